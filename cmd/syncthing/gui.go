@@ -91,6 +91,7 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	getRestMux.HandleFunc("/rest/model", withModel(m, restGetModel))
 	getRestMux.HandleFunc("/rest/model/version", withModel(m, restGetModelVersion))
 	getRestMux.HandleFunc("/rest/need", withModel(m, restGetNeed))
+	getRestMux.HandleFunc("/rest/scanerrors", withModel(m, restGetScanErrors))
 	getRestMux.HandleFunc("/rest/connections", withModel(m, restGetConnections))
 	getRestMux.HandleFunc("/rest/config", restGetConfig)
 	getRestMux.HandleFunc("/rest/config/sync", restGetConfigInSync)
@@ -109,6 +110,7 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	postRestMux.HandleFunc("/rest/error/clear", restClearErrors)
 	postRestMux.HandleFunc("/rest/discovery/hint", restPostDiscoveryHint)
 	postRestMux.HandleFunc("/rest/model/override", withModel(m, restPostOverride))
+	postRestMux.HandleFunc("/rest/bump", withModel(m, restPostBump))
 
 	// A handler that splits requests between the two above and disables
 	// caching
@@ -205,6 +207,7 @@ func restGetModel(m *model.Model, w http.ResponseWriter, r *http.Request) {
 
 	res["state"] = m.State(repo)
 	res["version"] = m.Version(repo)
+	res["scanErrors"] = len(m.ScanErrors(repo))
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(res)
@@ -216,6 +219,15 @@ func restPostOverride(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	m.Override(repo)
 }
 
+func restPostBump(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+	var file = qs.Get("file")
+	if err := m.Bump(repo, file); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
 func restGetNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var repo = qs.Get("repo")
@@ -226,6 +238,16 @@ func restGetNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(files)
 }
 
+func restGetScanErrors(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+
+	errs := m.ScanErrors(repo)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(errs)
+}
+
 func restGetConnections(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var res = m.ConnectionStats()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -10,7 +10,6 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/calmh/syncthing/osutil"
 )
@@ -88,27 +87,18 @@ func newCsrfToken() string {
 
 func saveCsrfTokens() {
 	name := filepath.Join(confDir, "csrftokens.txt")
-	tmp := fmt.Sprintf("%s.tmp.%d", name, time.Now().UnixNano())
 
-	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	f, err := osutil.CreateAtomic(name, 0644)
 	if err != nil {
 		return
 	}
-	defer os.Remove(tmp)
+	f.Sync = cfg.Options.SyncWrites
 
 	for _, t := range csrfTokens {
-		_, err := fmt.Fprintln(f, t)
-		if err != nil {
-			return
-		}
-	}
-
-	err = f.Close()
-	if err != nil {
-		return
+		fmt.Fprintln(f, t)
 	}
 
-	osutil.Rename(tmp, name)
+	f.Close()
 }
 
 func loadCsrfTokens() {
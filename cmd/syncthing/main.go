@@ -289,16 +289,24 @@ func main() {
 		rateBucket = ratelimit.NewBucketWithRate(float64(1000*cfg.Options.MaxSendKbps), int64(5*1000*cfg.Options.MaxSendKbps))
 	}
 
-	havePersistentIndex := false
+	// The index entries gained local versions, so an index database in the
+	// older format is removed and rebuilt by scanning.
 	if fi, err := os.Stat(filepath.Join(confDir, "index")); err == nil && fi.IsDir() {
+		l.Infoln("Removing index database in old format")
+		os.RemoveAll(filepath.Join(confDir, "index"))
+	}
+
+	indexDir := filepath.Join(confDir, "index-v1")
+	havePersistentIndex := false
+	if fi, err := os.Stat(indexDir); err == nil && fi.IsDir() {
 		havePersistentIndex = true
 	}
 
-	db, err := leveldb.OpenFile(filepath.Join(confDir, "index"), nil)
+	db, err := leveldb.OpenFile(indexDir, nil)
 	if err != nil {
 		l.Fatalln("leveldb.OpenFile():", err)
 	}
-	m := model.NewModel(confDir, &cfg, "syncthing", Version, db)
+	m := model.NewModel(confDir, &cfg, myID, "syncthing", Version, db)
 
 nextRepo:
 	for i, repo := range cfg.Repositories {
@@ -564,26 +572,21 @@ var saveConfigCh = make(chan struct{})
 
 func saveConfigLoop(cfgFile string) {
 	for _ = range saveConfigCh {
-		fd, err := os.Create(cfgFile + ".tmp")
+		fd, err := osutil.CreateAtomic(cfgFile, 0644)
 		if err != nil {
 			l.Warnln(err)
 			continue
 		}
+		fd.Sync = cfg.Options.SyncWrites
 
 		err = config.Save(fd, cfg)
 		if err != nil {
 			l.Warnln(err)
-			fd.Close()
+			fd.Abort()
 			continue
 		}
 
 		err = fd.Close()
-		if err != nil {
-			l.Warnln(err)
-			continue
-		}
-
-		err = osutil.Rename(cfgFile+".tmp", cfgFile)
 		if err != nil {
 			l.Warnln(err)
 		}
@@ -6,14 +6,17 @@
 package config
 
 import (
+	"encoding/binary"
 	"encoding/xml"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"os"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
+	"time"
 
 	"code.google.com/p/go.crypto/bcrypt"
 	"github.com/calmh/syncthing/logger"
@@ -65,6 +68,8 @@ type RepositoryConfiguration struct {
 	Nodes             []NodeConfiguration     `xml:"node"`
 	ReadOnly          bool                    `xml:"ro,attr"`
 	IgnorePerms       bool                    `xml:"ignorePerms,attr"`
+	LargeBlocks       bool                    `xml:"largeBlocks,attr"`
+	PullOrder         string                  `xml:"pullOrder,attr,omitempty"`
 	Invalid           string                  `xml:"-"` // Set at runtime when there is an error, not saved
 	Versioning        VersioningConfiguration `xml:"versioning"`
 	SyncOrderPatterns []SyncOrderPattern      `xml:"syncorder>pattern"`
@@ -122,6 +127,17 @@ func (r *RepositoryConfiguration) NodeIDs() []protocol.NodeID {
 	return r.nodeIDs
 }
 
+// Permission returns the sharing permission of the given node for the
+// repository.
+func (r RepositoryConfiguration) Permission(node protocol.NodeID) string {
+	for _, n := range r.Nodes {
+		if n.NodeID == node && n.Permission != "" {
+			return n.Permission
+		}
+	}
+	return PermissionTrusted
+}
+
 func (r RepositoryConfiguration) FileRanker() func(scanner.File) int {
 	if len(r.SyncOrderPatterns) <= 0 {
 		return nil
@@ -137,10 +153,98 @@ func (r RepositoryConfiguration) FileRanker() func(scanner.File) int {
 	}
 }
 
+// The orders in which files can be pulled. An empty pull order means that
+// files are pulled in the order given by the sync order patterns only.
+const (
+	PullOrderAlphabetic    = "alphabetic"
+	PullOrderRandom        = "random"
+	PullOrderSmallestFirst = "smallestFirst"
+	PullOrderLargestFirst  = "largestFirst"
+	PullOrderOldestFirst   = "oldestFirst"
+	PullOrderNewestFirst   = "newestFirst"
+)
+
+// The seed for the random pull order. It stays the same for the lifetime of
+// the process so that the order of a given set of files is stable.
+var randomOrderSeed = uint32(time.Now().UnixNano())
+
+func pullOrderLess(order string) func(a, b scanner.File) bool {
+	switch order {
+	case PullOrderAlphabetic:
+		return func(a, b scanner.File) bool { return a.Name < b.Name }
+	case PullOrderRandom:
+		return func(a, b scanner.File) bool { return randomKey(a.Name) < randomKey(b.Name) }
+	case PullOrderSmallestFirst:
+		return func(a, b scanner.File) bool { return a.Size < b.Size }
+	case PullOrderLargestFirst:
+		return func(a, b scanner.File) bool { return a.Size > b.Size }
+	case PullOrderOldestFirst:
+		return func(a, b scanner.File) bool { return a.Modified < b.Modified }
+	case PullOrderNewestFirst:
+		return func(a, b scanner.File) bool { return a.Modified > b.Modified }
+	}
+	return nil
+}
+
+func randomKey(name string) uint32 {
+	h := fnv.New32a()
+	binary.Write(h, binary.BigEndian, randomOrderSeed)
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+func validPullOrder(order string) bool {
+	return order == "" || pullOrderLess(order) != nil
+}
+
+// FileLess returns a function that is true when file a should be pulled
+// before file b, or nil if the repository has neither a pull order nor sync
+// order patterns. Files are ordered by the pull order, and then by the
+// priorities of the sync order patterns.
+func (r RepositoryConfiguration) FileLess() func(a, b scanner.File) bool {
+	order := pullOrderLess(r.PullOrder)
+	ranker := r.FileRanker()
+	if order == nil && ranker == nil {
+		return nil
+	}
+	return func(a, b scanner.File) bool {
+		if order != nil {
+			if order(a, b) {
+				return true
+			}
+			if order(b, a) {
+				return false
+			}
+		}
+		if ranker != nil {
+			return ranker(a) > ranker(b)
+		}
+		return false
+	}
+}
+
 type NodeConfiguration struct {
-	NodeID    protocol.NodeID `xml:"id,attr"`
-	Name      string          `xml:"name,attr,omitempty"`
-	Addresses []string        `xml:"address,omitempty"`
+	NodeID      protocol.NodeID `xml:"id,attr"`
+	Name        string          `xml:"name,attr,omitempty"`
+	Addresses   []string        `xml:"address,omitempty"`
+	Compression string          `xml:"compression,attr,omitempty"` // "never", "metadata" (the default) or "always"
+	Permission  string          `xml:"permission,attr,omitempty"`  // Only used in repository node lists
+}
+
+// The sharing permissions a node can have for a repository. An empty
+// permission is the same as PermissionTrusted.
+const (
+	PermissionTrusted     = "trusted"     // changes are exchanged in both directions
+	PermissionReadOnly    = "readonly"    // the node publishes changes but does not accept any
+	PermissionReceiveOnly = "receiveonly" // the node accepts changes but may not make any
+)
+
+func validPermission(p string) bool {
+	switch p {
+	case "", PermissionTrusted, PermissionReadOnly, PermissionReceiveOnly:
+		return true
+	}
+	return false
 }
 
 type OptionsConfiguration struct {
@@ -150,12 +254,14 @@ type OptionsConfiguration struct {
 	LocalAnnEnabled    bool     `xml:"localAnnounceEnabled" default:"true"`
 	LocalAnnPort       int      `xml:"localAnnouncePort" default:"21025"`
 	ParallelRequests   int      `xml:"parallelRequests" default:"16"`
+	RequestTimeoutS    int      `xml:"requestTimeoutS" default:"60"`
 	MaxSendKbps        int      `xml:"maxSendKbps"`
 	RescanIntervalS    int      `xml:"rescanIntervalS" default:"60"`
 	ReconnectIntervalS int      `xml:"reconnectionIntervalS" default:"60"`
 	MaxChangeKbps      int      `xml:"maxChangeKbps" default:"10000"`
 	StartBrowser       bool     `xml:"startBrowser" default:"true"`
 	UPnPEnabled        bool     `xml:"upnpEnabled" default:"true"`
+	SyncWrites         bool     `xml:"syncWrites" default:"true"`
 	URAccepted         int      `xml:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
 
 	Deprecated_UREnabled  bool   `xml:"urEnabled,omitempty" json:"-"`
@@ -326,6 +432,19 @@ func Load(rd io.Reader, myID protocol.NodeID) (Configuration, error) {
 		} else {
 			seenRepos[repo.ID] = repo
 		}
+
+		if !validPullOrder(repo.PullOrder) {
+			l.Warnf("Unknown pull order %q for repository %q; using the default", repo.PullOrder, repo.ID)
+			repo.PullOrder = ""
+		}
+
+		for j := range repo.Nodes {
+			node := &repo.Nodes[j]
+			if !validPermission(node.Permission) {
+				l.Warnf("Unknown permission %q for node %s in repository %q; using %q", node.Permission, node.NodeID, repo.ID, PermissionTrusted)
+				node.Permission = ""
+			}
+		}
 	}
 
 	if cfg.Options.Deprecated_URDeclined {
@@ -361,6 +480,13 @@ func Load(rd io.Reader, myID protocol.NodeID) (Configuration, error) {
 		if len(n.Addresses) == 0 || len(n.Addresses) == 1 && n.Addresses[0] == "" {
 			n.Addresses = []string{"dynamic"}
 		}
+
+		switch n.Compression {
+		case "", protocol.CompressNever, protocol.CompressMetadata, protocol.CompressAlways:
+		default:
+			l.Warnf("Unknown compression mode %q for node %s; using %q", n.Compression, n.NodeID, protocol.CompressMetadata)
+			n.Compression = ""
+		}
 	}
 
 	return cfg, err
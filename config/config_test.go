@@ -33,12 +33,14 @@ func TestDefaultValues(t *testing.T) {
 		LocalAnnEnabled:    true,
 		LocalAnnPort:       21025,
 		ParallelRequests:   16,
+		RequestTimeoutS:    60,
 		MaxSendKbps:        0,
 		RescanIntervalS:    60,
 		ReconnectIntervalS: 60,
 		MaxChangeKbps:      10000,
 		StartBrowser:       true,
 		UPnPEnabled:        true,
+		SyncWrites:         true,
 	}
 
 	cfg, err := Load(bytes.NewReader(nil), node1)
@@ -155,12 +157,14 @@ func TestOverriddenValues(t *testing.T) {
         <localAnnounceEnabled>false</localAnnounceEnabled>
         <localAnnouncePort>42123</localAnnouncePort>
         <parallelRequests>32</parallelRequests>
+        <requestTimeoutS>120</requestTimeoutS>
         <maxSendKbps>1234</maxSendKbps>
         <rescanIntervalS>600</rescanIntervalS>
         <reconnectionIntervalS>6000</reconnectionIntervalS>
         <maxChangeKbps>2345</maxChangeKbps>
         <startBrowser>false</startBrowser>
         <upnpEnabled>false</upnpEnabled>
+        <syncWrites>false</syncWrites>
     </options>
 </configuration>
 `)
@@ -172,12 +176,14 @@ func TestOverriddenValues(t *testing.T) {
 		LocalAnnEnabled:    false,
 		LocalAnnPort:       42123,
 		ParallelRequests:   32,
+		RequestTimeoutS:    120,
 		MaxSendKbps:        1234,
 		RescanIntervalS:    600,
 		ReconnectIntervalS: 6000,
 		MaxChangeKbps:      2345,
 		StartBrowser:       false,
 		UPnPEnabled:        false,
+		SyncWrites:         false,
 	}
 
 	cfg, err := Load(bytes.NewReader(data), node1)
@@ -290,6 +296,7 @@ func TestFileSorter(t *testing.T) {
 
 	files.SortBy(rcfg.FileRanker()).Sort(f)
 
+	// Files of equal rank keep their relative order from the input.
 	expected := []scanner.File{
 		{Name: "camera-uploads/foo.jpg"},
 		{Name: "camera-uploads/herp.mov"},
@@ -299,8 +306,8 @@ func TestFileSorter(t *testing.T) {
 		{Name: "frew/foo.jpg"},
 		{Name: "bar.mov"},
 		{Name: "frew/bar.mov"},
-		{Name: "frew/lol.go"},
 		{Name: "baz.txt"},
+		{Name: "frew/lol.go"},
 		{Name: "frew/rofl.copter"},
 	}
 
@@ -314,6 +321,81 @@ func TestFileSorter(t *testing.T) {
 	}
 }
 
+func TestPullOrder(t *testing.T) {
+	f := []scanner.File{
+		{Name: "b.jpg", Size: 300, Modified: 1},
+		{Name: "a.txt", Size: 100, Modified: 3},
+		{Name: "d.txt", Size: 200, Modified: 2},
+		{Name: "c.jpg", Size: 200, Modified: 4},
+	}
+
+	patterns := []SyncOrderPattern{{"\\.jpg$", 10, nil}}
+
+	cases := []struct {
+		order    string
+		expected []string
+	}{
+		{PullOrderAlphabetic, []string{"a.txt", "b.jpg", "c.jpg", "d.txt"}},
+		{PullOrderSmallestFirst, []string{"a.txt", "c.jpg", "d.txt", "b.jpg"}},
+		{PullOrderLargestFirst, []string{"b.jpg", "c.jpg", "d.txt", "a.txt"}},
+		{PullOrderOldestFirst, []string{"b.jpg", "d.txt", "a.txt", "c.jpg"}},
+		{PullOrderNewestFirst, []string{"c.jpg", "a.txt", "d.txt", "b.jpg"}},
+		{"", []string{"b.jpg", "c.jpg", "a.txt", "d.txt"}},
+	}
+
+	for _, tc := range cases {
+		rcfg := RepositoryConfiguration{PullOrder: tc.order, SyncOrderPatterns: patterns}
+		sf := append([]scanner.File(nil), f...)
+		files.Less(rcfg.FileLess()).Sort(sf)
+
+		var names []string
+		for _, f := range sf {
+			names = append(names, f.Name)
+		}
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("%q: incorrect order %v != %v", tc.order, names, tc.expected)
+		}
+	}
+
+	rcfg := RepositoryConfiguration{PullOrder: PullOrderRandom}
+	s0 := append([]scanner.File(nil), f...)
+	s1 := append([]scanner.File(nil), f[2:]...)
+	s1 = append(s1, f[:2]...)
+	files.Less(rcfg.FileLess()).Sort(s0)
+	files.Less(rcfg.FileLess()).Sort(s1)
+	if !reflect.DeepEqual(s0, s1) {
+		t.Error("Random order is not stable")
+	}
+
+	if (RepositoryConfiguration{}).FileLess() != nil {
+		t.Error("Unexpected order function without pull order or patterns")
+	}
+}
+
+func TestPullOrderConfig(t *testing.T) {
+	data := []byte(`<configuration version="2">
+    <repository id="photos" directory="~/Photos" pullOrder="newestFirst">
+    </repository>
+    <repository id="backup" directory="~/Backup" pullOrder="smallestFirst">
+    </repository>
+    <repository id="other" directory="~/Other" pullOrder="sideways">
+    </repository>
+</configuration>
+`)
+
+	cfg, err := Load(bytes.NewReader(data), node1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{PullOrderNewestFirst, PullOrderSmallestFirst, ""}
+	for i, e := range expected {
+		if o := cfg.Repositories[i].PullOrder; o != e {
+			t.Errorf("%d: incorrect pull order %q != %q", i, o, e)
+		}
+	}
+}
+
 func formatFiles(f []scanner.File) string {
 	ret := ""
 
@@ -323,3 +405,34 @@ func formatFiles(f []scanner.File) string {
 
 	return ret
 }
+
+func TestNodePermissions(t *testing.T) {
+	data := []byte(`
+<configuration version="2">
+    <repository id="test" directory="~/Sync">
+        <node id="AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ"/>
+        <node id="GYRZZQBIRNPV4T7TC52WEQYJ3TFDQW6MWDFLMU4SSSU6EMFBK2VA" permission="readonly"/>
+        <node id="LGFPDIT7SKNNJVJZA4FC7QNCRKCE753K72BW5QD2FOZ7FRFEP57Q" permission="receiveonly"/>
+        <node id="P56IOI7MZJNU2IQGDREYDM2MGTMGL3BXNPQ6W5BTBBZ4TJXZWICQ" permission="bogus"/>
+    </repository>
+</configuration>
+`)
+
+	cfg, err := Load(bytes.NewReader(data), node4)
+	if err != nil {
+		t.Error(err)
+	}
+
+	repo := cfg.Repositories[0]
+	expected := map[protocol.NodeID]string{
+		node1: PermissionTrusted,
+		node2: PermissionReadOnly,
+		node3: PermissionReceiveOnly,
+		node4: PermissionTrusted,
+	}
+	for node, perm := range expected {
+		if p := repo.Permission(node); p != perm {
+			t.Errorf("Incorrect permission for %s: %q != %q", node, p, perm)
+		}
+	}
+}
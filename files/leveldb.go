@@ -27,6 +27,21 @@ type versionList struct {
 	versions []fileVersion
 }
 
+// nodeFilter returns true for the nodes whose files count towards the
+// global version of a file.
+type nodeFilter func(node []byte) bool
+
+// global returns the index of the global version in the list, the highest
+// version of a node accepted by the filter, or -1 if there is none.
+func (vl versionList) global(filter nodeFilter) int {
+	for i, v := range vl.versions {
+		if filter(v.node) {
+			return i
+		}
+	}
+	return -1
+}
+
 type fileList []scanner.File
 
 func (l fileList) Len() int {
@@ -92,11 +107,15 @@ func globalKeyName(key []byte) []byte {
 	return key[1+64:]
 }
 
-type deletionHandler func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator) bool
+type deletionHandler func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator, localVersion *uint64) bool
 
 type fileIterator func(f scanner.File) bool
 
-func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []scanner.File, deleteFn deletionHandler) bool {
+// The functions changing the files of a node take a pointer to the local
+// version counter of the repository when the node is the local node, and
+// nil otherwise. Each changed local file gets the next local version.
+
+func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []scanner.File, localVersion *uint64, deleteFn deletionHandler) bool {
 	sort.Sort(fileList(fs)) // sort list on name, same as on disk
 
 	start := nodeKey(repo, node, nil)                            // before all repo/node files
@@ -147,7 +166,7 @@ func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []scanner.File, del
 		case moreFs && (!moreDb || cmp == -1):
 			changed = true
 			// Disk is missing this file. Insert it.
-			ldbInsert(batch, repo, node, newName, fs[fsi])
+			ldbInsert(batch, repo, node, newName, fs[fsi], localVersion)
 			ldbUpdateGlobal(snap, batch, repo, node, newName, fs[fsi].Version)
 			fsi++
 
@@ -156,7 +175,7 @@ func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []scanner.File, del
 			var ef scanner.File
 			ef.UnmarshalXDR(dbi.Value())
 			if fs[fsi].Version > ef.Version {
-				ldbInsert(batch, repo, node, newName, fs[fsi])
+				ldbInsert(batch, repo, node, newName, fs[fsi], localVersion)
 				ldbUpdateGlobal(snap, batch, repo, node, newName, fs[fsi].Version)
 				changed = true
 			}
@@ -166,7 +185,7 @@ func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []scanner.File, del
 
 		case moreDb && (!moreFs || cmp == 1):
 			if deleteFn != nil {
-				if deleteFn(snap, batch, repo, node, oldName, dbi) {
+				if deleteFn(snap, batch, repo, node, oldName, dbi, localVersion) {
 					changed = true
 				}
 			}
@@ -182,8 +201,8 @@ func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []scanner.File, del
 	return changed
 }
 
-func ldbReplace(db *leveldb.DB, repo, node []byte, fs []scanner.File) bool {
-	return ldbGenericReplace(db, repo, node, fs, func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator) bool {
+func ldbReplace(db *leveldb.DB, repo, node []byte, fs []scanner.File, localVersion *uint64) bool {
+	return ldbGenericReplace(db, repo, node, fs, localVersion, func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator, localVersion *uint64) bool {
 		// Disk has files that we are missing. Remove it.
 		if debug {
 			l.Debugf("delete; repo=%q node=%x name=%q", repo, node, name)
@@ -194,8 +213,8 @@ func ldbReplace(db *leveldb.DB, repo, node []byte, fs []scanner.File) bool {
 	})
 }
 
-func ldbReplaceWithDelete(db *leveldb.DB, repo, node []byte, fs []scanner.File) bool {
-	return ldbGenericReplace(db, repo, node, fs, func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator) bool {
+func ldbReplaceWithDelete(db *leveldb.DB, repo, node []byte, fs []scanner.File, localVersion *uint64) bool {
+	return ldbGenericReplace(db, repo, node, fs, localVersion, func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator, localVersion *uint64) bool {
 		var f scanner.File
 		err := f.UnmarshalXDR(dbi.Value())
 		if err != nil {
@@ -207,16 +226,16 @@ func ldbReplaceWithDelete(db *leveldb.DB, repo, node []byte, fs []scanner.File)
 			}
 			f.Blocks = nil
 			f.Version = lamport.Default.Tick(f.Version)
-			f.Flags |= protocol.FlagDeleted
-			batch.Put(dbi.Key(), f.MarshalXDR())
-			ldbUpdateGlobal(db, batch, repo, node, nodeKeyName(dbi.Key()), f.Version)
+			f.Flags = f.Flags&^protocol.FlagBlockSizeBits | protocol.FlagDeleted
+			ldbInsert(batch, repo, node, name, f, localVersion)
+			ldbUpdateGlobal(db, batch, repo, node, name, f.Version)
 			return true
 		}
 		return false
 	})
 }
 
-func ldbUpdate(db *leveldb.DB, repo, node []byte, fs []scanner.File) bool {
+func ldbUpdate(db *leveldb.DB, repo, node []byte, fs []scanner.File, localVersion *uint64) bool {
 	batch := new(leveldb.Batch)
 	snap, err := db.GetSnapshot()
 	if err != nil {
@@ -229,7 +248,7 @@ func ldbUpdate(db *leveldb.DB, repo, node []byte, fs []scanner.File) bool {
 		fk := nodeKey(repo, node, name)
 		bs, err := snap.Get(fk, nil)
 		if err == leveldb.ErrNotFound {
-			ldbInsert(batch, repo, node, name, f)
+			ldbInsert(batch, repo, node, name, f, localVersion)
 			ldbUpdateGlobal(snap, batch, repo, node, name, f.Version)
 			continue
 		}
@@ -240,7 +259,7 @@ func ldbUpdate(db *leveldb.DB, repo, node []byte, fs []scanner.File) bool {
 			panic(err)
 		}
 		if ef.Version != f.Version {
-			ldbInsert(batch, repo, node, name, f)
+			ldbInsert(batch, repo, node, name, f, localVersion)
 			ldbUpdateGlobal(snap, batch, repo, node, name, f.Version)
 		}
 	}
@@ -253,7 +272,11 @@ func ldbUpdate(db *leveldb.DB, repo, node []byte, fs []scanner.File) bool {
 	return true
 }
 
-func ldbInsert(batch dbWriter, repo, node, name []byte, file scanner.File) {
+func ldbInsert(batch dbWriter, repo, node, name []byte, file scanner.File, localVersion *uint64) {
+	if localVersion != nil {
+		*localVersion++
+		file.LocalVersion = *localVersion
+	}
 	if debug {
 		l.Debugf("insert; repo=%q node=%x %v", repo, node, file)
 	}
@@ -391,7 +414,7 @@ func ldbGet(db *leveldb.DB, repo, node, file []byte) scanner.File {
 	return f
 }
 
-func ldbGetGlobal(db *leveldb.DB, repo, file []byte) scanner.File {
+func ldbGetGlobal(db *leveldb.DB, repo, file []byte, filter nodeFilter) scanner.File {
 	k := globalKey(repo, file)
 	snap, err := db.GetSnapshot()
 	if err != nil {
@@ -416,8 +439,12 @@ func ldbGetGlobal(db *leveldb.DB, repo, file []byte) scanner.File {
 		l.Debugln(k)
 		panic("no versions?")
 	}
+	g := vl.global(filter)
+	if g < 0 {
+		return scanner.File{}
+	}
 
-	k = nodeKey(repo, vl.versions[0].node, file)
+	k = nodeKey(repo, vl.versions[g].node, file)
 	bs, err = snap.Get(k, nil)
 	if err != nil {
 		panic(err)
@@ -431,7 +458,7 @@ func ldbGetGlobal(db *leveldb.DB, repo, file []byte) scanner.File {
 	return f
 }
 
-func ldbWithGlobal(db *leveldb.DB, repo []byte, fn fileIterator) {
+func ldbWithGlobal(db *leveldb.DB, repo []byte, filter nodeFilter, fn fileIterator) {
 	start := globalKey(repo, nil)
 	limit := globalKey(repo, []byte{0xff, 0xff, 0xff, 0xff})
 	snap, err := db.GetSnapshot()
@@ -452,7 +479,11 @@ func ldbWithGlobal(db *leveldb.DB, repo []byte, fn fileIterator) {
 			l.Debugln(dbi.Key())
 			panic("no versions?")
 		}
-		fk := nodeKey(repo, vl.versions[0].node, globalKeyName(dbi.Key()))
+		g := vl.global(filter)
+		if g < 0 {
+			continue
+		}
+		fk := nodeKey(repo, vl.versions[g].node, globalKeyName(dbi.Key()))
 		bs, err := snap.Get(fk, nil)
 		if err != nil {
 			panic(err)
@@ -470,7 +501,7 @@ func ldbWithGlobal(db *leveldb.DB, repo []byte, fn fileIterator) {
 	}
 }
 
-func ldbAvailability(db *leveldb.DB, repo, file []byte) []protocol.NodeID {
+func ldbAvailability(db *leveldb.DB, repo, file []byte, filter nodeFilter) []protocol.NodeID {
 	k := globalKey(repo, file)
 	bs, err := db.Get(k, nil)
 	if err == leveldb.ErrNotFound {
@@ -486,11 +517,19 @@ func ldbAvailability(db *leveldb.DB, repo, file []byte) []protocol.NodeID {
 		panic(err)
 	}
 
+	g := vl.global(filter)
+	if g < 0 {
+		return nil
+	}
+
 	var nodes []protocol.NodeID
-	for _, v := range vl.versions {
-		if v.version != vl.versions[0].version {
+	for _, v := range vl.versions[g:] {
+		if v.version != vl.versions[g].version {
 			break
 		}
+		if !filter(v.node) {
+			continue
+		}
 		var n protocol.NodeID
 		copy(n[:], v.node)
 		nodes = append(nodes, n)
@@ -499,7 +538,7 @@ func ldbAvailability(db *leveldb.DB, repo, file []byte) []protocol.NodeID {
 	return nodes
 }
 
-func ldbWithNeed(db *leveldb.DB, repo, node []byte, fn fileIterator) {
+func ldbWithNeed(db *leveldb.DB, repo, node []byte, filter nodeFilter, fn fileIterator) {
 	start := globalKey(repo, nil)
 	limit := globalKey(repo, []byte{0xff, 0xff, 0xff, 0xff})
 	snap, err := db.GetSnapshot()
@@ -520,6 +559,10 @@ func ldbWithNeed(db *leveldb.DB, repo, node []byte, fn fileIterator) {
 			l.Debugln(dbi.Key())
 			panic("no versions?")
 		}
+		g := vl.global(filter)
+		if g < 0 {
+			continue
+		}
 
 		have := false // If we have the file, any version
 		need := false // If we have a lower version of the file
@@ -528,7 +571,7 @@ func ldbWithNeed(db *leveldb.DB, repo, node []byte, fn fileIterator) {
 			if bytes.Compare(v.node, node) == 0 {
 				have = true
 				haveVersion = v.version
-				need = v.version < vl.versions[0].version
+				need = v.version < vl.versions[g].version
 				break
 			}
 		}
@@ -536,9 +579,9 @@ func ldbWithNeed(db *leveldb.DB, repo, node []byte, fn fileIterator) {
 		if need || !have {
 			name := globalKeyName(dbi.Key())
 			if debug {
-				l.Debugf("need repo=%q node=%x name=%q need=%v have=%v haveV=%d globalV=%d", repo, node, name, need, have, haveVersion, vl.versions[0].version)
+				l.Debugf("need repo=%q node=%x name=%q need=%v have=%v haveV=%d globalV=%d", repo, node, name, need, have, haveVersion, vl.versions[g].version)
 			}
-			fk := nodeKey(repo, vl.versions[0].node, name)
+			fk := nodeKey(repo, vl.versions[g].node, name)
 			bs, err := snap.Get(fk, nil)
 			if err != nil {
 				panic(err)
@@ -22,28 +22,46 @@ type fileRecord struct {
 type bitset uint64
 
 type Set struct {
-	changes map[protocol.NodeID]uint64
-	mutex   sync.Mutex
-	repo    string
-	db      *leveldb.DB
+	changes      map[protocol.NodeID]uint64
+	disconnected map[protocol.NodeID]bool
+	localVersion uint64 // the highest local version of the local node's files
+	mutex        sync.Mutex
+	repo         string
+	db           *leveldb.DB
 }
 
 func NewSet(repo string, db *leveldb.DB) *Set {
 	var s = Set{
-		changes: make(map[protocol.NodeID]uint64),
-		repo:    repo,
-		db:      db,
+		changes:      make(map[protocol.NodeID]uint64),
+		disconnected: make(map[protocol.NodeID]bool),
+		repo:         repo,
+		db:           db,
 	}
+	ldbWithHave(db, []byte(repo), protocol.LocalNodeID[:], func(f scanner.File) bool {
+		if f.LocalVersion > s.localVersion {
+			s.localVersion = f.LocalVersion
+		}
+		return true
+	})
 	return &s
 }
 
+// localVersionFor returns the local version counter to use when changing
+// the files of the node; nil unless it is the local node.
+func (s *Set) localVersionFor(node protocol.NodeID) *uint64 {
+	if node == protocol.LocalNodeID {
+		return &s.localVersion
+	}
+	return nil
+}
+
 func (s *Set) Replace(node protocol.NodeID, fs []scanner.File) {
 	if debug {
 		l.Debugf("%s Replace(%v, [%d])", s.repo, node, len(fs))
 	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if ldbReplace(s.db, []byte(s.repo), node[:], fs) {
+	if ldbReplace(s.db, []byte(s.repo), node[:], fs, s.localVersionFor(node)) {
 		s.changes[node]++
 	}
 }
@@ -54,7 +72,7 @@ func (s *Set) ReplaceWithDelete(node protocol.NodeID, fs []scanner.File) {
 	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if ldbReplaceWithDelete(s.db, []byte(s.repo), node[:], fs) {
+	if ldbReplaceWithDelete(s.db, []byte(s.repo), node[:], fs, s.localVersionFor(node)) {
 		s.changes[node]++
 	}
 }
@@ -65,7 +83,7 @@ func (s *Set) Update(node protocol.NodeID, fs []scanner.File) {
 	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if ldbUpdate(s.db, []byte(s.repo), node[:], fs) {
+	if ldbUpdate(s.db, []byte(s.repo), node[:], fs, s.localVersionFor(node)) {
 		s.changes[node]++
 	}
 }
@@ -74,7 +92,7 @@ func (s *Set) WithNeed(node protocol.NodeID, fn fileIterator) {
 	if debug {
 		l.Debugf("%s Need(%v)", s.repo, node)
 	}
-	ldbWithNeed(s.db, []byte(s.repo), node[:], fn)
+	ldbWithNeed(s.db, []byte(s.repo), node[:], s.connected(), fn)
 }
 
 func (s *Set) WithHave(node protocol.NodeID, fn fileIterator) {
@@ -88,7 +106,7 @@ func (s *Set) WithGlobal(fn fileIterator) {
 	if debug {
 		l.Debugf("%s WithGlobal()", s.repo)
 	}
-	ldbWithGlobal(s.db, []byte(s.repo), fn)
+	ldbWithGlobal(s.db, []byte(s.repo), s.connected(), fn)
 }
 
 func (s *Set) Get(node protocol.NodeID, file string) scanner.File {
@@ -96,11 +114,11 @@ func (s *Set) Get(node protocol.NodeID, file string) scanner.File {
 }
 
 func (s *Set) GetGlobal(file string) scanner.File {
-	return ldbGetGlobal(s.db, []byte(s.repo), []byte(file))
+	return ldbGetGlobal(s.db, []byte(s.repo), []byte(file), s.connected())
 }
 
 func (s *Set) Availability(file string) []protocol.NodeID {
-	return ldbAvailability(s.db, []byte(s.repo), []byte(file))
+	return ldbAvailability(s.db, []byte(s.repo), []byte(file), s.connected())
 }
 
 func (s *Set) Changes(node protocol.NodeID) uint64 {
@@ -108,3 +126,56 @@ func (s *Set) Changes(node protocol.NodeID) uint64 {
 	defer s.mutex.Unlock()
 	return s.changes[node]
 }
+
+// LocalVersion returns the highest local version of the node's files. For
+// remote nodes it is the highest local version the node has sent.
+func (s *Set) LocalVersion(node protocol.NodeID) uint64 {
+	if node == protocol.LocalNodeID {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return s.localVersion
+	}
+	var max uint64
+	ldbWithHave(s.db, []byte(s.repo), node[:], func(f scanner.File) bool {
+		if f.LocalVersion > max {
+			max = f.LocalVersion
+		}
+		return true
+	})
+	return max
+}
+
+// SetConnected marks the node as connected or not. The files of a node that
+// is not connected are kept, but don't count towards the global version,
+// need or availability of a file. Nodes are connected until marked
+// otherwise.
+func (s *Set) SetConnected(node protocol.NodeID, connected bool) {
+	if debug {
+		l.Debugf("%s SetConnected(%v, %v)", s.repo, node, connected)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.disconnected[node] == connected {
+		if connected {
+			delete(s.disconnected, node)
+		} else {
+			s.disconnected[node] = true
+		}
+		s.changes[node]++
+	}
+}
+
+// connected returns a filter accepting the nodes currently connected.
+func (s *Set) connected() nodeFilter {
+	s.mutex.Lock()
+	disconnected := make(map[protocol.NodeID]bool, len(s.disconnected))
+	for node := range s.disconnected {
+		disconnected[node] = true
+	}
+	s.mutex.Unlock()
+	return func(node []byte) bool {
+		var n protocol.NodeID
+		copy(n[:], node)
+		return !disconnected[n]
+	}
+}
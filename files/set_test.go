@@ -37,9 +37,13 @@ func genBlocks(n int) []scanner.Block {
 	return b
 }
 
+// The list helpers clear the local versions, which are tested separately
+// in TestLocalVersion.
+
 func globalList(s *files.Set) []scanner.File {
 	var fs []scanner.File
 	s.WithGlobal(func(f scanner.File) bool {
+		f.LocalVersion = 0
 		fs = append(fs, f)
 		return true
 	})
@@ -49,6 +53,7 @@ func globalList(s *files.Set) []scanner.File {
 func haveList(s *files.Set, n protocol.NodeID) []scanner.File {
 	var fs []scanner.File
 	s.WithHave(n, func(f scanner.File) bool {
+		f.LocalVersion = 0
 		fs = append(fs, f)
 		return true
 	})
@@ -58,6 +63,7 @@ func haveList(s *files.Set, n protocol.NodeID) []scanner.File {
 func needList(s *files.Set, n protocol.NodeID) []scanner.File {
 	var fs []scanner.File
 	s.WithNeed(n, func(f scanner.File) bool {
+		f.LocalVersion = 0
 		fs = append(fs, f)
 		return true
 	})
@@ -185,6 +191,7 @@ func TestGlobalSet(t *testing.T) {
 	}
 
 	f := m.Get(protocol.LocalNodeID, "b")
+	f.LocalVersion = 0
 	if fmt.Sprint(f) != fmt.Sprint(localTot[1]) {
 		t.Errorf("Get incorrect;\n A: %v !=\n E: %v", f, localTot[1])
 	}
@@ -594,3 +601,115 @@ func TestChanges(t *testing.T) {
 		t.Fatal("Change number should be unchanged")
 	}
 }
+
+func TestLocalVersion(t *testing.T) {
+	lamport.Default = lamport.Clock{}
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := files.NewSet("test", db)
+
+	local := []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1000},
+	}
+
+	localVersions := func(n protocol.NodeID) map[string]uint64 {
+		lvs := make(map[string]uint64)
+		m.WithHave(n, func(f scanner.File) bool {
+			lvs[f.Name] = f.LocalVersion
+			return true
+		})
+		return lvs
+	}
+
+	m.ReplaceWithDelete(protocol.LocalNodeID, local)
+	if lvs := localVersions(protocol.LocalNodeID); lvs["a"] != 1 || lvs["b"] != 2 {
+		t.Errorf("Incorrect local versions %v", lvs)
+	}
+
+	// Only changed files get a new local version, including deleted ones.
+	m.ReplaceWithDelete(protocol.LocalNodeID, local[:1])
+	m.Update(protocol.LocalNodeID, []scanner.File{{Name: "c", Version: 1000}})
+	if lvs := localVersions(protocol.LocalNodeID); lvs["a"] != 1 || lvs["b"] != 3 || lvs["c"] != 4 {
+		t.Errorf("Incorrect local versions %v", lvs)
+	}
+	if lv := m.LocalVersion(protocol.LocalNodeID); lv != 4 {
+		t.Errorf("Incorrect local version %d != 4", lv)
+	}
+
+	// Remote files keep the local versions of the sender.
+	m.Replace(remoteNode, []scanner.File{{Name: "a", Version: 1000, LocalVersion: 10}, {Name: "d", Version: 900, LocalVersion: 20}})
+	if lvs := localVersions(remoteNode); lvs["a"] != 10 || lvs["d"] != 20 {
+		t.Errorf("Incorrect remote local versions %v", lvs)
+	}
+	if lv := m.LocalVersion(remoteNode); lv != 20 {
+		t.Errorf("Incorrect remote local version %d != 20", lv)
+	}
+
+	// The counter continues from the index in the database.
+	m = files.NewSet("test", db)
+	m.Update(protocol.LocalNodeID, []scanner.File{{Name: "e", Version: 1000}})
+	if lvs := localVersions(protocol.LocalNodeID); lvs["e"] != 5 {
+		t.Errorf("Incorrect local versions %v", lvs)
+	}
+}
+
+func TestDisconnectedNode(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := files.NewSet("test", db)
+
+	local := []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1000},
+	}
+
+	remote := []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1001},
+		scanner.File{Name: "c", Version: 1000},
+	}
+
+	m.ReplaceWithDelete(protocol.LocalNodeID, local)
+	m.Replace(remoteNode, remote)
+
+	// The files of a disconnected node are kept but don't count.
+	c0 := m.Changes(remoteNode)
+	m.SetConnected(remoteNode, false)
+	if m.Changes(remoteNode) == c0 {
+		t.Error("Change number should have incremented")
+	}
+
+	if g := globalList(m); fmt.Sprint(g) != fmt.Sprint(local) {
+		t.Errorf("Global incorrect;\n%v !=\n%v", g, local)
+	}
+	if n := needList(m, protocol.LocalNodeID); len(n) != 0 {
+		t.Errorf("Need incorrect; %v", n)
+	}
+	if f := m.GetGlobal("c"); f.Name != "" {
+		t.Errorf("GetGlobal incorrect; %v", f)
+	}
+	if a := m.Availability("a"); len(a) != 1 || a[0] != protocol.LocalNodeID {
+		t.Errorf("Availability incorrect; %v", a)
+	}
+	if h := haveList(m, remoteNode); fmt.Sprint(h) != fmt.Sprint(remote) {
+		t.Errorf("Have incorrect;\n%v !=\n%v", h, remote)
+	}
+
+	m.SetConnected(remoteNode, true)
+
+	shouldNeed := remote[1:]
+	if n := needList(m, protocol.LocalNodeID); fmt.Sprint(n) != fmt.Sprint(shouldNeed) {
+		t.Errorf("Need incorrect;\n%v !=\n%v", n, shouldNeed)
+	}
+	if a := m.Availability("b"); len(a) != 1 || a[0] != remoteNode {
+		t.Errorf("Availability incorrect; %v", a)
+	}
+}
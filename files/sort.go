@@ -8,17 +8,30 @@ import (
 
 type SortBy func(p scanner.File) int
 
+// Sort sorts the files by decreasing rank. Files of equal rank keep their
+// relative order.
 func (by SortBy) Sort(files []scanner.File) {
+	Less(func(a, b scanner.File) bool {
+		return by(a) > by(b)
+	}).Sort(files)
+}
+
+// Less reports whether file a sorts before file b.
+type Less func(a, b scanner.File) bool
+
+// Sort sorts the files in the order given by less. Files that are equal
+// in that order keep their relative order.
+func (less Less) Sort(files []scanner.File) {
 	ps := &fileSorter{
 		files: files,
-		by:    by,
+		less:  less,
 	}
-	sort.Sort(ps)
+	sort.Stable(ps)
 }
 
 type fileSorter struct {
 	files []scanner.File
-	by    func(p1 scanner.File) int
+	less  func(a, b scanner.File) bool
 }
 
 func (s *fileSorter) Len() int {
@@ -30,5 +43,5 @@ func (s *fileSorter) Swap(i, j int) {
 }
 
 func (s *fileSorter) Less(i, j int) bool {
-	return s.by(s.files[i]) > s.by(s.files[j])
+	return s.less(s.files[i], s.files[j])
 }
@@ -53,6 +53,7 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
     {id: 'RescanIntervalS', descr: 'Rescan Interval (s)', type: 'number'},
     {id: 'ReconnectIntervalS', descr: 'Reconnect Interval (s)', type: 'number'},
     {id: 'ParallelRequests', descr: 'Max Outstanding Requests', type: 'number'},
+    {id: 'RequestTimeoutS', descr: 'Request Timeout (s)', type: 'number'},
     {id: 'MaxChangeKbps', descr: 'Max File Change Rate (KiB/s)', type: 'number'},
 
     {id: 'LocalAnnPort', descr: 'Local Discovery Port', type: 'number'},
@@ -60,6 +61,7 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
     {id: 'GlobalAnnEnabled', descr: 'Global Discovery', type: 'bool'},
     {id: 'StartBrowser', descr: 'Start Browser', type: 'bool'},
     {id: 'UPnPEnabled', descr: 'Enable UPnP', type: 'bool'},
+    {id: 'SyncWrites', descr: 'Sync Files to Disk', type: 'bool'},
     {id: 'UREnabled', descr: 'Anonymous Usage Reporting', type: 'bool'},
     ];
 
@@ -481,21 +483,32 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
     $scope.editRepo = function (nodeCfg) {
         $scope.currentRepo = angular.copy(nodeCfg);
         $scope.currentRepo.selectedNodes = {};
+        $scope.currentRepo.permissions = {};
         $scope.currentRepo.Nodes.forEach(function (n) {
             $scope.currentRepo.selectedNodes[n.NodeID] = true;
+            $scope.currentRepo.permissions[n.NodeID] = n.Permission === "trusted" ? "" : n.Permission;
         });
+        $scope.currentRepo.fileVersioningSelector = "none";
         if ($scope.currentRepo.Versioning && $scope.currentRepo.Versioning.Type === "simple") {
-            $scope.currentRepo.simpleFileVersioning = true;
+            $scope.currentRepo.fileVersioningSelector = "simple";
             $scope.currentRepo.simpleKeep = +$scope.currentRepo.Versioning.Params.keep;
+        } else if ($scope.currentRepo.Versioning && $scope.currentRepo.Versioning.Type === "staggered") {
+            $scope.currentRepo.fileVersioningSelector = "staggered";
+            $scope.currentRepo.staggeredMaxAge = Math.floor(+$scope.currentRepo.Versioning.Params.maxAge / 86400);
+        } else if ($scope.currentRepo.Versioning && $scope.currentRepo.Versioning.Type === "trashcan") {
+            $scope.currentRepo.fileVersioningSelector = "trashcan";
+            $scope.currentRepo.trashcanCleanoutDays = +$scope.currentRepo.Versioning.Params.cleanoutDays;
         }
         $scope.currentRepo.simpleKeep = $scope.currentRepo.simpleKeep || 5;
+        $scope.currentRepo.staggeredMaxAge = $scope.currentRepo.staggeredMaxAge || 365;
+        $scope.currentRepo.trashcanCleanoutDays = $scope.currentRepo.trashcanCleanoutDays || 0;
         $scope.editingExisting = true;
         $scope.repoEditor.$setPristine();
         $('#editRepo').modal({backdrop: 'static', keyboard: true});
     };
 
     $scope.addRepo = function () {
-        $scope.currentRepo = {selectedNodes: {}};
+        $scope.currentRepo = {selectedNodes: {}, permissions: {}, fileVersioningSelector: "none", simpleKeep: 5, staggeredMaxAge: 365, trashcanCleanoutDays: 0};
         $scope.editingExisting = false;
         $scope.repoEditor.$setPristine();
         $('#editRepo').modal({backdrop: 'static', keyboard: true});
@@ -510,23 +523,40 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
         repoCfg.selectedNodes[$scope.myID] = true;
         for (var nodeID in repoCfg.selectedNodes) {
             if (repoCfg.selectedNodes[nodeID] === true) {
-                repoCfg.Nodes.push({NodeID: nodeID});
+                repoCfg.Nodes.push({NodeID: nodeID, Permission: repoCfg.permissions[nodeID] || ""});
             }
         }
         delete repoCfg.selectedNodes;
+        delete repoCfg.permissions;
 
-        if (repoCfg.simpleFileVersioning) {
+        if (repoCfg.fileVersioningSelector === "simple") {
             repoCfg.Versioning = {
                 'Type': 'simple',
                 'Params': {
                     'keep': '' + repoCfg.simpleKeep,
                 }
             };
-            delete repoCfg.simpleFileVersioning;
-            delete repoCfg.simpleKeep;
+        } else if (repoCfg.fileVersioningSelector === "staggered") {
+            repoCfg.Versioning = {
+                'Type': 'staggered',
+                'Params': {
+                    'maxAge': '' + (repoCfg.staggeredMaxAge * 86400),
+                }
+            };
+        } else if (repoCfg.fileVersioningSelector === "trashcan") {
+            repoCfg.Versioning = {
+                'Type': 'trashcan',
+                'Params': {
+                    'cleanoutDays': '' + repoCfg.trashcanCleanoutDays,
+                }
+            };
         } else {
             delete repoCfg.Versioning;
         }
+        delete repoCfg.fileVersioningSelector;
+        delete repoCfg.simpleKeep;
+        delete repoCfg.staggeredMaxAge;
+        delete repoCfg.trashcanCleanoutDays;
 
         $scope.repos[repoCfg.ID] = repoCfg;
         $scope.config.Repositories = repoList($scope.repos);
@@ -622,6 +652,7 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
 
     $scope.showNeed = function (repo) {
         $scope.neededLoaded = false;
+        $scope.neededRepo = repo;
         $('#needed').modal({backdrop: 'static', keyboard: true});
         $http.get(urlbase + "/need?repo=" + encodeURIComponent(repo)).success(function (data) {
             $scope.needed = data;
@@ -644,6 +675,10 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http) {
         }
     };
 
+    $scope.bump = function (repo, file) {
+        $http.post(urlbase + "/bump?repo=" + encodeURIComponent(repo) + "&file=" + encodeURIComponent(file));
+    };
+
     $scope.override = function (repo) {
         $http.post(urlbase + "/model/override?repo=" + encodeURIComponent(repo)).success(function () {
             $scope.refresh();
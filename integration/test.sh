@@ -131,7 +131,7 @@ alterFiles() {
 	pkill -CONT syncthing
 }
 
-rm -rf h?/*.idx.gz h?/index
+rm -rf h?/*.idx.gz h?/index h?/index-v1
 rm -rf s? s??-? s4d
 
 echo "Setting up files..."
@@ -5,15 +5,17 @@
 package model
 
 import (
+	"container/heap"
 	"sync"
 
 	"github.com/calmh/syncthing/scanner"
 )
 
 type bqAdd struct {
-	file scanner.File
-	have []scanner.Block
-	need []scanner.Block
+	file     scanner.File
+	have     []scanner.Block
+	need     []scanner.Block
+	priority int // files with higher priority are handed out first
 }
 
 type bqBlock struct {
@@ -24,40 +26,129 @@ type bqBlock struct {
 	last  bool
 }
 
-type blockQueue struct {
-	inbox  chan bqAdd
-	outbox chan bqBlock
+// A bqFile is a queued file and the blocks of it that remain to be handed
+// out.
+type bqFile struct {
+	file     scanner.File
+	blocks   []bqBlock
+	priority int
+	front    int    // order of moving to the front; zero if never moved
+	seq      uint64 // order of insertion
+	index    int    // position in the heap
+}
+
+// A fileHeap orders the queued files by (in order) the most recent move to
+// the front, the highest priority, the pull order and the earliest
+// insertion.
+type fileHeap struct {
+	files []*bqFile
+	less  func(a, b scanner.File) bool // the pull order; nil if none
+}
+
+func (h *fileHeap) Len() int {
+	return len(h.files)
+}
+
+func (h *fileHeap) Less(i, j int) bool {
+	a, b := h.files[i], h.files[j]
+	if a.front != b.front {
+		return a.front > b.front
+	}
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if h.less != nil {
+		if h.less(a.file, b.file) {
+			return true
+		}
+		if h.less(b.file, a.file) {
+			return false
+		}
+	}
+	return a.seq < b.seq
+}
+
+func (h *fileHeap) Swap(i, j int) {
+	h.files[i], h.files[j] = h.files[j], h.files[i]
+	h.files[i].index = i
+	h.files[j].index = j
+}
 
-	queued []bqBlock
+func (h *fileHeap) Push(x interface{}) {
+	f := x.(*bqFile)
+	f.index = len(h.files)
+	h.files = append(h.files, f)
+}
 
-	mut sync.Mutex
+func (h *fileHeap) Pop() interface{} {
+	n := len(h.files)
+	f := h.files[n-1]
+	h.files[n-1] = nil
+	f.index = -1
+	h.files = h.files[:n-1]
+	return f
 }
 
-func newBlockQueue() *blockQueue {
+// A blockQueue holds the files waiting to be pulled, indexed by name. Blocks
+// are handed out file by file in priority and pull order; all blocks of a
+// file are handed out in order, starting with the one marked first.
+type blockQueue struct {
+	files  fileHeap
+	byName map[string]*bqFile
+	seq    uint64
+	fronts int
+	closed bool
+
+	mut  sync.Mutex
+	cond *sync.Cond
+}
+
+// newBlockQueue returns a new queue. Files of equal priority are handed out
+// in the order given by less, if not nil, and then in the order they were
+// queued.
+func newBlockQueue(less func(a, b scanner.File) bool) *blockQueue {
 	q := &blockQueue{
-		inbox:  make(chan bqAdd),
-		outbox: make(chan bqBlock),
+		files:  fileHeap{less: less},
+		byName: make(map[string]*bqFile),
 	}
-	go q.run()
+	q.cond = sync.NewCond(&q.mut)
 	return q
 }
 
-func (q *blockQueue) addBlock(a bqAdd) {
+// put queues the file. If the same version of the file is already queued
+// nothing happens. If an other version of it is queued, that version is
+// obsolete and is replaced.
+func (q *blockQueue) put(a bqAdd) {
 	q.mut.Lock()
 	defer q.mut.Unlock()
 
-	// If we already have it queued, return
-	for _, b := range q.queued {
-		if b.file.Name == a.file.Name {
+	if f, ok := q.byName[a.file.Name]; ok {
+		if f.file.Version == a.file.Version {
 			return
 		}
+		q.removeFile(f)
+	}
+
+	q.seq++
+	f := &bqFile{
+		file:     a.file,
+		blocks:   fileBlocks(a),
+		priority: a.priority,
+		seq:      q.seq,
 	}
+	heap.Push(&q.files, f)
+	q.byName[f.file.Name] = f
+	q.cond.Broadcast()
+}
 
+// fileBlocks returns the blocks to hand out for the file.
+func fileBlocks(a bqAdd) []bqBlock {
+	var blocks []bqBlock
 	l := len(a.need)
 
 	if len(a.have) > 0 {
 		// First queue a copy operation
-		q.queued = append(q.queued, bqBlock{
+		blocks = append(blocks, bqBlock{
 			file:  a.file,
 			copy:  a.have,
 			first: true,
@@ -67,7 +158,7 @@ func (q *blockQueue) addBlock(a bqAdd) {
 
 	// Queue the needed blocks individually
 	for i, b := range a.need {
-		q.queued = append(q.queued, bqBlock{
+		blocks = append(blocks, bqBlock{
 			file:  a.file,
 			block: b,
 			first: len(a.have) == 0 && i == 0,
@@ -77,43 +168,109 @@ func (q *blockQueue) addBlock(a bqAdd) {
 
 	if len(a.need)+len(a.have) == 0 {
 		// If we didn't have anything to fetch, queue an empty block with the "last" flag set to close the file.
-		q.queued = append(q.queued, bqBlock{
-			file: a.file,
-			last: true,
+		blocks = append(blocks, bqBlock{
+			file:  a.file,
+			first: true,
+			last:  true,
 		})
 	}
+
+	return blocks
 }
 
-func (q *blockQueue) run() {
-	for {
-		if len(q.queued) == 0 {
-			q.addBlock(<-q.inbox)
-		} else {
-			q.mut.Lock()
-			next := q.queued[0]
-			q.mut.Unlock()
-			select {
-			case a := <-q.inbox:
-				q.addBlock(a)
-			case q.outbox <- next:
-				q.mut.Lock()
-				q.queued = q.queued[1:]
-				q.mut.Unlock()
-			}
-		}
+// get returns the next block, waiting for one to be queued if necessary.
+// After close it returns false instead.
+func (q *blockQueue) get() (bqBlock, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	for q.files.Len() == 0 && !q.closed {
+		q.cond.Wait()
 	}
+	if q.closed {
+		return bqBlock{}, false
+	}
+
+	f := q.files.files[0]
+	b := f.blocks[0]
+	f.blocks[0] = bqBlock{}
+	f.blocks = f.blocks[1:]
+	if len(f.blocks) == 0 {
+		q.removeFile(f)
+	}
+	return b, true
 }
 
-func (q *blockQueue) put(a bqAdd) {
-	q.inbox <- a
+// close wakes up and fails any waiting and following calls to get.
+func (q *blockQueue) close() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// remove removes the remaining blocks of the named file from the queue and
+// returns true if it was queued.
+func (q *blockQueue) remove(name string) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	f, ok := q.byName[name]
+	if ok {
+		q.removeFile(f)
+	}
+	return ok
+}
+
+func (q *blockQueue) removeFile(f *bqFile) {
+	heap.Remove(&q.files, f.index)
+	delete(q.byName, f.file.Name)
 }
 
-func (q *blockQueue) get() bqBlock {
-	return <-q.outbox
+// setPriority changes the priority of the named file and returns true if it
+// was queued.
+func (q *blockQueue) setPriority(name string, priority int) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	f, ok := q.byName[name]
+	if ok {
+		f.priority = priority
+		heap.Fix(&q.files, f.index)
+	}
+	return ok
+}
+
+// moveToFront moves the named file ahead of all other queued files and
+// returns true if it was queued.
+func (q *blockQueue) moveToFront(name string) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	f, ok := q.byName[name]
+	if ok {
+		q.fronts++
+		f.front = q.fronts
+		heap.Fix(&q.files, f.index)
+	}
+	return ok
+}
+
+// version returns the version of the named file in the queue, and whether
+// it is queued at all.
+func (q *blockQueue) version(name string) (uint64, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if f, ok := q.byName[name]; ok {
+		return f.file.Version, true
+	}
+	return 0, false
 }
 
 func (q *blockQueue) empty() bool {
 	q.mut.Lock()
 	defer q.mut.Unlock()
-	return len(q.queued) == 0
+	return q.files.Len() == 0
 }
@@ -0,0 +1,189 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package model
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+var testBlocks = []scanner.Block{{Offset: 0, Size: 1}, {Offset: 1, Size: 1}}
+
+type expectedBlock struct {
+	name    string
+	version uint64
+	first   bool
+	last    bool
+}
+
+func checkBlocks(t *testing.T, q *blockQueue, expected []expectedBlock) {
+	for i, e := range expected {
+		b, _ := q.get()
+		if b.file.Name != e.name || b.file.Version != e.version || b.first != e.first || b.last != e.last {
+			t.Errorf("%d: unexpected block %q v%d first %v last %v", i, b.file.Name, b.file.Version, b.first, b.last)
+		}
+	}
+	if !q.empty() {
+		t.Error("Queue not empty")
+	}
+}
+
+func TestBlockQueueReplaceVersion(t *testing.T) {
+	q := newBlockQueue(nil)
+
+	q.put(bqAdd{file: scanner.File{Name: "a", Version: 1}, need: testBlocks})
+	q.put(bqAdd{file: scanner.File{Name: "b", Version: 1}, need: testBlocks[:1]})
+
+	// The same version again is ignored
+	q.put(bqAdd{file: scanner.File{Name: "a", Version: 1}, need: testBlocks})
+
+	if v, ok := q.version("a"); !ok || v != 1 {
+		t.Errorf("Incorrect queued version %d, %v", v, ok)
+	}
+
+	// A new version replaces the queued blocks of the old one
+	q.put(bqAdd{file: scanner.File{Name: "a", Version: 2}, need: testBlocks[:1]})
+
+	if v, ok := q.version("a"); !ok || v != 2 {
+		t.Errorf("Incorrect queued version %d, %v", v, ok)
+	}
+
+	checkBlocks(t, q, []expectedBlock{
+		{"b", 1, true, true},
+		{"a", 2, true, true},
+	})
+
+	if _, ok := q.version("a"); ok {
+		t.Error("Unexpected queued file")
+	}
+}
+
+func TestBlockQueueEmptyFileFirst(t *testing.T) {
+	q := newBlockQueue(nil)
+	q.put(bqAdd{file: scanner.File{Name: "empty"}})
+
+	if b, _ := q.get(); !b.first || !b.last {
+		t.Errorf("Empty file block should be both first and last; %v, %v", b.first, b.last)
+	}
+}
+
+func TestBlockQueuePriority(t *testing.T) {
+	q := newBlockQueue(nil)
+
+	q.put(bqAdd{file: scanner.File{Name: "low"}, need: testBlocks, priority: 1})
+	q.put(bqAdd{file: scanner.File{Name: "high"}, need: testBlocks[:1], priority: 10})
+	q.put(bqAdd{file: scanner.File{Name: "low2"}, need: testBlocks[:1], priority: 1})
+	q.put(bqAdd{file: scanner.File{Name: "lowest"}, need: testBlocks[:1]})
+
+	checkBlocks(t, q, []expectedBlock{
+		{"high", 0, true, true},
+		{"low", 0, true, false},
+		{"low", 0, false, true},
+		{"low2", 0, true, true},
+		{"lowest", 0, true, true},
+	})
+}
+
+func TestBlockQueuePullOrder(t *testing.T) {
+	q := newBlockQueue(func(a, b scanner.File) bool { return a.Size < b.Size })
+
+	// Files queued later are still handed out in pull order, after the
+	// files with a higher priority and before equal files queued later.
+	q.put(bqAdd{file: scanner.File{Name: "large", Size: 300}, need: testBlocks[:1]})
+	q.put(bqAdd{file: scanner.File{Name: "medium", Size: 200}, need: testBlocks[:1]})
+	q.put(bqAdd{file: scanner.File{Name: "small", Size: 100}, need: testBlocks[:1]})
+	q.put(bqAdd{file: scanner.File{Name: "medium2", Size: 200}, need: testBlocks[:1]})
+	q.put(bqAdd{file: scanner.File{Name: "high", Size: 400}, need: testBlocks[:1], priority: 1})
+
+	checkBlocks(t, q, []expectedBlock{
+		{"high", 0, true, true},
+		{"small", 0, true, true},
+		{"medium", 0, true, true},
+		{"medium2", 0, true, true},
+		{"large", 0, true, true},
+	})
+}
+
+func TestBlockQueueReprioritize(t *testing.T) {
+	q := newBlockQueue(nil)
+
+	for _, n := range []string{"a", "b", "c", "d"} {
+		q.put(bqAdd{file: scanner.File{Name: n}, need: testBlocks[:1]})
+	}
+
+	if !q.setPriority("c", 5) {
+		t.Error("c not queued")
+	}
+	if !q.moveToFront("d") {
+		t.Error("d not queued")
+	}
+	if !q.remove("a") {
+		t.Error("a not queued")
+	}
+	if q.remove("a") || q.setPriority("x", 1) || q.moveToFront("x") {
+		t.Error("Unexpected success for file not queued")
+	}
+
+	checkBlocks(t, q, []expectedBlock{
+		{"d", 0, true, true},
+		{"c", 0, true, true},
+		{"b", 0, true, true},
+	})
+}
+
+func TestBlockQueueMoveToFront(t *testing.T) {
+	q := newBlockQueue(nil)
+
+	q.put(bqAdd{file: scanner.File{Name: "a"}, need: testBlocks, priority: 100})
+	q.put(bqAdd{file: scanner.File{Name: "b"}, need: testBlocks[:1]})
+	q.put(bqAdd{file: scanner.File{Name: "c"}, need: testBlocks[:1]})
+
+	// Start handing out a, then move b and c before it. The most recently
+	// moved file goes first.
+	q.get()
+	q.moveToFront("b")
+	q.moveToFront("c")
+
+	checkBlocks(t, q, []expectedBlock{
+		{"c", 0, true, true},
+		{"b", 0, true, true},
+		{"a", 0, false, true},
+	})
+}
+
+func TestBlockQueueClose(t *testing.T) {
+	q := newBlockQueue(nil)
+
+	res := make(chan bool)
+	go func() {
+		_, ok := q.get()
+		res <- ok
+	}()
+
+	q.close()
+	select {
+	case ok := <-res:
+		if ok {
+			t.Error("Unexpected block from closed queue")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiting get not woken up by close")
+	}
+
+	q.put(bqAdd{file: scanner.File{Name: "a"}, need: testBlocks})
+	if _, ok := q.get(); ok {
+		t.Error("Unexpected block from closed queue")
+	}
+}
+
+func BenchmarkBlockQueuePut(b *testing.B) {
+	q := newBlockQueue(nil)
+	for i := 0; i < b.N; i++ {
+		q.put(bqAdd{file: scanner.File{Name: fmt.Sprintf("file%d", i)}, need: testBlocks, priority: i % 10})
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// A testCluster is a set of models in the same process, each with its own
+// repository directory and in-memory database, sharing the repository
+// "default" with each other over in-memory connections.
+type testCluster struct {
+	t     *testing.T
+	dir   string
+	nodes []*testNode
+	conns []net.Conn
+
+	idleCheck time.Duration // pullerIdleCheck to restore on close
+}
+
+type testNode struct {
+	t     *testing.T
+	id    protocol.NodeID
+	dir   string // the repository directory
+	model *Model
+}
+
+// newTestCluster creates a cluster of n started but unconnected nodes. The
+// caller must defer close.
+func newTestCluster(t *testing.T, n int) *testCluster {
+	dir, err := ioutil.TempDir("", "syncthing-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCluster{t: t, dir: dir, idleCheck: pullerIdleCheck}
+	pullerIdleCheck = 100 * time.Millisecond
+
+	var nodeCfgs []config.NodeConfiguration
+	for i := 0; i < n; i++ {
+		id := protocol.NewNodeID([]byte(fmt.Sprintf("cluster node %d", i)))
+		nodeCfgs = append(nodeCfgs, config.NodeConfiguration{NodeID: id, Name: fmt.Sprintf("node%d", i)})
+		c.nodes = append(c.nodes, &testNode{
+			t:   t,
+			id:  id,
+			dir: filepath.Join(dir, fmt.Sprintf("node%d", i)),
+		})
+	}
+
+	for _, node := range c.nodes {
+		if err := os.Mkdir(node.dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, _ := config.Load(nil, node.id)
+		cfg.Nodes = nodeCfgs
+		cfg.Repositories = []config.RepositoryConfiguration{{
+			ID:        "default",
+			Directory: node.dir,
+			Nodes:     nodeCfgs,
+		}}
+
+		db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+		node.model = NewModel(dir, &cfg, node.id, "syncthing", "dev", db)
+		node.model.AddRepo(cfg.Repositories[0])
+		node.model.ScanRepos()
+		node.model.StartRepoRW("default", cfg.Options.ParallelRequests)
+	}
+
+	return c
+}
+
+// connect connects all nodes to each other.
+func (c *testCluster) connect() {
+	for i, a := range c.nodes {
+		for _, b := range c.nodes[i+1:] {
+			ca, cb := net.Pipe()
+			c.conns = append(c.conns, ca, cb)
+			a.model.AddConnection(ca, protocol.NewConnection(b.id, ca, ca, a.model))
+			b.model.AddConnection(cb, protocol.NewConnection(a.id, cb, cb, b.model))
+		}
+	}
+}
+
+// close stops the nodes, disconnects them and removes the repository
+// directories.
+func (c *testCluster) close() {
+	for _, node := range c.nodes {
+		if node.model != nil {
+			node.model.Stop()
+		}
+	}
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	pullerIdleCheck = c.idleCheck
+	os.RemoveAll(c.dir)
+}
+
+// awaitConvergence waits for all nodes to need nothing and have the same
+// repository contents, failing the test after the timeout.
+func (c *testCluster) awaitConvergence(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, node := range c.nodes {
+			node.model.broadcastIndexes()
+		}
+
+		err := c.converged()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatal("No convergence:", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (c *testCluster) converged() error {
+	var first map[string]string
+	for i, node := range c.nodes {
+		if need := node.model.NeedFilesRepo("default"); len(need) > 0 {
+			return fmt.Errorf("node%d needs %d files", i, len(need))
+		}
+
+		contents, err := node.contents()
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			first = contents
+		} else if !reflect.DeepEqual(contents, first) {
+			return fmt.Errorf("node%d has %v, node0 has %v", i, contents, first)
+		}
+	}
+	return nil
+}
+
+// contents returns the contents of the files in the repository by name,
+// with directories as "/".
+func (n *testNode) contents() (map[string]string, error) {
+	contents := make(map[string]string)
+	err := filepath.Walk(n.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rn, _ := filepath.Rel(n.dir, path)
+		switch {
+		case rn == "." || defTempNamer.IsTemporary(rn):
+		case info.IsDir():
+			contents[rn] = "/"
+		default:
+			bs, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			contents[rn] = string(bs)
+		}
+		return nil
+	})
+	return contents, err
+}
+
+// writeFile writes the named file in the node's repository, creating
+// directories as needed. The modification time is moved forward when
+// necessary so that the next scan sees the change.
+func (n *testNode) writeFile(name, data string) {
+	path := filepath.Join(n.dir, name)
+	prev, err := os.Stat(path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		n.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		n.t.Fatal(err)
+	}
+
+	if err == nil {
+		if t := prev.ModTime().Add(time.Second); time.Now().Before(t) {
+			os.Chtimes(path, t, t)
+		}
+	}
+}
+
+func (n *testNode) remove(name string) {
+	if err := os.RemoveAll(filepath.Join(n.dir, name)); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+func (n *testNode) scan() {
+	if err := n.model.ScanRepo("default"); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+func TestClusterConvergence(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+
+	c.nodes[0].writeFile("a", "from node0")
+	c.nodes[0].writeFile(filepath.Join("dir", "b"), "bbb")
+	c.nodes[1].writeFile("c", "from node1")
+	c.nodes[2].writeFile(filepath.Join("empty", "d"), "")
+	for _, node := range c.nodes {
+		node.scan()
+	}
+
+	c.connect()
+	c.awaitConvergence(30 * time.Second)
+
+	contents, _ := c.nodes[2].contents()
+	expected := map[string]string{
+		"a":                         "from node0",
+		"c":                         "from node1",
+		"dir":                       "/",
+		filepath.Join("dir", "b"):   "bbb",
+		"empty":                     "/",
+		filepath.Join("empty", "d"): "",
+	}
+	if !reflect.DeepEqual(contents, expected) {
+		t.Errorf("Incorrect contents %v != %v", contents, expected)
+	}
+}
+
+func TestClusterChangesAndDeletes(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+
+	c.nodes[0].writeFile("a", "original")
+	c.nodes[0].writeFile(filepath.Join("dir", "b"), "bbb")
+	c.nodes[0].scan()
+	c.connect()
+	c.awaitConvergence(30 * time.Second)
+
+	// A change made on another node than the one that created the file,
+	// and the removal of a file and its directory.
+	c.nodes[1].writeFile("a", "changed on node1")
+	c.nodes[1].scan()
+	c.nodes[2].remove("dir")
+	c.nodes[2].scan()
+	c.awaitConvergence(30 * time.Second)
+
+	contents, _ := c.nodes[0].contents()
+	expected := map[string]string{"a": "changed on node1"}
+	if !reflect.DeepEqual(contents, expected) {
+		t.Errorf("Incorrect contents %v != %v", contents, expected)
+	}
+}
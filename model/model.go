@@ -5,15 +5,17 @@
 package model
 
 import (
+	"bytes"
 	"compress/gzip"
 	"crypto/sha1"
-	"errors"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,6 +47,9 @@ type Model struct {
 	indexDir string
 	cfg      *config.Configuration
 	db       *leveldb.DB
+	nodeID   protocol.NodeID
+
+	filesystem osutil.Filesystem // where the repositories are
 
 	clientName    string
 	clientVersion string
@@ -54,47 +59,70 @@ type Model struct {
 	repoNodes  map[string][]protocol.NodeID              // repo -> nodeIDs
 	nodeRepos  map[protocol.NodeID][]string              // nodeID -> repos
 	suppressor map[string]*suppressor                    // repo -> suppressor
+	pullers    map[string]*puller                        // repo -> puller, for read/write repos
+	roPullers  map[string]*puller                        // repo -> puller, for read only repos
 	rmut       sync.RWMutex                              // protects the above
 
-	repoState map[string]repoState // repo -> state
-	smut      sync.RWMutex
+	repoState  map[string]repoState           // repo -> state
+	scanErrors map[string][]scanner.FileError // repo -> errors from last scan
+	rescans    map[string]map[string]bool     // repo -> files with a pending rescan
+	smut       sync.RWMutex                   // protects the above
 
-	protoConn map[protocol.NodeID]protocol.Connection
-	rawConn   map[protocol.NodeID]io.Closer
-	nodeVer   map[protocol.NodeID]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	protoConn  map[protocol.NodeID]protocol.Connection
+	rawConn    map[protocol.NodeID]io.Closer
+	nodeVer    map[protocol.NodeID]string
+	remoteMax  map[protocol.NodeID]map[string]uint64 // nodeID -> repo -> max local version of ours the node knows
+	idxStarted map[protocol.NodeID]bool              // initial index sending has started
+	idxChanges map[protocol.NodeID]map[string]uint64 // nodeID -> repo -> local change counter last sent
+	pmut       sync.RWMutex                          // protects the above
 
 	sup suppressor
 
 	addedRepo bool
 	started   bool
+
+	stop chan struct{} // closed to stop the model
 }
 
+// The errors returned from Request are protocol error codes, so that they
+// are passed on to the requesting peer.
 var (
-	ErrNoSuchFile = errors.New("no such file")
-	ErrInvalid    = errors.New("file is invalid")
+	ErrNoSuchFile   = protocol.ErrNoSuchFile
+	ErrInvalid      = protocol.ErrInvalid
+	ErrIO           = protocol.ErrIO
+	ErrHashMismatch = protocol.ErrHashMismatch
 )
 
 // NewModel creates and starts a new model. The model starts in read-only mode,
 // where it sends index information to connected peers and responds to requests
 // for file data without altering the local repository in any way.
-func NewModel(indexDir string, cfg *config.Configuration, clientName, clientVersion string, db *leveldb.DB) *Model {
+func NewModel(indexDir string, cfg *config.Configuration, nodeID protocol.NodeID, clientName, clientVersion string, db *leveldb.DB) *Model {
 	m := &Model{
 		indexDir:      indexDir,
 		cfg:           cfg,
 		db:            db,
+		nodeID:        nodeID,
 		clientName:    clientName,
 		clientVersion: clientVersion,
+		filesystem:    osutil.NativeFilesystem{},
 		repoCfgs:      make(map[string]config.RepositoryConfiguration),
 		repoFiles:     make(map[string]*files.Set),
 		repoNodes:     make(map[string][]protocol.NodeID),
 		nodeRepos:     make(map[protocol.NodeID][]string),
 		repoState:     make(map[string]repoState),
+		scanErrors:    make(map[string][]scanner.FileError),
+		rescans:       make(map[string]map[string]bool),
 		suppressor:    make(map[string]*suppressor),
+		pullers:       make(map[string]*puller),
+		roPullers:     make(map[string]*puller),
 		protoConn:     make(map[protocol.NodeID]protocol.Connection),
 		rawConn:       make(map[protocol.NodeID]io.Closer),
 		nodeVer:       make(map[protocol.NodeID]string),
+		remoteMax:     make(map[protocol.NodeID]map[string]uint64),
+		idxStarted:    make(map[protocol.NodeID]bool),
+		idxChanges:    make(map[protocol.NodeID]map[string]uint64),
 		sup:           suppressor{threshold: int64(cfg.Options.MaxChangeKbps)},
+		stop:          make(chan struct{}),
 	}
 
 	var timeout = 20 * 60 // seconds
@@ -115,13 +143,35 @@ func NewModel(indexDir string, cfg *config.Configuration, clientName, clientVers
 // read/write mode the model will attempt to keep in sync with the cluster by
 // pulling needed files from peer nodes.
 func (m *Model) StartRepoRW(repo string, threads int) {
-	m.rmut.RLock()
-	defer m.rmut.RUnlock()
+	m.rmut.Lock()
+	defer m.rmut.Unlock()
 
 	if cfg, ok := m.repoCfgs[repo]; !ok {
 		panic("cannot start without repo")
+	} else if p := newPuller(cfg, m, threads, m.cfg); threads > 0 {
+		m.pullers[repo] = p
 	} else {
-		newPuller(cfg, m, threads, m.cfg)
+		m.roPullers[repo] = p
+	}
+}
+
+// Stop stops the pullers and the sending of index updates, and waits for the
+// pullers to finish. Connections are left open.
+func (m *Model) Stop() {
+	close(m.stop)
+
+	m.rmut.RLock()
+	var pullers []*puller
+	for _, p := range m.pullers {
+		pullers = append(pullers, p)
+	}
+	for _, p := range m.roPullers {
+		pullers = append(pullers, p)
+	}
+	m.rmut.RUnlock()
+
+	for _, p := range pullers {
+		p.Stop()
 	}
 }
 
@@ -284,8 +334,8 @@ func (m *Model) NeedFilesRepo(repo string) []scanner.File {
 			fs = append(fs, f)
 			return true
 		})
-		if r := m.repoCfgs[repo].FileRanker(); r != nil {
-			files.SortBy(r).Sort(fs)
+		if less := m.repoCfgs[repo].FileLess(); less != nil {
+			files.Less(less).Sort(fs)
 		}
 		return fs
 	}
@@ -304,6 +354,13 @@ func (m *Model) Index(nodeID protocol.NodeID, repo string, fs []protocol.FileInf
 		return
 	}
 
+	if !m.mayModify(repo, nodeID) {
+		if debug {
+			l.Debugf("IDX(in): %s %q: ignoring index from receive only node", nodeID, repo)
+		}
+		return
+	}
+
 	var files = make([]scanner.File, len(fs))
 	for i := range fs {
 		f := fs[i]
@@ -339,6 +396,13 @@ func (m *Model) IndexUpdate(nodeID protocol.NodeID, repo string, fs []protocol.F
 		return
 	}
 
+	if !m.mayModify(repo, nodeID) {
+		if debug {
+			l.Debugf("IDXUP(in): %s %q: ignoring index from receive only node", nodeID, repo)
+		}
+		return
+	}
+
 	var files = make([]scanner.File, len(fs))
 	for i := range fs {
 		f := fs[i]
@@ -362,6 +426,22 @@ func (m *Model) IndexUpdate(nodeID protocol.NodeID, repo string, fs []protocol.F
 	m.rmut.RUnlock()
 }
 
+// mayModify returns true if changes made by the node should be accepted
+// into the repository.
+func (m *Model) mayModify(repo string, nodeID protocol.NodeID) bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return m.repoCfgs[repo].Permission(nodeID) != config.PermissionReceiveOnly
+}
+
+// mayPull returns true if the node may receive changes to the repository
+// from us.
+func (m *Model) mayPull(repo string, nodeID protocol.NodeID) bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return m.repoCfgs[repo].Permission(nodeID) != config.PermissionReadOnly
+}
+
 func (m *Model) repoSharedWith(repo string, nodeID protocol.NodeID) bool {
 	m.rmut.RLock()
 	defer m.rmut.RUnlock()
@@ -383,6 +463,18 @@ func (m *Model) ClusterConfig(nodeID protocol.NodeID, config protocol.ClusterCon
 	if compErr != nil {
 		l.Warnf("%s: %v", nodeID, compErr)
 		m.Close(nodeID, compErr)
+		return
+	}
+
+	// Remember the highest local version of our index that the peer
+	// already knows about, per repository.
+	remoteMax := make(map[string]uint64)
+	for _, repo := range config.Repositories {
+		for _, node := range repo.Nodes {
+			if bytes.Equal(node.ID, m.nodeID[:]) {
+				remoteMax[repo.ID] = node.MaxVersion
+			}
+		}
 	}
 
 	m.pmut.Lock()
@@ -391,19 +483,25 @@ func (m *Model) ClusterConfig(nodeID protocol.NodeID, config protocol.ClusterCon
 	} else {
 		m.nodeVer[nodeID] = config.ClientName + " " + config.ClientVersion
 	}
+	m.remoteMax[nodeID] = remoteMax
 	m.pmut.Unlock()
 
 	l.Infof(`Node %s client is "%s %s"`, nodeID, config.ClientName, config.ClientVersion)
+
+	m.startIndexSending(nodeID)
 }
 
 // Close removes the peer from the model and closes the underlying connection if possible.
-// Implements the protocol.Model interface.
+// The index received from the peer is kept, so that only the changes need to
+// be exchanged when it reconnects. Implements the protocol.Model interface.
 func (m *Model) Close(node protocol.NodeID, err error) {
 	l.Infof("Connection to %s closed: %v", node, err)
 
+	// The files of a disconnected node can't be pulled, so they no longer
+	// count towards the global model until the node is connected again.
 	m.rmut.RLock()
 	for _, repo := range m.nodeRepos[node] {
-		m.repoFiles[repo].Replace(node, nil)
+		m.repoFiles[repo].SetConnected(node, false)
 	}
 	m.rmut.RUnlock()
 
@@ -415,12 +513,18 @@ func (m *Model) Close(node protocol.NodeID, err error) {
 	delete(m.protoConn, node)
 	delete(m.rawConn, node)
 	delete(m.nodeVer, node)
+	delete(m.remoteMax, node)
+	delete(m.idxStarted, node)
+	delete(m.idxChanges, node)
 	m.pmut.Unlock()
 }
 
 // Request returns the specified data segment by reading it from local disk.
+// The data is verified against the given hash, or against the hash in the
+// local index if no hash is given, before it is returned. On mismatch a
+// rescan of the file is scheduled and ErrHashMismatch is returned.
 // Implements the protocol.Model interface.
-func (m *Model) Request(nodeID protocol.NodeID, repo, name string, offset int64, size int) ([]byte, error) {
+func (m *Model) Request(nodeID protocol.NodeID, repo, name string, offset int64, size int, hash []byte) ([]byte, error) {
 	// Verify that the requested file exists in the local model.
 	m.rmut.RLock()
 	r, ok := m.repoFiles[repo]
@@ -431,6 +535,13 @@ func (m *Model) Request(nodeID protocol.NodeID, repo, name string, offset int64,
 		return nil, ErrNoSuchFile
 	}
 
+	if !m.mayPull(repo, nodeID) {
+		if debug {
+			l.Debugf("REQ(in): %s: %q / %q; refusing request from read only node", nodeID, repo, name)
+		}
+		return nil, ErrInvalid
+	}
+
 	lf := r.Get(protocol.LocalNodeID, name)
 	if lf.Suppressed || protocol.IsDeleted(lf.Flags) {
 		if debug {
@@ -446,27 +557,101 @@ func (m *Model) Request(nodeID protocol.NodeID, repo, name string, offset int64,
 		return nil, ErrNoSuchFile
 	}
 
+	if size > lf.BlockSize() {
+		if debug {
+			l.Debugf("REQ(in; oversized): %s: %q o=%d s=%d bs=%d", nodeID, name, offset, size, lf.BlockSize())
+		}
+		return nil, ErrInvalid
+	}
+
 	if debug && nodeID != protocol.LocalNodeID {
 		l.Debugf("REQ(in): %s: %q / %q o=%d s=%d", nodeID, repo, name, offset, size)
 	}
 	m.rmut.RLock()
 	fn := filepath.Join(m.repoCfgs[repo].Directory, name)
 	m.rmut.RUnlock()
-	fd, err := os.Open(fn) // XXX: Inefficient, should cache fd?
+	fd, err := m.filesystem.Open(fn) // XXX: Inefficient, should cache fd?
 	if err != nil {
-		return nil, err
+		if debug {
+			l.Debugf("REQ(in; open): %s: %q / %q: %v", nodeID, repo, name, err)
+		}
+		if os.IsNotExist(err) {
+			return nil, ErrNoSuchFile
+		}
+		return nil, ErrIO
 	}
 	defer fd.Close()
 
 	buf := make([]byte, size)
 	_, err = fd.ReadAt(buf, offset)
 	if err != nil {
-		return nil, err
+		if debug {
+			l.Debugf("REQ(in; read): %s: %q / %q o=%d s=%d: %v", nodeID, repo, name, offset, size, err)
+		}
+		return nil, ErrIO
+	}
+
+	actual := sha256.Sum256(buf)
+	if len(hash) > 0 && bytes.Equal(actual[:], hash) {
+		return buf, nil
+	}
+
+	lh := localBlockHash(lf, offset, size)
+	if lh != nil && !bytes.Equal(actual[:], lh) {
+		// The file has changed on disk since we last scanned it.
+		if debug {
+			l.Debugf("REQ(in; changed): %s: %q / %q o=%d s=%d", nodeID, repo, name, offset, size)
+		}
+		m.rescanFile(repo, name)
+		return nil, ErrHashMismatch
+	}
+	if len(hash) > 0 {
+		// We have a different version of the file than the one requested.
+		if debug {
+			l.Debugf("REQ(in; mismatch): %s: %q / %q o=%d s=%d", nodeID, repo, name, offset, size)
+		}
+		return nil, ErrHashMismatch
 	}
 
 	return buf, nil
 }
 
+// localBlockHash returns the hash of the block at the given offset and size
+// in the file, or nil if there is no such block.
+func localBlockHash(f scanner.File, offset int64, size int) []byte {
+	for _, b := range f.Blocks {
+		if b.Offset == offset && int(b.Size) == size {
+			return b.Hash
+		}
+	}
+	return nil
+}
+
+// rescanFile schedules a rescan of the named file, unless one is already
+// pending. The file is rehashed even if it looks unchanged, since its
+// contents may have changed without its modification time.
+func (m *Model) rescanFile(repo, name string) {
+	m.smut.Lock()
+	if m.rescans[repo] == nil {
+		m.rescans[repo] = make(map[string]bool)
+	}
+	if m.rescans[repo][name] {
+		m.smut.Unlock()
+		return
+	}
+	m.rescans[repo][name] = true
+	m.smut.Unlock()
+
+	go func() {
+		if err := m.scanRepoSub(repo, name, true); err != nil {
+			l.Infof("Rescanning %q in repository %q: %v", name, repo, err)
+		}
+		m.smut.Lock()
+		delete(m.rescans[repo], name)
+		m.smut.Unlock()
+	}()
+}
+
 // ReplaceLocal replaces the local repository index with the given list of files.
 func (m *Model) ReplaceLocal(repo string, fs []scanner.File) {
 	m.rmut.RLock()
@@ -498,6 +683,21 @@ func (cf cFiler) CurrentFile(file string) scanner.File {
 	return cf.m.CurrentRepoFile(cf.r, file)
 }
 
+// rehashFiler is a scanner.CurrentFiler that reports the named file as
+// modified since the last scan, so that it is rehashed.
+type rehashFiler struct {
+	scanner.CurrentFiler
+	name string
+}
+
+func (rf rehashFiler) CurrentFile(file string) scanner.File {
+	f := rf.CurrentFiler.CurrentFile(file)
+	if file == rf.name {
+		f.Modified = -1
+	}
+	return f
+}
+
 // ConnectedTo returns true if we are connected to the named node.
 func (m *Model) ConnectedTo(nodeID protocol.NodeID) bool {
 	m.pmut.RLock()
@@ -507,10 +707,17 @@ func (m *Model) ConnectedTo(nodeID protocol.NodeID) bool {
 }
 
 // AddConnection adds a new peer connection to the model. An initial index will
-// be sent to the connected peer, thereafter index updates whenever the local
-// repository changes.
+// be sent to the connected peer once its cluster configuration has been
+// received, thereafter index updates whenever the local repository changes.
 func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection) {
 	nodeID := protoConn.ID()
+
+	// The cluster config must be the first message sent. Once the
+	// connection is registered, receiving the peer's cluster config starts
+	// the index sending.
+	cm := m.clusterConfig(nodeID)
+	protoConn.ClusterConfig(cm)
+
 	m.pmut.Lock()
 	if _, ok := m.protoConn[nodeID]; ok {
 		panic("add existing node")
@@ -522,46 +729,95 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	m.rawConn[nodeID] = rawConn
 	m.pmut.Unlock()
 
-	cm := m.clusterConfig(nodeID)
-	protoConn.ClusterConfig(cm)
+	m.rmut.RLock()
+	for _, repo := range m.nodeRepos[nodeID] {
+		m.repoFiles[repo].SetConnected(nodeID, true)
+	}
+	m.rmut.RUnlock()
+
+	m.startIndexSending(nodeID)
+}
+
+// startIndexSending starts sending the initial index to the node, once the
+// connection has been added and the node's cluster configuration has been
+// received, whichever happens last.
+func (m *Model) startIndexSending(nodeID protocol.NodeID) {
+	m.pmut.Lock()
+	conn, connected := m.protoConn[nodeID]
+	remoteMax, haveCC := m.remoteMax[nodeID]
+	if !connected || !haveCC || m.idxStarted[nodeID] {
+		m.pmut.Unlock()
+		return
+	}
+	m.idxStarted[nodeID] = true
+	m.pmut.Unlock()
 
-	var idxToSend = make(map[string][]protocol.FileInfo)
+	go m.sendInitialIndex(nodeID, conn, remoteMax)
+}
 
+func (m *Model) sendInitialIndex(nodeID protocol.NodeID, conn protocol.Connection, remoteMax map[string]uint64) {
 	m.rmut.RLock()
-	for _, repo := range m.nodeRepos[nodeID] {
-		idxToSend[repo] = m.protocolIndex(repo)
+	var repos = m.nodeRepos[nodeID]
+	var sets = make(map[string]*files.Set, len(repos))
+	for _, repo := range repos {
+		sets[repo] = m.repoFiles[repo]
 	}
 	m.rmut.RUnlock()
 
-	go func() {
-		for repo, idx := range idxToSend {
-			if debug {
-				l.Debugf("IDX(out/initial): %s: %q: %d files", nodeID, repo, len(idx))
-			}
-			const batchSize = 1000
-			for i := 0; i < len(idx); i += batchSize {
-				if len(idx[i:]) < batchSize {
-					protoConn.Index(repo, idx[i:])
-				} else {
-					protoConn.Index(repo, idx[i:i+batchSize])
-				}
-			}
+	changes := make(map[string]uint64, len(repos))
+	for _, repo := range repos {
+		fs := sets[repo]
+		changes[repo] = fs.Changes(protocol.LocalNodeID)
+
+		// If the peer claims to know a higher local version than we have,
+		// our index has been reset and the peer needs the full index.
+		maxLocalVersion := remoteMax[repo]
+		if !conn.HasFeature(protocol.FeatureIncrementalIndex) {
+			maxLocalVersion = 0
+		} else if maxLocalVersion > fs.LocalVersion(protocol.LocalNodeID) {
+			maxLocalVersion = 0
 		}
-	}()
-}
 
-// protocolIndex returns the current local index in protocol data types.
-func (m *Model) protocolIndex(repo string) []protocol.FileInfo {
-	var index []protocol.FileInfo
+		if debug {
+			l.Debugf("IDX(out/initial): %s: %q: since local version %d", nodeID, repo, maxLocalVersion)
+		}
+		sendIndexTo(conn, repo, fs, maxLocalVersion)
+	}
 
-	var fs []scanner.File
-	m.repoFiles[repo].WithHave(protocol.LocalNodeID, func(f scanner.File) bool {
-		fs = append(fs, f)
-		return true
-	})
+	m.pmut.Lock()
+	if m.idxStarted[nodeID] {
+		m.idxChanges[nodeID] = changes
+	}
+	m.pmut.Unlock()
+}
 
-	for _, f := range fs {
+// The number of files sent per call to Connection.Index.
+const indexBatchSize = 1000
+
+// sendIndexTo sends the local index for the repository to the connection in
+// batches. If maxLocalVersion is non zero, the files the peer already knows
+// of are skipped and no full index is sent. Files with large blocks are
+// marked invalid for peers that can't handle them.
+func sendIndexTo(conn protocol.Connection, repo string, fs *files.Set, maxLocalVersion uint64) {
+	var batch []protocol.FileInfo
+	var sent bool
+	largeBlocks := conn.HasFeature(protocol.FeatureLargeBlocks)
+
+	flush := func() {
+		if maxLocalVersion > 0 {
+			conn.IndexUpdate(repo, batch, maxLocalVersion)
+		} else {
+			conn.Index(repo, batch)
+		}
+		batch = nil
+		sent = true
+	}
+
+	fs.WithHave(protocol.LocalNodeID, func(f scanner.File) bool {
 		mf := fileInfoFromFile(f)
+		if !largeBlocks && f.BlockSize() > scanner.StandardBlockSize {
+			mf.Flags = mf.Flags&^protocol.FlagBlockSizeBits | protocol.FlagInvalid
+		}
 		if debug {
 			var flagComment string
 			if protocol.IsDeleted(mf.Flags) {
@@ -569,10 +825,35 @@ func (m *Model) protocolIndex(repo string) []protocol.FileInfo {
 			}
 			l.Debugf("IDX(out): %q/%q m=%d f=%o%s v=%d (%d blocks)", repo, mf.Name, mf.Modified, mf.Flags, flagComment, mf.Version, len(mf.Blocks))
 		}
-		index = append(index, mf)
+		batch = append(batch, mf)
+		if len(batch) == indexBatchSize {
+			flush()
+		}
+		return true
+	})
+
+	if len(batch) > 0 || !sent {
+		flush()
 	}
+}
+
+// availability returns the connected nodes that have the current global
+// version of the file.
+func (m *Model) availability(repo, name string) []protocol.NodeID {
+	m.rmut.RLock()
+	nodes := m.repoFiles[repo].Availability(name)
+	m.rmut.RUnlock()
 
-	return index
+	m.pmut.RLock()
+	var connected []protocol.NodeID
+	for _, node := range nodes {
+		if _, ok := m.protoConn[node]; ok {
+			connected = append(connected, node)
+		}
+	}
+	m.pmut.RUnlock()
+
+	return connected
 }
 
 func (m *Model) updateLocal(repo string, f scanner.File) {
@@ -581,7 +862,7 @@ func (m *Model) updateLocal(repo string, f scanner.File) {
 	m.rmut.RUnlock()
 }
 
-func (m *Model) requestGlobal(nodeID protocol.NodeID, repo, name string, offset int64, size int, hash []byte) ([]byte, error) {
+func (m *Model) requestGlobal(nodeID protocol.NodeID, repo, name string, offset int64, size int, hash []byte, cancel <-chan struct{}) ([]byte, error) {
 	m.pmut.RLock()
 	nc, ok := m.protoConn[nodeID]
 	m.pmut.RUnlock()
@@ -594,50 +875,53 @@ func (m *Model) requestGlobal(nodeID protocol.NodeID, repo, name string, offset
 		l.Debugf("REQ(out): %s: %q / %q o=%d s=%d h=%x", nodeID, repo, name, offset, size, hash)
 	}
 
-	return nc.Request(repo, name, offset, size)
+	return nc.Request(repo, name, offset, size, hash, cancel)
 }
 
 func (m *Model) broadcastIndexLoop() {
-	// TODO: Rewrite to send index in segments
-	var lastChange = map[string]uint64{}
 	for {
-		time.Sleep(5 * time.Second)
-
-		m.pmut.RLock()
-		m.rmut.RLock()
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(5 * time.Second):
+			m.broadcastIndexes()
+		}
+	}
+}
 
-		var indexWg sync.WaitGroup
-		for repo, fs := range m.repoFiles {
-			repo := repo
+// broadcastIndexes sends the local index for each repository that has
+// changed to the nodes that have received the initial index. The connection
+// only sends the files that have changed since the last index.
+func (m *Model) broadcastIndexes() {
+	m.pmut.Lock()
+	m.rmut.RLock()
 
+	var indexWg sync.WaitGroup
+	for nodeID, changes := range m.idxChanges {
+		conn := m.protoConn[nodeID]
+		for _, repo := range m.nodeRepos[nodeID] {
+			fs := m.repoFiles[repo]
 			c := fs.Changes(protocol.LocalNodeID)
-			if c == lastChange[repo] {
+			if c == changes[repo] {
 				continue
 			}
-			lastChange[repo] = c
+			changes[repo] = c
 
-			idx := m.protocolIndex(repo)
-
-			for _, nodeID := range m.repoNodes[repo] {
-				nodeID := nodeID
-				if conn, ok := m.protoConn[nodeID]; ok {
-					indexWg.Add(1)
-					if debug {
-						l.Debugf("IDX(out/loop): %s: %d files", nodeID, len(idx))
-					}
-					go func() {
-						conn.Index(repo, idx)
-						indexWg.Done()
-					}()
-				}
+			if debug {
+				l.Debugf("IDX(out/loop): %s: %q", nodeID, repo)
 			}
+			indexWg.Add(1)
+			go func(conn protocol.Connection, repo string, fs *files.Set) {
+				sendIndexTo(conn, repo, fs, 0)
+				indexWg.Done()
+			}(conn, repo, fs)
 		}
+	}
 
-		m.rmut.RUnlock()
-		m.pmut.RUnlock()
+	m.rmut.RUnlock()
+	m.pmut.Unlock()
 
-		indexWg.Wait()
-	}
+	indexWg.Wait()
 }
 
 func (m *Model) AddRepo(cfg config.RepositoryConfiguration) {
@@ -657,6 +941,11 @@ func (m *Model) AddRepo(cfg config.RepositoryConfiguration) {
 	for i, node := range cfg.Nodes {
 		m.repoNodes[cfg.ID][i] = node.NodeID
 		m.nodeRepos[node.NodeID] = append(m.nodeRepos[node.NodeID], cfg.ID)
+		if node.NodeID != m.nodeID {
+			// The index of the node kept from an earlier run counts once
+			// the node is connected.
+			m.repoFiles[cfg.ID].SetConnected(node.NodeID, false)
+		}
 	}
 
 	m.addedRepo = true
@@ -698,8 +987,9 @@ func (m *Model) CleanRepos() {
 	wg.Add(len(dirs))
 	for _, dir := range dirs {
 		w := &scanner.Walker{
-			Dir:       dir,
-			TempNamer: defTempNamer,
+			Dir:        dir,
+			TempNamer:  defTempNamer,
+			Filesystem: m.filesystem,
 		}
 		go func() {
 			w.CleanTempFiles()
@@ -709,26 +999,149 @@ func (m *Model) CleanRepos() {
 	wg.Wait()
 }
 
+// ScanRepoSub rescans the named file or directory in the repository and
+// updates the local index with any changes found. Files that have been
+// removed are left for the next full scan to detect.
+func (m *Model) ScanRepoSub(repo, sub string) error {
+	return m.scanRepoSub(repo, sub, false)
+}
+
+// scanRepoSub is ScanRepoSub, but rehashes sub itself if rehash is set.
+func (m *Model) scanRepoSub(repo, sub string, rehash bool) error {
+	m.rmut.RLock()
+	w := m.walker(repo)
+	m.rmut.RUnlock()
+	w.Sub = sub
+	if rehash {
+		w.CurrentFiler = rehashFiler{w.CurrentFiler, sub}
+	}
+
+	fs, _, errs, err := w.Walk()
+	if err != nil {
+		return err
+	}
+	m.setScanErrors(repo, sub, errs)
+
+	var changed []scanner.File
+	for _, f := range fs {
+		if cf := m.CurrentRepoFile(repo, f.Name); cf.Version != f.Version {
+			changed = append(changed, f)
+		}
+	}
+	if len(changed) > 0 {
+		m.rmut.RLock()
+		m.repoFiles[repo].Update(protocol.LocalNodeID, changed)
+		m.rmut.RUnlock()
+	}
+	return nil
+}
+
 func (m *Model) ScanRepo(repo string) error {
 	m.rmut.RLock()
-	w := &scanner.Walker{
+	w := m.walker(repo)
+	m.rmut.RUnlock()
+	m.setState(repo, RepoScanning)
+	fs, _, errs, err := w.Walk()
+	if err != nil {
+		return err
+	}
+	fs = m.keepUnreadable(repo, fs, errs)
+	m.ReplaceLocal(repo, fs)
+	m.setScanErrors(repo, "", errs)
+	m.setState(repo, RepoIdle)
+	return nil
+}
+
+// walker returns a scanner for the given repository. Must be called with
+// rmut held.
+func (m *Model) walker(repo string) *scanner.Walker {
+	var blockSize = scanner.StandardBlockSize
+	if m.repoCfgs[repo].LargeBlocks {
+		blockSize = 0 // chosen per file
+	}
+	return &scanner.Walker{
 		Dir:          m.repoCfgs[repo].Directory,
 		IgnoreFile:   ".stignore",
-		BlockSize:    scanner.StandardBlockSize,
+		BlockSize:    blockSize,
 		TempNamer:    defTempNamer,
 		Suppressor:   m.suppressor[repo],
 		CurrentFiler: cFiler{m, repo},
 		IgnorePerms:  m.repoCfgs[repo].IgnorePerms,
+		Filesystem:   m.filesystem,
+	}
+}
+
+// keepUnreadable adds the current local index entries for files that could
+// not be scanned to the list of scanned files, so that they are not marked
+// as deleted. For directories that could not be read, all files below them
+// are kept.
+func (m *Model) keepUnreadable(repo string, fs []scanner.File, errs []scanner.FileError) []scanner.File {
+	if len(errs) == 0 {
+		return fs
+	}
+
+	var seen = make(map[string]bool, len(fs))
+	for _, f := range fs {
+		seen[f.Name] = true
 	}
+
+	m.rmut.RLock()
+	rf := m.repoFiles[repo]
 	m.rmut.RUnlock()
-	m.setState(repo, RepoScanning)
-	fs, _, err := w.Walk()
-	if err != nil {
-		return err
+
+	rf.WithHave(protocol.LocalNodeID, func(f scanner.File) bool {
+		if seen[f.Name] {
+			return true
+		}
+		for _, e := range errs {
+			if e.Path == "." || f.Name == e.Path || strings.HasPrefix(f.Name, e.Path+string(os.PathSeparator)) {
+				if debug {
+					l.Debugf("keeping unreadable %q / %q: %v", repo, f.Name, e.Err)
+				}
+				fs = append(fs, f)
+				break
+			}
+		}
+		return true
+	})
+
+	return fs
+}
+
+// setScanErrors records the errors from a scan of the repository, or of the
+// named file or directory in it when sub is not empty, and logs the new ones.
+func (m *Model) setScanErrors(repo, sub string, errs []scanner.FileError) {
+	prefix := sub + string(filepath.Separator)
+
+	m.smut.Lock()
+	prev := make(map[string]bool, len(m.scanErrors[repo]))
+	for _, e := range m.scanErrors[repo] {
+		prev[e.Path] = true
+		if sub != "" && e.Path != sub && !strings.HasPrefix(e.Path, prefix) {
+			// Outside of the rescanned part of the repository
+			errs = append(errs, e)
+		}
+	}
+	m.scanErrors[repo] = errs
+	m.smut.Unlock()
+
+	for _, e := range errs {
+		if !prev[e.Path] {
+			l.Infof("Cannot scan %q in repository %q: %v", e.Path, repo, e.Err)
+		}
 	}
-	m.ReplaceLocal(repo, fs)
-	m.setState(repo, RepoIdle)
-	return nil
+}
+
+// ScanErrors returns the files and directories that could not be read during
+// the last scan of the repository, mapped to the corresponding error.
+func (m *Model) ScanErrors(repo string) map[string]string {
+	m.smut.RLock()
+	defer m.smut.RUnlock()
+	res := make(map[string]string, len(m.scanErrors[repo]))
+	for _, e := range m.scanErrors[repo] {
+		res[e.Path] = e.Err.Error()
+	}
+	return res
 }
 
 func (m *Model) LoadIndexes(dir string) {
@@ -752,27 +1165,27 @@ func (m *Model) saveIndex(repo string, dir string, fs []protocol.FileInfo) error
 	id := fmt.Sprintf("%x", sha1.Sum([]byte(m.repoCfgs[repo].Directory)))
 	name := id + ".idx.gz"
 	name = filepath.Join(dir, name)
-	tmp := fmt.Sprintf("%s.tmp.%d", name, time.Now().UnixNano())
-	idxf, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	idxf, err := osutil.CreateAtomic(name, 0644)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmp)
+	idxf.Sync = m.cfg.Options.SyncWrites
 
 	gzw := gzip.NewWriter(idxf)
 
 	n, err := protocol.IndexMessage{
 		Repository: repo,
 		Files:      fs,
-	}.EncodeXDR(gzw)
+	}.EncodeXDRV0(gzw)
 	if err != nil {
 		gzw.Close()
-		idxf.Close()
+		idxf.Abort()
 		return err
 	}
 
 	err = gzw.Close()
 	if err != nil {
+		idxf.Abort()
 		return err
 	}
 
@@ -785,7 +1198,7 @@ func (m *Model) saveIndex(repo string, dir string, fs []protocol.FileInfo) error
 		l.Debugln("wrote index,", n, "bytes uncompressed")
 	}
 
-	return osutil.Rename(tmp, name)
+	return nil
 }
 
 func (m *Model) loadIndex(repo string, dir string) []protocol.FileInfo {
@@ -806,7 +1219,7 @@ func (m *Model) loadIndex(repo string, dir string) []protocol.FileInfo {
 	defer gzr.Close()
 
 	var im protocol.IndexMessage
-	err = im.DecodeXDR(gzr)
+	err = im.DecodeXDRV0(gzr)
 	if err != nil || im.Repository != repo {
 		return nil
 	}
@@ -815,23 +1228,37 @@ func (m *Model) loadIndex(repo string, dir string) []protocol.FileInfo {
 }
 
 // clusterConfig returns a ClusterConfigMessage that is correct for the given peer node
-func (m *Model) clusterConfig(node protocol.NodeID) protocol.ClusterConfigMessage {
+func (m *Model) clusterConfig(peer protocol.NodeID) protocol.ClusterConfigMessage {
 	cm := protocol.ClusterConfigMessage{
 		ClientName:    m.clientName,
 		ClientVersion: m.clientVersion,
 	}
 
+	compression := protocol.CompressMetadata
+	if nc, ok := m.cfg.NodeMap()[peer]; ok && nc.Compression != "" {
+		compression = nc.Compression
+	}
+	cm.Options = append(cm.Options, protocol.Option{
+		Key:   protocol.CompressionOption,
+		Value: compression,
+	})
+
 	m.rmut.RLock()
-	for _, repo := range m.nodeRepos[node] {
+	for _, repo := range m.nodeRepos[peer] {
 		cr := protocol.Repository{
 			ID: repo,
 		}
 		for _, node := range m.repoNodes[repo] {
-			// TODO: Set read only bit when relevant
-			cr.Nodes = append(cr.Nodes, protocol.Node{
+			cn := protocol.Node{
 				ID:    node[:],
-				Flags: protocol.FlagShareTrusted,
-			})
+				Flags: shareFlags(m.repoCfgs[repo].Permission(node)),
+			}
+			if node == peer {
+				// Tell the peer how much of its index we already have,
+				// so that it only needs to send what has changed.
+				cn.MaxVersion = m.repoFiles[repo].LocalVersion(node)
+			}
+			cr.Nodes = append(cr.Nodes, cn)
 		}
 		cm.Repositories = append(cm.Repositories, cr)
 	}
@@ -864,6 +1291,30 @@ func (m *Model) State(repo string) string {
 	}
 }
 
+// Bump moves the named file, or the files in the named directory, to the
+// front of the pull queue of the repository.
+func (m *Model) Bump(repo, name string) error {
+	m.rmut.RLock()
+	p, ok := m.pullers[repo]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("bump: no such read/write repository: %q", repo)
+	}
+
+	name = strings.TrimRight(name, "/"+string(filepath.Separator))
+	if name == "" {
+		return fmt.Errorf("bump: empty file name")
+	}
+
+	select {
+	case p.bumps <- name:
+		return nil
+	default:
+		return fmt.Errorf("bump: too many pending bumps for repository %q", repo)
+	}
+}
+
 func (m *Model) Override(repo string) {
 	fs := m.NeedFilesRepo(repo)
 
@@ -876,7 +1327,7 @@ func (m *Model) Override(repo string) {
 		h := r.Get(protocol.LocalNodeID, f.Name)
 		if h.Name != f.Name {
 			// We are missing the file
-			f.Flags |= protocol.FlagDeleted
+			f.Flags = f.Flags&^protocol.FlagBlockSizeBits | protocol.FlagDeleted
 			f.Blocks = nil
 		} else {
 			// We have the file, replace with our version
@@ -8,19 +8,25 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/osutil"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
-var node1, node2 protocol.NodeID
+var node0, node1, node2 protocol.NodeID
 
 func init() {
+	node0 = protocol.NewNodeID([]byte("local node"))
 	node1, _ = protocol.NodeIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
 	node2, _ = protocol.NodeIDFromString("GYRZZQB-IRNPV4Z-T7TC52W-EQYJ3TT-FDQW6MW-DFLMU42-SSSU6EM-FBK2VAY")
 }
@@ -61,11 +67,11 @@ func init() {
 
 func TestRequest(t *testing.T) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", &config.Configuration{}, "syncthing", "dev", db)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 
-	bs, err := m.Request(node1, "default", "foo", 0, 6)
+	bs, err := m.Request(node1, "default", "foo", 0, 6, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,7 +79,23 @@ func TestRequest(t *testing.T) {
 		t.Errorf("Incorrect data from request: %q", string(bs))
 	}
 
-	bs, err = m.Request(node1, "default", "../walk.go", 0, 6)
+	bs, err = m.Request(node1, "default", "foo", 0, 7, testDataExpected["foo"].Blocks[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(bs, []byte("foobar\n")) != 0 {
+		t.Errorf("Incorrect data from request: %q", string(bs))
+	}
+
+	bs, err = m.Request(node1, "default", "foo", 0, 7, testDataExpected["bar"].Blocks[0].Hash)
+	if err != ErrHashMismatch {
+		t.Errorf("Unexpected error %v on hash mismatch", err)
+	}
+	if bs != nil {
+		t.Errorf("Unexpected non nil data on hash mismatch: %q", string(bs))
+	}
+
+	bs, err = m.Request(node1, "default", "../walk.go", 0, 6, nil)
 	if err == nil {
 		t.Error("Unexpected nil error on insecure file read")
 	}
@@ -82,6 +104,101 @@ func TestRequest(t *testing.T) {
 	}
 }
 
+func TestRequestRehashesChangedFile(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	dir := filepath.Join("repo", "default")
+	if err := fs.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "foo")
+	modified := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(data string) {
+		fd, _ := fs.Create(name)
+		fd.Write([]byte(data))
+		fd.Close()
+		fs.Chtimes(name, modified, modified)
+	}
+	write("foobar\n")
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	// A high change rate limit, so that the change isn't suppressed.
+	cfg := config.Configuration{Options: config.OptionsConfiguration{MaxChangeKbps: 1 << 30}}
+	m := NewModel("/tmp", &cfg, node0, "syncthing", "dev", db)
+	m.filesystem = fs
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir})
+	m.ScanRepo("default")
+
+	// The file changes without a change of size or modification time, so
+	// only rehashing it notices the change.
+	write("barfoo\n")
+	if _, err := m.Request(node1, "default", "foo", 0, 7, nil); err != ErrHashMismatch {
+		t.Fatalf("Unexpected error %v on changed file", err)
+	}
+
+	for i := 0; ; i++ {
+		bs, err := m.Request(node1, "default", "foo", 0, 7, nil)
+		if err == nil {
+			if string(bs) != "barfoo\n" {
+				t.Errorf("Incorrect data from request: %q", string(bs))
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Changed file not rehashed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeepUnreadable(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+	m.ReplaceLocal("default", []scanner.File{
+		{Name: "a", Version: 1000},
+		{Name: "b", Version: 1000},
+		{Name: "dir", Version: 1000, Flags: protocol.FlagDirectory},
+		{Name: filepath.Join("dir", "c"), Version: 1000},
+		{Name: "dirfoo", Version: 1000},
+	})
+
+	fs := []scanner.File{
+		{Name: "a", Version: 1001},
+		{Name: "dir", Version: 1000, Flags: protocol.FlagDirectory},
+	}
+	errs := []scanner.FileError{
+		{Path: "b", Err: os.ErrPermission},
+		{Path: "dir", Err: os.ErrPermission},
+	}
+
+	fs = m.keepUnreadable("default", fs, errs)
+
+	var names []string
+	for _, f := range fs {
+		names = append(names, f.Name)
+		if f.Name == "a" && f.Version != 1001 {
+			t.Error("Scanned file replaced by previous version")
+		}
+	}
+	sort.Strings(names)
+	expected := []string{"a", "b", "dir", filepath.Join("dir", "c")}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Incorrect kept files %v != %v", names, expected)
+	}
+
+	m.setScanErrors("default", "", errs)
+	if se := m.ScanErrors("default"); len(se) != 2 || se["b"] == "" {
+		t.Errorf("Incorrect scan errors %v", se)
+	}
+
+	// A rescan of part of the repository replaces only the errors in that
+	// part.
+	m.setScanErrors("default", "dir", []scanner.FileError{{Path: filepath.Join("dir", "c"), Err: os.ErrPermission}})
+	if se := m.ScanErrors("default"); len(se) != 2 || se["b"] == "" || se[filepath.Join("dir", "c")] == "" {
+		t.Errorf("Incorrect scan errors after rescan %v", se)
+	}
+}
+
 func genFiles(n int) []protocol.FileInfo {
 	files := make([]protocol.FileInfo, n)
 	t := time.Now().Unix()
@@ -98,7 +215,7 @@ func genFiles(n int) []protocol.FileInfo {
 
 func BenchmarkIndex10000(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(10000)
@@ -111,7 +228,7 @@ func BenchmarkIndex10000(b *testing.B) {
 
 func BenchmarkIndex00100(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(100)
@@ -124,7 +241,7 @@ func BenchmarkIndex00100(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f10000(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(10000)
@@ -138,7 +255,7 @@ func BenchmarkIndexUpdate10000f10000(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f00100(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(10000)
@@ -153,7 +270,7 @@ func BenchmarkIndexUpdate10000f00100(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f00001(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(10000)
@@ -185,12 +302,18 @@ func (f FakeConnection) Option(string) string {
 
 func (FakeConnection) Index(string, []protocol.FileInfo) {}
 
-func (f FakeConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+func (FakeConnection) IndexUpdate(string, []protocol.FileInfo, uint64) {}
+
+func (f FakeConnection) Request(repo, name string, offset int64, size int, hash []byte, cancel <-chan struct{}) ([]byte, error) {
 	return f.requestData, nil
 }
 
 func (FakeConnection) ClusterConfig(protocol.ClusterConfigMessage) {}
 
+func (FakeConnection) HasFeature(string) bool {
+	return true
+}
+
 func (FakeConnection) Ping() bool {
 	return true
 }
@@ -201,7 +324,7 @@ func (FakeConnection) Statistics() protocol.Statistics {
 
 func BenchmarkRequest(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 
@@ -225,7 +348,7 @@ func BenchmarkRequest(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		data, err := m.requestGlobal(node1, "default", files[i%n].Name, 0, 32, nil)
+		data, err := m.requestGlobal(node1, "default", files[i%n].Name, 0, 32, nil, nil)
 		if err != nil {
 			b.Error(err)
 		}
@@ -250,3 +373,508 @@ func TestActivityMap(t *testing.T) {
 		t.Errorf("Incorrect least busy node %q", node)
 	}
 }
+
+func TestActivityMapThroughput(t *testing.T) {
+	m := make(activityMap)
+	m.completed(node1, 128<<10, 100*time.Millisecond)
+	m.completed(node2, 128<<10, time.Second)
+
+	// node1 is ten times faster and should get several requests before
+	// node2 gets one.
+	for i := 0; i < 5; i++ {
+		if node := m.leastBusyNode([]protocol.NodeID{node1, node2}); node != node1 {
+			t.Fatalf("Incorrect least busy node %q at request %d", node, i)
+		}
+	}
+	if m[node1].outstanding != 5 || m[node2].outstanding != 0 {
+		t.Errorf("Incorrect outstanding counts %d, %d", m[node1].outstanding, m[node2].outstanding)
+	}
+
+	// A timeout makes node1 the slower node.
+	for i := 0; i < 5; i++ {
+		m.decrease(node1)
+	}
+	m.timedOut(node1, 128<<10, 10*time.Second)
+	if node := m.leastBusyNode([]protocol.NodeID{node1, node2}); node != node2 {
+		t.Errorf("Incorrect least busy node %q after timeout", node)
+	}
+
+	// An unmeasured node is assumed to be as fast as the fastest one.
+	if node := m.leastBusyNode([]protocol.NodeID{node1, node2, node0}); node != node0 {
+		t.Errorf("Incorrect least busy node %q with unmeasured node", node)
+	}
+}
+
+func TestRequestWithTimeout(t *testing.T) {
+	block := func(cancel <-chan struct{}) ([]byte, error) {
+		<-cancel
+		return nil, protocol.ErrCanceled
+	}
+
+	if _, err := requestWithTimeout(block, nil, 10*time.Millisecond); err != errRequestTimeout {
+		t.Errorf("Unexpected error %v != %v", err, errRequestTimeout)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, err := requestWithTimeout(block, cancel, time.Minute); err != protocol.ErrCanceled {
+		t.Errorf("Unexpected error %v != %v", err, protocol.ErrCanceled)
+	}
+
+	data := []byte("data")
+	answer := func(cancel <-chan struct{}) ([]byte, error) {
+		return data, nil
+	}
+	if bs, err := requestWithTimeout(answer, nil, 0); err != nil || !bytes.Equal(bs, data) {
+		t.Errorf("Unexpected result %q, %v", bs, err)
+	}
+}
+
+type indexCall struct {
+	update          bool
+	maxLocalVersion uint64
+	files           []protocol.FileInfo
+}
+
+// indexConnection is a FakeConnection that records the index calls made.
+type indexConnection struct {
+	FakeConnection
+	calls chan indexCall
+}
+
+func (c indexConnection) Index(repo string, fs []protocol.FileInfo) {
+	c.calls <- indexCall{false, 0, fs}
+}
+
+func (c indexConnection) IndexUpdate(repo string, fs []protocol.FileInfo, maxLocalVersion uint64) {
+	c.calls <- indexCall{true, maxLocalVersion, fs}
+}
+
+func TestIncrementalIndex(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes:     []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}},
+	})
+	m.ReplaceLocal("default", []scanner.File{
+		{Name: "a", Version: 10},
+		{Name: "b", Version: 20},
+	})
+	// A file pulled from another node keeps its lower version but gets
+	// the next local version.
+	m.updateLocal("default", scanner.File{Name: "e", Version: 5})
+
+	// The remote index is kept in the database, and its max local version
+	// is announced when the node connects after a restart.
+
+	m.Index(node1, "default", []protocol.FileInfo{
+		{Name: "c", Version: 30, LocalVersion: 7},
+		{Name: "d", Version: 40, LocalVersion: 6},
+	})
+
+	m = NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes:     []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}},
+	})
+
+	if maxVersion := announcedMaxVersion(m, node1); maxVersion != 7 {
+		t.Errorf("Incorrect announced max version %d != 7", maxVersion)
+	}
+
+	// The initial index is only sent once the cluster config is received,
+	// and only contains what the peer doesn't already know.
+
+	conn := indexConnection{FakeConnection{id: node1}, make(chan indexCall, 10)}
+	m.AddConnection(conn, conn)
+
+	select {
+	case <-conn.calls:
+		t.Fatal("Index sent before cluster config")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m.ClusterConfig(node1, protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{
+			ID: "default",
+			Nodes: []protocol.Node{
+				{ID: node0[:], Flags: protocol.FlagShareTrusted, MaxVersion: 1},
+				{ID: node1[:], Flags: protocol.FlagShareTrusted},
+			},
+		}},
+	})
+
+	select {
+	case call := <-conn.calls:
+		if !call.update || call.maxLocalVersion != 1 || len(call.files) != 3 {
+			t.Errorf("Incorrect initial index call %+v", call)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No initial index sent")
+	}
+
+	// A peer claiming to know more than we have gets the full index.
+
+	m.Close(node1, nil)
+	m.AddConnection(conn, conn)
+	m.ClusterConfig(node1, protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{
+			ID: "default",
+			Nodes: []protocol.Node{
+				{ID: node0[:], Flags: protocol.FlagShareTrusted, MaxVersion: 1000},
+			},
+		}},
+	})
+
+	select {
+	case call := <-conn.calls:
+		if call.update || len(call.files) != 3 {
+			t.Errorf("Incorrect initial index call %+v", call)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No initial index sent")
+	}
+}
+
+// announcedMaxVersion returns the max version of the node's own index
+// announced in the cluster config sent to it.
+func announcedMaxVersion(m *Model, node protocol.NodeID) uint64 {
+	cm := m.clusterConfig(node)
+	for _, n := range cm.Repositories[0].Nodes {
+		if bytes.Equal(n.ID, node[:]) {
+			return n.MaxVersion
+		}
+	}
+	return 0
+}
+
+func TestCloseKeepsIndex(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes:     []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}},
+	})
+
+	conn := FakeConnection{id: node1}
+	m.AddConnection(conn, conn)
+	m.Index(node1, "default", []protocol.FileInfo{{Name: "c", Version: 30, LocalVersion: 3}})
+	if need := m.NeedFilesRepo("default"); len(need) != 1 {
+		t.Fatalf("Incorrect need list %v", need)
+	}
+
+	// Files only a disconnected node has are neither needed nor part of
+	// the global model, but the index is kept so that the node only needs
+	// to send its changes when it reconnects.
+
+	m.Close(node1, nil)
+
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Unexpected need list %v", need)
+	}
+	if f := m.CurrentGlobalFile("default", "c"); f.Name != "" {
+		t.Errorf("Unexpected global file %v", f)
+	}
+	if maxVersion := announcedMaxVersion(m, node1); maxVersion != 3 {
+		t.Errorf("Incorrect announced max version %d != 3", maxVersion)
+	}
+
+	m.AddConnection(conn, conn)
+
+	if need := m.NeedFilesRepo("default"); len(need) != 1 {
+		t.Errorf("Incorrect need list %v", need)
+	}
+}
+
+func TestReceiveOnlyNode(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes: []config.NodeConfiguration{
+			{NodeID: node0},
+			{NodeID: node1, Permission: config.PermissionReceiveOnly},
+			{NodeID: node2, Permission: config.PermissionReadOnly},
+		},
+	})
+
+	flags := make(map[protocol.NodeID]uint32)
+	for _, n := range m.clusterConfig(node1).Repositories[0].Nodes {
+		var id protocol.NodeID
+		copy(id[:], n.ID)
+		flags[id] = n.Flags
+	}
+	if flags[node0] != protocol.FlagShareTrusted || flags[node1] != protocol.FlagShareReceiveOnly || flags[node2] != protocol.FlagShareReadOnly {
+		t.Errorf("Incorrect sharing flags %v", flags)
+	}
+
+	files := []protocol.FileInfo{{Name: "a", Version: 10}}
+	m.Index(node1, "default", files)
+	m.IndexUpdate(node1, "default", files)
+	if f := m.repoFiles["default"].Get(node1, "a"); f.Name != "" {
+		t.Error("Index from receive only node was accepted")
+	}
+
+	m.Index(node2, "default", files)
+	if f := m.repoFiles["default"].Get(node2, "a"); f.Name != "a" {
+		t.Error("Index from read only node was not accepted")
+	}
+}
+
+func TestReadOnlyNodeRequest(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes: []config.NodeConfiguration{
+			{NodeID: node0},
+			{NodeID: node1},
+			{NodeID: node2, Permission: config.PermissionReadOnly},
+		},
+	})
+	m.ScanRepo("default")
+
+	if _, err := m.Request(node1, "default", "foo", 0, 6, nil); err != nil {
+		t.Errorf("Unexpected error from trusted node request: %v", err)
+	}
+	if _, err := m.Request(node2, "default", "foo", 0, 6, nil); err != ErrInvalid {
+		t.Errorf("Incorrect error from read only node request: %v", err)
+	}
+}
+
+func TestAsymmetricPermissions(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes: []config.NodeConfiguration{
+			{NodeID: node0},
+			{NodeID: node1, Permission: config.PermissionReceiveOnly},
+		},
+	})
+
+	conn := FakeConnection{id: node1}
+	m.AddConnection(conn, conn)
+
+	// The peer trusts us and itself, while we consider it receive only.
+	m.ClusterConfig(node1, protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{
+			{
+				ID: "default",
+				Nodes: []protocol.Node{
+					{ID: node0[:], Flags: protocol.FlagShareTrusted},
+					{ID: node1[:], Flags: protocol.FlagShareTrusted},
+				},
+			},
+		},
+	})
+
+	if !m.ConnectedTo(node1) {
+		t.Error("Connection closed on differing permissions")
+	}
+}
+
+func TestBump(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+	cfg := config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes:     []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}},
+	}
+	m.AddRepo(cfg)
+
+	conn := FakeConnection{id: node1}
+	m.AddConnection(conn, conn)
+	var files []protocol.FileInfo
+	for _, n := range []string{"a", "dir", filepath.Join("dir", "b"), filepath.Join("dir", "c"), "dirx", "z"} {
+		files = append(files, protocol.FileInfo{Name: n, Version: 10})
+	}
+	m.Index(node1, "default", files)
+
+	if err := m.Bump("default", "a"); err == nil {
+		t.Error("Unexpected nil error for repo without puller")
+	}
+
+	p := &puller{
+		repoCfg:   cfg,
+		model:     m,
+		bq:        newBlockQueue(nil),
+		openFiles: make(map[string]openFile),
+	}
+	p.queueNeededBlocks()
+	p.bump("dir")
+
+	for _, n := range []string{"dir", filepath.Join("dir", "b"), filepath.Join("dir", "c"), "a", "dirx", "z"} {
+		if b, _ := p.bq.get(); b.file.Name != n {
+			t.Errorf("Unexpected file %q != %q", b.file.Name, n)
+		}
+	}
+
+	// Bumps are refused rather than blocking when the puller doesn't keep
+	// up with them.
+	p.bumps = make(chan string, 1)
+	m.pullers["default"] = p
+	if err := m.Bump("default", "a"); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := m.Bump("default", "z"); err == nil {
+		t.Error("Unexpected nil error with a full bump queue")
+	}
+}
+
+func TestPullZeroBlocks(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	dir := filepath.Join("repo", "default")
+	if err := fs.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+	m.filesystem = fs
+	cfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m.AddRepo(cfg)
+
+	size := 2 * scanner.StandardBlockSize
+	blocks, _ := scanner.Blocks(bytes.NewReader(make([]byte, size)), scanner.StandardBlockSize)
+	f := scanner.File{Name: "zeros", Version: 1, Size: int64(size), Modified: time.Now().Unix(), Blocks: blocks}
+
+	// The blocks are handled without any connected node to request them
+	// from.
+	p := &puller{
+		repoCfg:    cfg,
+		model:      m,
+		bq:         newBlockQueue(nil),
+		openFiles:  make(map[string]openFile),
+		filesystem: fs,
+	}
+	p.handleBlock(bqBlock{file: f, block: blocks[0], first: true})
+	p.handleBlock(bqBlock{file: f, block: blocks[1], last: true})
+
+	if len(p.openFiles) != 0 {
+		t.Error("File not closed")
+	}
+	bs, err := osutil.ReadFile(fs, filepath.Join(dir, "zeros"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, make([]byte, size)) {
+		t.Errorf("Incorrect file contents, %d bytes", len(bs))
+	}
+	if lf := m.CurrentRepoFile("default", "zeros"); lf.Version != 1 {
+		t.Errorf("Local file not updated: %v", lf)
+	}
+}
+
+// timeoutConnection is a FakeConnection that doesn't answer the first
+// requests until they are canceled.
+type timeoutConnection struct {
+	FakeConnection
+	mut      sync.Mutex
+	timeouts int
+	requests int
+}
+
+func (c *timeoutConnection) Request(repo, name string, offset int64, size int, hash []byte, cancel <-chan struct{}) ([]byte, error) {
+	c.mut.Lock()
+	c.requests++
+	timeout := c.requests <= c.timeouts
+	c.mut.Unlock()
+
+	if timeout {
+		<-cancel
+		return nil, protocol.ErrCanceled
+	}
+	return c.FakeConnection.Request(repo, name, offset, size, hash, cancel)
+}
+
+func TestPullTimeoutSingleNode(t *testing.T) {
+	pullerRetryDelay = time.Millisecond
+
+	// The node that times out is the only one with the file, so the block
+	// is requested from it again until it answers, but only until it has
+	// timed out maxNodeTimeouts times in a row.
+	cases := []struct {
+		timeouts int
+		requests int
+		pulled   bool
+	}{
+		{2, 3, true},
+		{100, maxNodeTimeouts, false},
+	}
+
+	for _, tc := range cases {
+		fs := osutil.NewFakeFilesystem()
+		dir := filepath.Join("repo", "default")
+		if err := fs.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+		m := NewModel("/tmp", &config.Configuration{}, node0, "syncthing", "dev", db)
+		m.filesystem = fs
+		cfg := config.RepositoryConfiguration{
+			ID:        "default",
+			Directory: dir,
+			Nodes:     []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}},
+		}
+		m.AddRepo(cfg)
+
+		data := []byte("data from the only node")
+		blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize)
+		f := scanner.File{Name: "a", Version: 1, Size: int64(len(data)), Modified: time.Now().Unix(), Blocks: blocks}
+
+		conn := &timeoutConnection{FakeConnection: FakeConnection{id: node1, requestData: data}, timeouts: tc.timeouts}
+		m.AddConnection(conn, conn)
+		m.Index(node1, "default", []protocol.FileInfo{{
+			Name:     f.Name,
+			Version:  f.Version,
+			Modified: f.Modified,
+			Blocks:   []protocol.BlockInfo{{Size: blocks[0].Size, Hash: blocks[0].Hash}},
+		}})
+
+		p := &puller{
+			repoCfg:           cfg,
+			model:             m,
+			bq:                newBlockQueue(nil),
+			oustandingPerNode: make(activityMap),
+			openFiles:         make(map[string]openFile),
+			requestTimeout:    10 * time.Millisecond,
+			requestResults:    make(chan requestResult),
+			filesystem:        fs,
+		}
+		if p.handleBlock(bqBlock{file: f, block: blocks[0], first: true, last: true}) {
+			t.Fatal("Block not requested")
+		}
+		for !p.handleRequestResult(<-p.requestResults) {
+		}
+
+		if conn.requests != tc.requests {
+			t.Errorf("%d timeouts: incorrect number of requests %d != %d", tc.timeouts, conn.requests, tc.requests)
+		}
+		if _, ok := p.openFiles[f.Name]; ok {
+			t.Errorf("%d timeouts: file still open", tc.timeouts)
+		}
+		bs, err := osutil.ReadFile(fs, filepath.Join(dir, "a"))
+		if !tc.pulled {
+			if err == nil {
+				t.Errorf("%d timeouts: unexpected pulled file", tc.timeouts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, data) {
+			t.Errorf("%d timeouts: incorrect file contents %q", tc.timeouts, bs)
+		}
+	}
+}
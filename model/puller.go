@@ -7,9 +7,12 @@ package model
 import (
 	"bytes"
 	"errors"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/calmh/syncthing/config"
@@ -19,46 +22,187 @@ import (
 	"github.com/calmh/syncthing/versioner"
 )
 
+// The interval at which an idle puller looks for newly needed files. Tests
+// lower it to converge faster.
+var pullerIdleCheck = 5 * time.Second
+
+// The delay before a timed out request is sent again to the same node, when
+// no other node has the file. It doubles with each further timeout, up to
+// maxRetryDelay.
+var pullerRetryDelay = time.Second
+
+const maxRetryDelay = time.Minute
+
+// The number of consecutive timeouts after which a node is no longer asked
+// again, even when no other node has the file. The file is given up on
+// until the next time needed files are queued.
+const maxNodeTimeouts = 5
+
 type requestResult struct {
 	node     protocol.NodeID
 	file     scanner.File
 	filepath string // full filepath name
-	offset   int64
+	block    scanner.Block
 	data     []byte
 	err      error
+	elapsed  time.Duration // time from sending the request to receiving the result
 }
 
 type openFile struct {
 	filepath     string // full filepath name
 	temp         string // temporary filename
+	version      uint64 // the version of the file being pulled
 	availability []protocol.NodeID
-	file         *os.File
-	err          error // error when opening or writing to file, all following operations are cancelled
-	outstanding  int   // number of requests we still have outstanding
-	done         bool  // we have sent all requests for this file
+	file         osutil.File
+	err          error         // error when opening or writing to file, all following operations are cancelled
+	outstanding  int           // number of requests we still have outstanding
+	done         bool          // we have sent all requests for this file
+	cancel       chan struct{} // closed to cancel outstanding requests
+	retryDelay   time.Duration // delay before the next request, after timeouts from the last available node
+}
+
+// cancelRequests cancels all outstanding requests for the file.
+func (of *openFile) cancelRequests() {
+	if of.cancel != nil {
+		close(of.cancel)
+		of.cancel = nil
+	}
 }
 
-type activityMap map[protocol.NodeID]int
+// The weight given to a new throughput sample in the moving average.
+const rateSampleWeight = 0.25
 
+type nodeActivity struct {
+	outstanding int     // number of requests outstanding to the node
+	rate        float64 // moving average of the throughput, bytes per second; zero if unknown
+	timeouts    int     // number of consecutive timed out requests
+}
+
+// An activityMap tracks the outstanding requests and the measured
+// throughput per node.
+type activityMap map[protocol.NodeID]*nodeActivity
+
+func (m activityMap) get(node protocol.NodeID) *nodeActivity {
+	a, ok := m[node]
+	if !ok {
+		a = &nodeActivity{}
+		m[node] = a
+	}
+	return a
+}
+
+// leastBusyNode returns the node among availability that is expected to
+// complete a new request first, given the number of requests already
+// outstanding to it and its measured throughput, and counts a new
+// outstanding request to it. Nodes without a measured throughput are
+// assumed to be as fast as the fastest known node, so that they get a chance
+// to be measured.
 func (m activityMap) leastBusyNode(availability []protocol.NodeID) protocol.NodeID {
-	var low int = 2<<30 - 1
+	var fastest float64 = 1
+	for _, node := range availability {
+		if a, ok := m[node]; ok && a.rate > fastest {
+			fastest = a.rate
+		}
+	}
+
+	var low = math.Inf(1)
 	var selected protocol.NodeID
 	for _, node := range availability {
-		usage := m[node]
-		if usage < low {
-			low = usage
+		a := m.get(node)
+		rate := a.rate
+		if rate == 0 {
+			rate = fastest
+		}
+		if cost := float64(a.outstanding+1) / rate; cost < low {
+			low = cost
 			selected = node
 		}
 	}
-	m[selected]++
+	if selected != (protocol.NodeID{}) {
+		m[selected].outstanding++
+	}
 	return selected
 }
 
 func (m activityMap) decrease(node protocol.NodeID) {
-	m[node]--
+	m.get(node).outstanding--
 }
 
-var errNoNode = errors.New("no available source node")
+// completed records that a request for the given number of bytes was
+// answered by the node after the given time.
+func (m activityMap) completed(node protocol.NodeID, bytes int, elapsed time.Duration) {
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	sample := float64(bytes) / elapsed.Seconds()
+
+	a := m.get(node)
+	if a.rate == 0 {
+		a.rate = sample
+	} else {
+		a.rate = (1-rateSampleWeight)*a.rate + rateSampleWeight*sample
+	}
+	a.timeouts = 0
+}
+
+// timedOut records that a request to the node timed out. The node is
+// treated as having half its previous throughput. Returns the number of
+// consecutive timeouts from the node.
+func (m activityMap) timedOut(node protocol.NodeID, bytes int, timeout time.Duration) int {
+	a := m.get(node)
+	a.timeouts++
+	rate := float64(bytes) / timeout.Seconds()
+	if a.rate == 0 || rate < a.rate/2 {
+		a.rate = rate
+	} else {
+		a.rate /= 2
+	}
+	return a.timeouts
+}
+
+var (
+	errNoNode         = errors.New("no available source node")
+	errRequestTimeout = errors.New("request timed out")
+)
+
+// requestWithTimeout calls req with a cancel channel that is closed when
+// either cancel is closed or the timeout expires. If the request fails after
+// the timeout has expired, errRequestTimeout is returned. A zero timeout
+// means no timeout.
+func requestWithTimeout(req func(cancel <-chan struct{}) ([]byte, error), cancel <-chan struct{}, timeout time.Duration) ([]byte, error) {
+	reqCancel := make(chan struct{})
+	expired := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		var timer <-chan time.Time
+		if timeout > 0 {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			timer = t.C
+		}
+		select {
+		case <-cancel:
+		case <-timer:
+			close(expired)
+		case <-done:
+			return
+		}
+		close(reqCancel)
+	}()
+
+	bs, err := req(reqCancel)
+	close(done)
+
+	if err != nil {
+		select {
+		case <-expired:
+			return nil, errRequestTimeout
+		default:
+		}
+	}
+	return bs, err
+}
 
 type puller struct {
 	cfg               *config.Configuration
@@ -68,22 +212,33 @@ type puller struct {
 	oustandingPerNode activityMap
 	openFiles         map[string]openFile
 	requestSlots      chan bool
+	requestTimeout    time.Duration
+	syncWrites        bool
 	blocks            chan bqBlock
 	requestResults    chan requestResult
+	bumps             chan string
 	versioner         versioner.Versioner
+	filesystem        osutil.Filesystem
+	stop              chan struct{}  // closed to stop the puller
+	running           sync.WaitGroup // the goroutines of the puller
 }
 
 func newPuller(repoCfg config.RepositoryConfiguration, model *Model, slots int, cfg *config.Configuration) *puller {
 	p := &puller{
 		repoCfg:           repoCfg,
 		cfg:               cfg,
-		bq:                newBlockQueue(),
+		bq:                newBlockQueue(repoCfg.FileLess()),
 		model:             model,
 		oustandingPerNode: make(activityMap),
 		openFiles:         make(map[string]openFile),
 		requestSlots:      make(chan bool, slots),
+		requestTimeout:    time.Duration(cfg.Options.RequestTimeoutS) * time.Second,
+		syncWrites:        cfg.Options.SyncWrites,
 		blocks:            make(chan bqBlock),
 		requestResults:    make(chan requestResult),
+		bumps:             make(chan string, 16),
+		filesystem:        model.filesystem,
+		stop:              make(chan struct{}),
 	}
 
 	if len(repoCfg.Versioning.Type) > 0 {
@@ -91,7 +246,7 @@ func newPuller(repoCfg config.RepositoryConfiguration, model *Model, slots int,
 		if !ok {
 			l.Fatalf("Requested versioning type %q that does not exist", repoCfg.Versioning.Type)
 		}
-		p.versioner = factory(repoCfg.Versioning.Params)
+		p.versioner = factory(p.filesystem, repoCfg.Directory, repoCfg.Versioning.Params)
 	}
 
 	if slots > 0 {
@@ -102,34 +257,67 @@ func newPuller(repoCfg config.RepositoryConfiguration, model *Model, slots int,
 		if debug {
 			l.Debugf("starting puller; repo %q dir %q slots %d", repoCfg.ID, repoCfg.Directory, slots)
 		}
+		p.running.Add(1)
 		go p.run()
 	} else {
 		// Read only
 		if debug {
 			l.Debugf("starting puller; repo %q dir %q (read only)", repoCfg.ID, repoCfg.Directory)
 		}
+		p.running.Add(1)
 		go p.runRO()
 	}
 	return p
 }
 
+// Stop stops the puller and its versioner, and waits for the puller to
+// finish. Files being pulled are abandoned and their outstanding requests
+// cancelled.
+func (p *puller) Stop() {
+	close(p.stop)
+	p.bq.close()
+	p.running.Wait()
+	if p.versioner != nil {
+		p.versioner.Stop()
+	}
+}
+
 func (p *puller) run() {
+	defer p.running.Done()
+	defer p.abandonOpenFiles()
+
+	p.running.Add(1)
 	go func() {
+		defer p.running.Done()
+
 		// fill blocks queue when there are free slots
 		for {
-			<-p.requestSlots
-			b := p.bq.get()
+			select {
+			case <-p.requestSlots:
+			case <-p.stop:
+				return
+			}
+			b, ok := p.bq.get()
+			if !ok {
+				return
+			}
 			if debug {
 				l.Debugf("filler: queueing %q / %q offset %d copy %d", p.repoCfg.ID, b.file.Name, b.block.Offset, len(b.copy))
 			}
-			p.blocks <- b
+			select {
+			case p.blocks <- b:
+			case <-p.stop:
+				return
+			}
 		}
 	}()
 
-	walkTicker := time.Tick(time.Duration(p.cfg.Options.RescanIntervalS) * time.Second)
-	timeout := time.Tick(5 * time.Second)
+	walkTicker := time.NewTicker(time.Duration(p.cfg.Options.RescanIntervalS) * time.Second)
+	defer walkTicker.Stop()
+	timeout := time.NewTicker(pullerIdleCheck)
+	defer timeout.Stop()
 	changed := true
-	var prevVer uint64
+	var prevVer, checkedVer uint64
 
 	for {
 		// Run the pulling loop as long as there are blocks to fetch
@@ -139,8 +327,10 @@ func (p *puller) run() {
 			case res := <-p.requestResults:
 				p.model.setState(p.repoCfg.ID, RepoSyncing)
 				changed = true
-				p.requestSlots <- true
-				p.handleRequestResult(res)
+				if p.handleRequestResult(res) {
+					// Request was fully handled, free up the slot
+					p.requestSlots <- true
+				}
 
 			case b := <-p.blocks:
 				p.model.setState(p.repoCfg.ID, RepoSyncing)
@@ -150,11 +340,23 @@ func (p *puller) run() {
 					p.requestSlots <- true
 				}
 
-			case <-timeout:
+			case name := <-p.bumps:
+				p.bump(name)
+
+			case <-p.stop:
+				return
+
+			case <-timeout.C:
 				if len(p.openFiles) == 0 && p.bq.empty() {
 					// Nothing more to do for the moment
 					break pull
 				}
+				if v := p.model.Version(p.repoCfg.ID); v > checkedVer {
+					// Abort work on files that have changed since
+					// they were queued
+					p.queueChangedFiles()
+					checkedVer = v
+				}
 				if debug {
 					l.Debugf("%q: idle but have %d open files", p.repoCfg.ID, len(p.openFiles))
 					i := 5
@@ -179,7 +381,10 @@ func (p *puller) run() {
 
 		// Do a rescan if it's time for it
 		select {
-		case <-walkTicker:
+		case <-p.stop:
+			return
+
+		case <-walkTicker.C:
 			if debug {
 				l.Debugf("%q: time for rescan", p.repoCfg.ID)
 			}
@@ -196,22 +401,45 @@ func (p *puller) run() {
 			// Queue more blocks to fetch, if any
 			p.queueNeededBlocks()
 			prevVer = v
+			checkedVer = v
 		}
 	}
 }
 
 func (p *puller) runRO() {
-	walkTicker := time.Tick(time.Duration(p.cfg.Options.RescanIntervalS) * time.Second)
+	defer p.running.Done()
 
-	for _ = range walkTicker {
-		if debug {
-			l.Debugf("%q: time for rescan", p.repoCfg.ID)
-		}
-		err := p.model.ScanRepo(p.repoCfg.ID)
-		if err != nil {
-			invalidateRepo(p.cfg, p.repoCfg.ID, err)
+	walkTicker := time.NewTicker(time.Duration(p.cfg.Options.RescanIntervalS) * time.Second)
+	defer walkTicker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
 			return
+
+		case <-walkTicker.C:
+			if debug {
+				l.Debugf("%q: time for rescan", p.repoCfg.ID)
+			}
+			err := p.model.ScanRepo(p.repoCfg.ID)
+			if err != nil {
+				invalidateRepo(p.cfg, p.repoCfg.ID, err)
+				return
+			}
+		}
+	}
+}
+
+// abandonOpenFiles cancels the outstanding requests of the files being
+// pulled and removes their temporary files.
+func (p *puller) abandonOpenFiles() {
+	for name, of := range p.openFiles {
+		of.cancelRequests()
+		if of.file != nil {
+			of.file.Close()
+			p.filesystem.Remove(of.temp)
 		}
+		delete(p.openFiles, name)
 	}
 }
 
@@ -264,7 +492,7 @@ func (p *puller) fixupDirectories() {
 		}
 
 		if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(cur.Flags) && !scanner.PermsEqual(cur.Flags, uint32(info.Mode())) {
-			err := os.Chmod(path, os.FileMode(cur.Flags)&os.ModePerm)
+			err := p.filesystem.Chmod(path, os.FileMode(cur.Flags)&os.ModePerm)
 			if err != nil {
 				l.Warnf("Restoring folder flags: %q: %v", path, err)
 			} else {
@@ -277,7 +505,7 @@ func (p *puller) fixupDirectories() {
 
 		if cur.Modified != info.ModTime().Unix() {
 			t := time.Unix(cur.Modified, 0)
-			err := os.Chtimes(path, t, t)
+			err := p.filesystem.Chtimes(path, t, t)
 			if err != nil {
 				if runtime.GOOS != "windows" {
 					// https://code.google.com/p/go/issues/detail?id=8090
@@ -297,7 +525,7 @@ func (p *puller) fixupDirectories() {
 	for {
 		deleteDirs = nil
 		changed = 0
-		filepath.Walk(p.repoCfg.Directory, walkFn)
+		p.filesystem.Walk(p.repoCfg.Directory, walkFn)
 
 		var deleted = 0
 		// Delete any queued directories
@@ -306,7 +534,7 @@ func (p *puller) fixupDirectories() {
 			if debug {
 				l.Debugln("delete dir:", dir)
 			}
-			err := os.Remove(dir)
+			err := p.filesystem.Remove(dir)
 			if err == nil {
 				deleted++
 			} else if p.versioner == nil { // Failures are expected in the presence of versioning
@@ -324,28 +552,102 @@ func (p *puller) fixupDirectories() {
 	}
 }
 
-func (p *puller) handleRequestResult(res requestResult) {
+// handleRequestResult writes the result of a block request to the file, or
+// reacts to the error returned by the node. Returns true if the request was
+// fully handled, false if the block was requested again from another node
+// (i.e. the slot is still in use).
+func (p *puller) handleRequestResult(res requestResult) bool {
 	p.oustandingPerNode.decrease(res.node)
 	f := res.file
 
 	of, ok := p.openFiles[f.Name]
-	if !ok || of.err != nil {
-		// no entry in openFiles means there was an error and we've cancelled the operation
-		return
+	if !ok || of.err != nil || of.version != f.Version {
+		// no entry in openFiles means there was an error and we've cancelled the operation,
+		// a different version means the download was aborted for a newer version
+		return true
 	}
 
-	_, of.err = of.file.WriteAt(res.data, res.offset)
-
 	of.outstanding--
+
+	switch res.err {
+	case nil:
+		p.oustandingPerNode.completed(res.node, len(res.data), res.elapsed)
+		of.retryDelay = 0
+		_, of.err = of.file.WriteAt(res.data, res.block.Offset)
+		if of.err != nil {
+			of.cancelRequests()
+		}
+
+	case protocol.ErrNoSuchFile, protocol.ErrInvalid, protocol.ErrHashMismatch, errRequestTimeout:
+		// The node doesn't have the version of the file that we want (any
+		// more), or is too slow to answer. Request the block from another
+		// node instead.
+		if debug {
+			l.Debugf("pull: %q / %q offset %d from %s: %v; trying another node", p.repoCfg.ID, f.Name, res.block.Offset, res.node, res.err)
+		}
+		availability := removeNode(of.availability, res.node)
+		if res.err == errRequestTimeout {
+			timeouts := p.oustandingPerNode.timedOut(res.node, int(res.block.Size), p.requestTimeout)
+			if len(availability) == 0 && timeouts < maxNodeTimeouts {
+				// A slow node is still better than none. Ask it again
+				// after a while.
+				availability = of.availability
+				of.retryDelay = nextRetryDelay(of.retryDelay)
+			}
+		}
+		of.availability = availability
+		p.openFiles[f.Name] = of
+		return p.handleRequestBlock(bqBlock{file: f, block: res.block, last: of.done})
+
+	default:
+		// An I/O or connection error. Give up on the file for now; it will
+		// be queued again when we next look for needed files.
+		if debug {
+			l.Debugf("pull: %q / %q offset %d from %s: %v; giving up", p.repoCfg.ID, f.Name, res.block.Offset, res.node, res.err)
+		}
+		of.err = res.err
+		of.cancelRequests()
+		of.file.Close()
+		of.file = nil
+		p.filesystem.Remove(of.temp)
+		if of.done {
+			delete(p.openFiles, f.Name)
+		} else {
+			p.openFiles[f.Name] = of
+		}
+		return true
+	}
+
 	p.openFiles[f.Name] = of
 
 	if debug {
-		l.Debugf("pull: wrote %q / %q offset %d outstanding %d done %v", p.repoCfg.ID, f.Name, res.offset, of.outstanding, of.done)
+		l.Debugf("pull: wrote %q / %q offset %d outstanding %d done %v", p.repoCfg.ID, f.Name, res.block.Offset, of.outstanding, of.done)
 	}
 
 	if of.done && of.outstanding == 0 {
 		p.closeFile(f)
 	}
+	return true
+}
+
+func nextRetryDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return pullerRetryDelay
+	}
+	if delay *= 2; delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+func removeNode(nodes []protocol.NodeID, node protocol.NodeID) []protocol.NodeID {
+	var res []protocol.NodeID
+	for _, n := range nodes {
+		if n != node {
+			res = append(res, n)
+		}
+	}
+	return res
 }
 
 // handleBlock fulfills the block request by copying, ignoring or fetching
@@ -354,17 +656,39 @@ func (p *puller) handleRequestResult(res requestResult) {
 func (p *puller) handleBlock(b bqBlock) bool {
 	f := b.file
 
+	of, ok := p.openFiles[f.Name]
+	if ok && of.version != f.Version && b.first {
+		// A new version of the file; the download of the old one is
+		// obsolete.
+		p.abortFile(f.Name)
+		of, ok = openFile{}, false
+	}
+	if (ok && of.version != f.Version) || (!ok && !b.first) {
+		// A block for a version of the file that we have aborted.
+		if debug {
+			l.Debugf("pull: %q / %q: ignoring block for obsolete version %d", p.repoCfg.ID, f.Name, f.Version)
+		}
+		return true
+	}
+	if ok && b.first {
+		// The file was queued again while being pulled.
+		if debug {
+			l.Debugf("pull: %q / %q: ignoring duplicate first block", p.repoCfg.ID, f.Name)
+		}
+		return true
+	}
+
 	// For directories, making sure they exist is enough.
 	// Deleted directories we mark as handled and delete later.
 	if protocol.IsDirectory(f.Flags) {
 		if !protocol.IsDeleted(f.Flags) {
 			path := filepath.Join(p.repoCfg.Directory, f.Name)
-			_, err := os.Stat(path)
+			_, err := p.filesystem.Stat(path)
 			if err != nil && os.IsNotExist(err) {
 				if debug {
 					l.Debugf("create dir: %v", f)
 				}
-				err = os.MkdirAll(path, 0777)
+				err = p.filesystem.MkdirAll(path, 0777)
 				if err != nil {
 					l.Warnf("Create folder: %q: %v", path, err)
 				}
@@ -384,12 +708,12 @@ func (p *puller) handleBlock(b bqBlock) bool {
 		}
 		fp := filepath.Join(p.repoCfg.Directory, f.Name)
 		t := time.Unix(f.Modified, 0)
-		err := os.Chtimes(fp, t, t)
+		err := p.filesystem.Chtimes(fp, t, t)
 		if debug && err != nil {
 			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 		}
 		if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(f.Flags) {
-			err = os.Chmod(fp, os.FileMode(f.Flags&0777))
+			err = p.filesystem.Chmod(fp, os.FileMode(f.Flags&0777))
 			if debug && err != nil {
 				l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 			}
@@ -399,7 +723,6 @@ func (p *puller) handleBlock(b bqBlock) bool {
 		return true
 	}
 
-	of, ok := p.openFiles[f.Name]
 	of.done = b.last
 
 	if !ok {
@@ -407,20 +730,22 @@ func (p *puller) handleBlock(b bqBlock) bool {
 			l.Debugf("pull: %q: opening file %q", p.repoCfg.ID, f.Name)
 		}
 
-		of.availability = p.model.repoFiles[p.repoCfg.ID].Availability(f.Name)
+		of.availability = p.model.availability(p.repoCfg.ID, f.Name)
+		of.version = f.Version
 		of.filepath = filepath.Join(p.repoCfg.Directory, f.Name)
 		of.temp = filepath.Join(p.repoCfg.Directory, defTempNamer.TempName(f.Name))
+		of.cancel = make(chan struct{})
 
 		dirName := filepath.Dir(of.filepath)
-		_, err := os.Stat(dirName)
+		_, err := p.filesystem.Stat(dirName)
 		if err != nil {
-			err = os.MkdirAll(dirName, 0777)
+			err = p.filesystem.MkdirAll(dirName, 0777)
 		}
 		if err != nil {
 			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 		}
 
-		of.file, of.err = os.Create(of.temp)
+		of.file, of.err = p.filesystem.Create(of.temp)
 		if of.err != nil {
 			if debug {
 				l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, of.err)
@@ -452,6 +777,10 @@ func (p *puller) handleBlock(b bqBlock) bool {
 		p.handleCopyBlock(b)
 		return true
 
+	case b.block.IsAllZeros():
+		p.handleZeroBlock(b)
+		return true
+
 	case b.block.Size > 0:
 		return p.handleRequestBlock(b)
 
@@ -470,8 +799,8 @@ func (p *puller) handleCopyBlock(b bqBlock) {
 		l.Debugf("pull: copying %d blocks for %q / %q", len(b.copy), p.repoCfg.ID, f.Name)
 	}
 
-	var exfd *os.File
-	exfd, of.err = os.Open(of.filepath)
+	var exfd osutil.File
+	exfd, of.err = p.filesystem.Open(of.filepath)
 	if of.err != nil {
 		if debug {
 			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, of.err)
@@ -485,6 +814,10 @@ func (p *puller) handleCopyBlock(b bqBlock) {
 	defer exfd.Close()
 
 	for _, b := range b.copy {
+		if b.IsAllZeros() {
+			// Left as a hole in the temporary file
+			continue
+		}
 		bs := make([]byte, b.Size)
 		_, of.err = exfd.ReadAt(bs, b.Offset)
 		if of.err == nil {
@@ -515,12 +848,13 @@ func (p *puller) handleRequestBlock(b bqBlock) bool {
 	}
 
 	node := p.oustandingPerNode.leastBusyNode(of.availability)
-	if len(node) == 0 {
+	if node == (protocol.NodeID{}) {
 		of.err = errNoNode
+		of.cancelRequests()
 		if of.file != nil {
 			of.file.Close()
 			of.file = nil
-			os.Remove(of.temp)
+			p.filesystem.Remove(of.temp)
 		}
 		if b.last {
 			delete(p.openFiles, f.Name)
@@ -533,25 +867,59 @@ func (p *puller) handleRequestBlock(b bqBlock) bool {
 	of.outstanding++
 	p.openFiles[f.Name] = of
 
-	go func(node protocol.NodeID, b bqBlock) {
+	p.running.Add(1)
+	go func(node protocol.NodeID, b bqBlock, delay time.Duration, cancel <-chan struct{}) {
+		defer p.running.Done()
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-cancel:
+			}
+		}
+
 		if debug {
 			l.Debugf("pull: requesting %q / %q offset %d size %d from %q outstanding %d", p.repoCfg.ID, f.Name, b.block.Offset, b.block.Size, node, of.outstanding)
 		}
 
-		bs, err := p.model.requestGlobal(node, p.repoCfg.ID, f.Name, b.block.Offset, int(b.block.Size), nil)
-		p.requestResults <- requestResult{
+		t0 := time.Now()
+		bs, err := requestWithTimeout(func(cancel <-chan struct{}) ([]byte, error) {
+			return p.model.requestGlobal(node, p.repoCfg.ID, f.Name, b.block.Offset, int(b.block.Size), b.block.Hash, cancel)
+		}, cancel, p.requestTimeout)
+		res := requestResult{
 			node:     node,
 			file:     f,
 			filepath: of.filepath,
-			offset:   b.block.Offset,
+			block:    b.block,
 			data:     bs,
 			err:      err,
+			elapsed:  time.Since(t0),
+		}
+		select {
+		case p.requestResults <- res:
+		case <-p.stop:
 		}
-	}(node, b)
+	}(node, b, of.retryDelay, of.cancel)
 
 	return false
 }
 
+// handleZeroBlock handles a block that is known to contain only zeros.
+// Nothing is requested or written; the block is left as a hole in the
+// temporary file, which is extended to the full file size when closed.
+func (p *puller) handleZeroBlock(b bqBlock) {
+	f := b.file
+	of := p.openFiles[f.Name]
+
+	if debug {
+		l.Debugf("pull: %q / %q offset %d: zero block", p.repoCfg.ID, f.Name, b.block.Offset)
+	}
+
+	if of.done && of.outstanding == 0 {
+		p.closeFile(f)
+	}
+}
+
 func (p *puller) handleEmptyBlock(b bqBlock) {
 	f := b.file
 	of := p.openFiles[f.Name]
@@ -566,13 +934,13 @@ func (p *puller) handleEmptyBlock(b bqBlock) {
 		if debug {
 			l.Debugf("pull: delete %q", f.Name)
 		}
-		os.Remove(of.temp)
-		os.Chmod(of.filepath, 0666)
+		p.filesystem.Remove(of.temp)
+		p.filesystem.Chmod(of.filepath, 0666)
 		if p.versioner != nil {
 			if err := p.versioner.Archive(of.filepath); err == nil {
 				p.model.updateLocal(p.repoCfg.ID, f)
 			}
-		} else if err := os.Remove(of.filepath); err == nil || os.IsNotExist(err) {
+		} else if err := p.filesystem.Remove(of.filepath); err == nil || os.IsNotExist(err) {
 			p.model.updateLocal(p.repoCfg.ID, f)
 		}
 	} else {
@@ -580,16 +948,17 @@ func (p *puller) handleEmptyBlock(b bqBlock) {
 			l.Debugf("pull: no blocks to fetch and nothing to copy for %q / %q", p.repoCfg.ID, f.Name)
 		}
 		t := time.Unix(f.Modified, 0)
-		if os.Chtimes(of.temp, t, t) != nil {
+		if p.filesystem.Chtimes(of.temp, t, t) != nil {
 			delete(p.openFiles, f.Name)
 			return
 		}
-		if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(f.Flags) && os.Chmod(of.temp, os.FileMode(f.Flags&0777)) != nil {
+		if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(f.Flags) && p.filesystem.Chmod(of.temp, os.FileMode(f.Flags&0777)) != nil {
 			delete(p.openFiles, f.Name)
 			return
 		}
 		osutil.ShowFile(of.temp)
-		if osutil.Rename(of.temp, of.filepath) == nil {
+		if osutil.Rename(p.filesystem, of.temp, of.filepath) == nil {
+			p.syncDir(of.filepath)
 			p.model.updateLocal(p.repoCfg.ID, f)
 		}
 	}
@@ -599,42 +968,121 @@ func (p *puller) handleEmptyBlock(b bqBlock) {
 func (p *puller) queueNeededBlocks() {
 	queued := 0
 	for _, f := range p.model.NeedFilesRepo(p.repoCfg.ID) {
-		lf := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
-		have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
-		if debug {
-			l.Debugf("need:\n  local: %v\n  global: %v\n  haveBlocks: %v\n  needBlocks: %v", lf, f, have, need)
-		}
+		p.queueFile(f)
 		queued++
-		p.bq.put(bqAdd{
-			file: f,
-			have: have,
-			need: need,
-		})
 	}
 	if debug && queued > 0 {
 		l.Debugf("%q: queued %d blocks", p.repoCfg.ID, queued)
 	}
 }
 
+// queueChangedFiles queues the needed files that are being pulled or are
+// queued in a different version than the current global one, aborting the
+// download of the obsolete version. Other needed files are left for
+// queueNeededBlocks.
+func (p *puller) queueChangedFiles() {
+	for _, f := range p.model.NeedFilesRepo(p.repoCfg.ID) {
+		of, open := p.openFiles[f.Name]
+		qv, queued := p.bq.version(f.Name)
+		switch {
+		case open && of.version != f.Version:
+			if debug {
+				l.Debugf("pull: %q / %q: version %d obsoleted by %d", p.repoCfg.ID, f.Name, of.version, f.Version)
+			}
+			p.abortFile(f.Name)
+		case queued && qv != f.Version:
+		default:
+			continue
+		}
+		p.queueFile(f)
+	}
+}
+
+// bump moves the needed files matching name, i.e. the file itself or the
+// files in the directory of that name, to the front of the queue. Needed
+// files that aren't queued yet are queued first. The bumped files keep the
+// order of the need list between themselves.
+func (p *puller) bump(name string) {
+	need := p.model.NeedFilesRepo(p.repoCfg.ID)
+	prefix := name + string(filepath.Separator)
+
+	bumped := 0
+	for i := len(need) - 1; i >= 0; i-- {
+		f := need[i]
+		if f.Name != name && !strings.HasPrefix(f.Name, prefix) {
+			continue
+		}
+		_, open := p.openFiles[f.Name]
+		if _, queued := p.bq.version(f.Name); !queued && !open {
+			p.queueFile(f)
+		}
+		if p.bq.moveToFront(f.Name) {
+			bumped++
+		}
+	}
+
+	if debug {
+		l.Debugf("%q: bumped %d files for %q", p.repoCfg.ID, bumped, name)
+	}
+}
+
+func (p *puller) queueFile(f scanner.File) {
+	lf := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
+	have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
+	if debug {
+		l.Debugf("need:\n  local: %v\n  global: %v\n  haveBlocks: %v\n  needBlocks: %v", lf, f, have, need)
+	}
+	p.bq.put(bqAdd{
+		file: f,
+		have: have,
+		need: need,
+	})
+}
+
+// abortFile cancels the pulling of the named file and removes the temporary
+// file.
+func (p *puller) abortFile(name string) {
+	of := p.openFiles[name]
+	of.cancelRequests()
+	if of.file != nil {
+		of.file.Close()
+		p.filesystem.Remove(of.temp)
+	}
+	delete(p.openFiles, name)
+}
+
 func (p *puller) closeFile(f scanner.File) {
 	if debug {
 		l.Debugf("pull: closing %q / %q", p.repoCfg.ID, f.Name)
 	}
 
 	of := p.openFiles[f.Name]
+	// Zero blocks at the end of the file were never written; extend the
+	// file to the full size, leaving a hole where the file system supports
+	// it.
+	err := of.file.Truncate(f.Size)
+	if debug && err != nil {
+		l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+	}
+	if p.syncWrites {
+		err = of.file.Sync()
+		if debug && err != nil {
+			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+		}
+	}
 	of.file.Close()
-	defer os.Remove(of.temp)
+	defer p.filesystem.Remove(of.temp)
 
 	delete(p.openFiles, f.Name)
 
-	fd, err := os.Open(of.temp)
+	fd, err := p.filesystem.Open(of.temp)
 	if err != nil {
 		if debug {
 			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 		}
 		return
 	}
-	hb, _ := scanner.Blocks(fd, scanner.StandardBlockSize)
+	hb, _ := scanner.Blocks(fd, f.BlockSize())
 	fd.Close()
 
 	if l0, l1 := len(hb), len(f.Blocks); l0 != l1 {
@@ -652,12 +1100,12 @@ func (p *puller) closeFile(f scanner.File) {
 	}
 
 	t := time.Unix(f.Modified, 0)
-	err = os.Chtimes(of.temp, t, t)
+	err = p.filesystem.Chtimes(of.temp, t, t)
 	if debug && err != nil {
 		l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 	}
 	if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(f.Flags) {
-		err = os.Chmod(of.temp, os.FileMode(f.Flags&0777))
+		err = p.filesystem.Chmod(of.temp, os.FileMode(f.Flags&0777))
 		if debug && err != nil {
 			l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 		}
@@ -678,13 +1126,24 @@ func (p *puller) closeFile(f scanner.File) {
 	if debug {
 		l.Debugf("pull: rename %q / %q: %q", p.repoCfg.ID, f.Name, of.filepath)
 	}
-	if err := osutil.Rename(of.temp, of.filepath); err == nil {
+	if err := osutil.Rename(p.filesystem, of.temp, of.filepath); err == nil {
+		p.syncDir(of.filepath)
 		p.model.updateLocal(p.repoCfg.ID, f)
 	} else {
 		l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 	}
 }
 
+// syncDir makes the rename of the file durable, unless syncing is disabled.
+func (p *puller) syncDir(path string) {
+	if !p.syncWrites {
+		return
+	}
+	if err := osutil.SyncDir(p.filesystem, filepath.Dir(path)); debug && err != nil {
+		l.Debugf("pull: error: %q / %q: %v", p.repoCfg.ID, path, err)
+	}
+}
+
 func invalidateRepo(cfg *config.Configuration, repoID string, err error) {
 	for i := range cfg.Repositories {
 		repo := &cfg.Repositories[i]
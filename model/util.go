@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/calmh/syncthing/config"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
 )
@@ -27,13 +28,14 @@ func fileFromFileInfo(f protocol.FileInfo) scanner.File {
 	}
 	return scanner.File{
 		// Name is with native separator and normalization
-		Name:       filepath.FromSlash(f.Name),
-		Size:       offset,
-		Flags:      f.Flags &^ protocol.FlagInvalid,
-		Modified:   f.Modified,
-		Version:    f.Version,
-		Blocks:     blocks,
-		Suppressed: f.Flags&protocol.FlagInvalid != 0,
+		Name:         filepath.FromSlash(f.Name),
+		Size:         offset,
+		Flags:        f.Flags &^ protocol.FlagInvalid,
+		Modified:     f.Modified,
+		Version:      f.Version,
+		LocalVersion: f.LocalVersion,
+		Blocks:       blocks,
+		Suppressed:   f.Flags&protocol.FlagInvalid != 0,
 	}
 }
 
@@ -46,11 +48,12 @@ func fileInfoFromFile(f scanner.File) protocol.FileInfo {
 		}
 	}
 	pf := protocol.FileInfo{
-		Name:     filepath.ToSlash(f.Name),
-		Flags:    f.Flags,
-		Modified: f.Modified,
-		Version:  f.Version,
-		Blocks:   blocks,
+		Name:         filepath.ToSlash(f.Name),
+		Flags:        f.Flags,
+		Modified:     f.Modified,
+		Version:      f.Version,
+		LocalVersion: f.LocalVersion,
+		Blocks:       blocks,
 	}
 	if f.Suppressed {
 		pf.Flags |= protocol.FlagInvalid
@@ -71,6 +74,18 @@ func cmMap(cm protocol.ClusterConfigMessage) map[string]map[protocol.NodeID]uint
 	return m
 }
 
+// shareFlags returns the cluster config flags for the given permission.
+func shareFlags(permission string) uint32 {
+	switch permission {
+	case config.PermissionReadOnly:
+		return protocol.FlagShareReadOnly
+	case config.PermissionReceiveOnly:
+		return protocol.FlagShareReceiveOnly
+	default:
+		return protocol.FlagShareTrusted
+	}
+}
+
 type ClusterConfigMismatch error
 
 // compareClusterConfig returns nil for two equivalent configurations,
@@ -79,12 +94,16 @@ func compareClusterConfig(local, remote protocol.ClusterConfigMessage) error {
 	lm := cmMap(local)
 	rm := cmMap(remote)
 
+	// The permission bits are local policy, so nodes may well give each
+	// other different permissions.
+	mask := protocol.FlagShareBits &^ protocol.FlagSharePermissionBits
+
 	for repo, lnodes := range lm {
 		_ = lnodes
 		if rnodes, ok := rm[repo]; ok {
 			for node, lflags := range lnodes {
 				if rflags, ok := rnodes[node]; ok {
-					if lflags&protocol.FlagShareBits != rflags&protocol.FlagShareBits {
+					if lflags&mask != rflags&mask {
 						return ClusterConfigMismatch(fmt.Errorf("remote has different sharing flags for node %q in repository %q", node, repo))
 					}
 				}
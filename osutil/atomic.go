@@ -0,0 +1,159 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package osutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var ErrClosed = errors.New("write to closed writer")
+
+// An AtomicWriter writes a file by writing to a temporary file in the same
+// directory, and replacing the target file with it when closed. A reader of
+// the target file sees either the old or the new contents, never a partial
+// write. Unless Sync is set to false, the data and the rename are synced to
+// disk before Close returns, so that the new contents survive a crash.
+type AtomicWriter struct {
+	Sync bool
+
+	fs   Filesystem
+	path string
+	temp string
+	next File
+	err  error
+}
+
+// CreateAtomic returns an AtomicWriter that replaces the named file, which
+// is created with the given mode if it does not exist.
+func CreateAtomic(path string, mode os.FileMode) (*AtomicWriter, error) {
+	return CreateAtomicFS(NativeFilesystem{}, path, mode)
+}
+
+// CreateAtomicFS is like CreateAtomic for a file on the given filesystem.
+func CreateAtomicFS(fs Filesystem, path string, mode os.FileMode) (*AtomicWriter, error) {
+	removeStaleTemps(fs, path)
+
+	temp := fmt.Sprintf("%s%d", tempPrefix(path), time.Now().UnixNano())
+	fd, err := fs.OpenFile(temp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &AtomicWriter{
+		Sync: true,
+		fs:   fs,
+		path: path,
+		temp: temp,
+		next: fd,
+	}
+	return w, nil
+}
+
+// Write writes to the temporary file. After a failed write, all following
+// writes fail and Close returns the error without replacing the target file.
+func (w *AtomicWriter) Write(bs []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.next.Write(bs)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Close replaces the target file with what has been written, unless there
+// was an error writing it.
+func (w *AtomicWriter) Close() error {
+	if err := w.err; err != nil {
+		w.Abort()
+		return err
+	}
+
+	if w.Sync {
+		if err := w.next.Sync(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	if err := w.next.Close(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := Rename(w.fs, w.temp, w.path); err != nil {
+		w.Abort()
+		return err
+	}
+	w.err = ErrClosed
+
+	if w.Sync {
+		return SyncDir(w.fs, filepath.Dir(w.path))
+	}
+	return nil
+}
+
+// Abort removes the temporary file without replacing the target file. It
+// does nothing after Close.
+func (w *AtomicWriter) Abort() {
+	if w.err == ErrClosed {
+		return
+	}
+	w.next.Close()
+	w.fs.Remove(w.temp)
+	w.err = ErrClosed
+}
+
+// staleTempAge is the age after which a temporary file is assumed to be left
+// over from a writer that was never closed, for example after a crash.
+const staleTempAge = time.Hour
+
+func tempPrefix(path string) string {
+	return path + ".tmp."
+}
+
+// removeStaleTemps removes old temporary files of earlier writers for the
+// named file. Recent ones may still belong to a writer in progress and are
+// left alone.
+func removeStaleTemps(fs Filesystem, path string) {
+	dir := filepath.Dir(path)
+	prefix := filepath.Base(tempPrefix(path))
+	cutoff := time.Now().Add(-staleTempAge)
+	fs.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p == dir {
+			return nil
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		if strings.HasPrefix(info.Name(), prefix) && info.ModTime().Before(cutoff) {
+			fs.Remove(p)
+		}
+		return nil
+	})
+}
+
+// SyncDir makes a preceding creation, rename or removal of a file in the
+// directory durable. Directories can't be synced on Windows, where it does
+// nothing.
+func SyncDir(fs Filesystem, path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	fd, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
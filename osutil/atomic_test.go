@@ -0,0 +1,180 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package osutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAtomicWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sync := range []bool{true, false} {
+		w, err := CreateAtomic(name, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Sync = sync
+
+		w.Write([]byte("new"))
+		if bs, _ := ioutil.ReadFile(name); string(bs) != "old" {
+			t.Errorf("File replaced before close: %q", bs)
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if bs, _ := ioutil.ReadFile(name); string(bs) != "new" {
+			t.Errorf("File not replaced: %q", bs)
+		}
+		if err := w.Close(); err != ErrClosed {
+			t.Errorf("Unexpected error on second close: %v", err)
+		}
+
+		ioutil.WriteFile(name, []byte("old"), 0644)
+	}
+
+	checkOnlyFile(t, dir)
+}
+
+func TestAtomicWriterAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := CreateAtomic(name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new"))
+	w.Abort()
+
+	if err := w.Close(); err != ErrClosed {
+		t.Errorf("Unexpected error on close after abort: %v", err)
+	}
+	if bs, _ := ioutil.ReadFile(name); string(bs) != "old" {
+		t.Errorf("File replaced after abort: %q", bs)
+	}
+
+	checkOnlyFile(t, dir)
+}
+
+func TestAtomicWriterRemovesStaleTemps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	stale := name + ".tmp.1"
+	recent := name + ".tmp.2"
+	other := filepath.Join(dir, "other.tmp.1")
+	for _, n := range []string{stale, recent, other} {
+		if err := ioutil.WriteFile(n, []byte("temp"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * staleTempAge)
+	for _, n := range []string{stale, other} {
+		if err := os.Chtimes(n, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := CreateAtomic(name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Stale temporary file not removed: %v", err)
+	}
+	for _, n := range []string{recent, other} {
+		if _, err := os.Stat(n); err != nil {
+			t.Errorf("File %s removed: %v", filepath.Base(n), err)
+		}
+	}
+}
+
+// closeRecorder is a Filesystem that counts the closes of opened files.
+type closeRecorder struct {
+	Filesystem
+	closes int
+}
+
+func (fs *closeRecorder) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fd, err := fs.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return recordedFile{fd, fs}, nil
+}
+
+type recordedFile struct {
+	File
+	fs *closeRecorder
+}
+
+func (f recordedFile) Close() error {
+	f.fs.closes++
+	return f.File.Close()
+}
+
+func TestAtomicWriterNoAbortAfterClose(t *testing.T) {
+	fs := &closeRecorder{Filesystem: NewFakeFilesystem()}
+	if err := fs.MkdirAll("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := CreateAtomicFS(fs, filepath.Join("dir", "file"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The renamed temporary file isn't closed again by an abort.
+	if fs.closes != 1 {
+		t.Errorf("Temporary file closed %d times", fs.closes)
+	}
+}
+
+// checkOnlyFile verifies that no temporary files are left in dir.
+func checkOnlyFile(t *testing.T, dir string) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("Unexpected files left: %v", names)
+	}
+}
@@ -0,0 +1,457 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package osutil
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNotEmpty    = errors.New("directory not empty")
+	errIsDirectory = errors.New("is a directory")
+	errNotDir      = errors.New("not a directory")
+)
+
+// A FakeFilesystem is a Filesystem kept in memory, for tests. It has no
+// symlinks, so Lstat is the same as Stat, and doesn't enforce permissions.
+// The root directory, "/" or ".", always exists.
+type FakeFilesystem struct {
+	entries map[string]*fakeEntry // cleaned path -> entry
+	mut     sync.Mutex
+}
+
+type fakeEntry struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+func NewFakeFilesystem() *FakeFilesystem {
+	return &FakeFilesystem{
+		entries: make(map[string]*fakeEntry),
+	}
+}
+
+// get returns the entry for the cleaned path. Must be called with mut held.
+func (fs *FakeFilesystem) get(p string) (*fakeEntry, bool) {
+	if filepath.Dir(p) == p {
+		return &fakeEntry{name: p, mode: os.ModeDir | 0777}, true
+	}
+	e, ok := fs.entries[p]
+	return e, ok
+}
+
+// isDir returns true if the cleaned path is an existing directory. Must be
+// called with mut held.
+func (fs *FakeFilesystem) isDir(p string) bool {
+	e, ok := fs.get(p)
+	return ok && e.mode.IsDir()
+}
+
+// hasChildren returns true if there are entries below the cleaned path.
+// Must be called with mut held.
+func (fs *FakeFilesystem) hasChildren(p string) bool {
+	for k := range fs.entries {
+		if filepath.Dir(k) == p && k != p {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *FakeFilesystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := fs.Lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	err = fs.walk(root, info, walkFn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walk follows the semantics of filepath.Walk.
+func (fs *FakeFilesystem) walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	err := walkFn(path, info, nil)
+	if err != nil {
+		if info.IsDir() && err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	for _, name := range fs.readDirNames(path) {
+		filename := filepath.Join(path, name)
+		fileInfo, err := fs.Lstat(filename)
+		if err != nil {
+			if err := walkFn(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+		} else {
+			err = fs.walk(filename, fileInfo, walkFn)
+			if err != nil {
+				if !fileInfo.IsDir() || err != filepath.SkipDir {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the sorted names of the entries in the directory.
+func (fs *FakeFilesystem) readDirNames(dir string) []string {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	dir = filepath.Clean(dir)
+	var names []string
+	for k, e := range fs.entries {
+		if filepath.Dir(k) == dir && k != dir {
+			names = append(names, e.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fs *FakeFilesystem) Stat(name string) (os.FileInfo, error) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	e, ok := fs.get(filepath.Clean(name))
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return e.info(), nil
+}
+
+func (fs *FakeFilesystem) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+func (fs *FakeFilesystem) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *FakeFilesystem) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *FakeFilesystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	p := filepath.Clean(name)
+	e, ok := fs.get(p)
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && (flag&os.O_CREATE == 0 || !fs.isDir(filepath.Dir(p))):
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case ok && e.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDirectory}
+	case !ok:
+		e = &fakeEntry{
+			name:    filepath.Base(p),
+			mode:    perm & os.ModePerm,
+			modTime: time.Now(),
+		}
+		fs.entries[p] = e
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		e.data = nil
+		e.modTime = time.Now()
+	}
+
+	f := &fakeFile{
+		fs:    fs,
+		entry: e,
+		name:  name,
+	}
+	if flag&os.O_APPEND != 0 {
+		f.pos = int64(len(e.data))
+	}
+	return f, nil
+}
+
+func (fs *FakeFilesystem) Rename(oldname, newname string) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	op, np := filepath.Clean(oldname), filepath.Clean(newname)
+	e, ok := fs.entries[op]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if !fs.isDir(filepath.Dir(np)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if op == np {
+		return nil
+	}
+	if t, ok := fs.entries[np]; ok {
+		if t.mode.IsDir() != e.mode.IsDir() {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errNotDir}
+		}
+		if t.mode.IsDir() && fs.hasChildren(np) {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errNotEmpty}
+		}
+	}
+
+	prefix := op + string(filepath.Separator)
+	for k, c := range fs.entries {
+		if strings.HasPrefix(k, prefix) {
+			delete(fs.entries, k)
+			fs.entries[np+string(filepath.Separator)+k[len(prefix):]] = c
+		}
+	}
+	delete(fs.entries, op)
+	e.name = filepath.Base(np)
+	fs.entries[np] = e
+	return nil
+}
+
+func (fs *FakeFilesystem) Chmod(name string, mode os.FileMode) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	e, ok := fs.entries[filepath.Clean(name)]
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	e.mode = e.mode&^os.ModePerm | mode&os.ModePerm
+	return nil
+}
+
+func (fs *FakeFilesystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	e, ok := fs.entries[filepath.Clean(name)]
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	e.modTime = mtime
+	return nil
+}
+
+func (fs *FakeFilesystem) Mkdir(name string, perm os.FileMode) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	return fs.mkdir(name, perm)
+}
+
+// mkdir creates the directory. Must be called with mut held.
+func (fs *FakeFilesystem) mkdir(name string, perm os.FileMode) error {
+	p := filepath.Clean(name)
+	if _, ok := fs.get(p); ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if !fs.isDir(filepath.Dir(p)) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	fs.entries[p] = &fakeEntry{
+		name:    filepath.Base(p),
+		mode:    os.ModeDir | perm&os.ModePerm,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+func (fs *FakeFilesystem) MkdirAll(name string, perm os.FileMode) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	var missing []string
+	p := filepath.Clean(name)
+	for {
+		if e, ok := fs.get(p); ok {
+			if !e.mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errNotDir}
+			}
+			break
+		}
+		missing = append(missing, p)
+		p = filepath.Dir(p)
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := fs.mkdir(missing[i], perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FakeFilesystem) Remove(name string) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+
+	p := filepath.Clean(name)
+	if _, ok := fs.entries[p]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if fs.hasChildren(p) {
+		return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	delete(fs.entries, p)
+	return nil
+}
+
+func (e *fakeEntry) info() os.FileInfo {
+	return fakeFileInfo{
+		name:    e.name,
+		size:    int64(len(e.data)),
+		mode:    e.mode,
+		modTime: e.modTime,
+	}
+}
+
+type fakeFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i fakeFileInfo) Name() string {
+	return i.name
+}
+
+func (i fakeFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i fakeFileInfo) Mode() os.FileMode {
+	return i.mode
+}
+
+func (i fakeFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i fakeFileInfo) IsDir() bool {
+	return i.mode.IsDir()
+}
+
+func (i fakeFileInfo) Sys() interface{} {
+	return nil
+}
+
+// A fakeFile refers to its entry like a file descriptor refers to an inode;
+// it remains usable after the file has been renamed or removed.
+type fakeFile struct {
+	fs     *FakeFilesystem
+	entry  *fakeEntry
+	name   string
+	pos    int64
+	closed bool
+}
+
+func (f *fakeFile) Read(bs []byte) (int, error) {
+	n, err := f.ReadAt(bs, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *fakeFile) ReadAt(bs []byte, off int64) (int, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if f.closed {
+		return 0, os.ErrInvalid
+	}
+	if off >= int64(len(f.entry.data)) {
+		return 0, io.EOF
+	}
+	n := copy(bs, f.entry.data[off:])
+	if n < len(bs) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *fakeFile) Write(bs []byte) (int, error) {
+	n, err := f.WriteAt(bs, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *fakeFile) WriteAt(bs []byte, off int64) (int, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if f.closed {
+		return 0, os.ErrInvalid
+	}
+	if end := off + int64(len(bs)); end > int64(len(f.entry.data)) {
+		f.entry.resize(end)
+	}
+	copy(f.entry.data[off:], bs)
+	f.entry.modTime = time.Now()
+	return len(bs), nil
+}
+
+func (f *fakeFile) Close() error {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if f.closed {
+		return os.ErrInvalid
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *fakeFile) Name() string {
+	return f.name
+}
+
+func (f *fakeFile) Stat() (os.FileInfo, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+	return f.entry.info(), nil
+}
+
+func (f *fakeFile) Sync() error {
+	return nil
+}
+
+func (f *fakeFile) Truncate(size int64) error {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if f.closed {
+		return os.ErrInvalid
+	}
+	f.entry.resize(size)
+	f.entry.modTime = time.Now()
+	return nil
+}
+
+func (e *fakeEntry) resize(size int64) {
+	if size <= int64(len(e.data)) {
+		e.data = e.data[:size]
+		return
+	}
+	data := make([]byte, size)
+	copy(data, e.data)
+	e.data = data
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package osutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFakeFilesystemFiles(t *testing.T) {
+	fs := NewFakeFilesystem()
+
+	if _, err := fs.Create(filepath.Join("dir", "file")); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error creating file in missing dir: %v", err)
+	}
+	if err := fs.MkdirAll(filepath.Join("dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join("dir", "file")
+	fd, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte("hello"))
+	fd.WriteAt([]byte("world"), 10)
+	fd.Truncate(12)
+	fd.Close()
+	if _, err := fd.Write([]byte("x")); err == nil {
+		t.Error("Unexpected nil error writing closed file")
+	}
+
+	bs, err := ReadFile(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "hello\x00\x00\x00\x00\x00wo" {
+		t.Errorf("Incorrect contents %q", bs)
+	}
+
+	mtime := time.Unix(1234567890, 0)
+	fs.Chmod(name, 0600)
+	fs.Chtimes(name, mtime, mtime)
+	info, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "file" || info.Size() != 12 || info.Mode() != 0600 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Incorrect file info %q %d %v %v", info.Name(), info.Size(), info.Mode(), info.ModTime())
+	}
+
+	if _, err := fs.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); !os.IsExist(err) {
+		t.Errorf("Unexpected error for exclusive create of existing file: %v", err)
+	}
+	if err := fs.Remove("dir"); err == nil {
+		t.Error("Unexpected nil error removing non empty dir")
+	}
+	if err := fs.Remove(name); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.Open(name); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error opening removed file: %v", err)
+	}
+}
+
+func TestFakeFilesystemRenameWalk(t *testing.T) {
+	fs := NewFakeFilesystem()
+
+	fs.MkdirAll(filepath.Join("a", "b"), 0755)
+	for _, n := range []string{"z", filepath.Join("a", "y"), filepath.Join("a", "b", "x")} {
+		fd, _ := fs.Create(n)
+		fd.Close()
+	}
+
+	if err := fs.Rename("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	var walked []string
+	fs.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, path)
+		if path == filepath.Join("c", "b") {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	expected := []string{".", "c", filepath.Join("c", "b"), filepath.Join("c", "y"), "z"}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("Incorrect walk %v != %v", walked, expected)
+	}
+	if _, err := fs.Stat(filepath.Join("c", "b", "x")); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.Stat("a"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error for renamed dir: %v", err)
+	}
+
+	matches, err := Glob(fs, filepath.Join("c", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{filepath.Join("c", "b"), filepath.Join("c", "y")}; !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Incorrect glob %v != %v", matches, expected)
+	}
+}
+
+func TestFakeFilesystemAtomicWriter(t *testing.T) {
+	fs := NewFakeFilesystem()
+
+	w, err := CreateAtomicFS(fs, "file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, _ := ReadFile(fs, "file"); string(bs) != "data" {
+		t.Errorf("Incorrect contents %q", bs)
+	}
+	if names, _ := Glob(fs, "*"); len(names) != 1 {
+		t.Errorf("Unexpected files left: %v", names)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package osutil
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A Filesystem provides the file operations used to scan and sync a
+// repository. Names are native paths, as for the functions in package os.
+type Filesystem interface {
+	Walk(root string, walkFn filepath.WalkFunc) error
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldname, newname string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+}
+
+// A File is an open file on a Filesystem.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// NativeFilesystem is the Filesystem of the operating system.
+type NativeFilesystem struct{}
+
+func (NativeFilesystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(root, walkFn)
+}
+
+func (NativeFilesystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (NativeFilesystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (NativeFilesystem) Open(name string) (File, error) {
+	return nativeFile(os.Open(name))
+}
+
+func (NativeFilesystem) Create(name string) (File, error) {
+	return nativeFile(os.Create(name))
+}
+
+func (NativeFilesystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return nativeFile(os.OpenFile(name, flag, perm))
+}
+
+// nativeFile avoids returning a non nil File interface holding a nil
+// *os.File on error.
+func nativeFile(fd *os.File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (NativeFilesystem) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (NativeFilesystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (NativeFilesystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (NativeFilesystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (NativeFilesystem) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (NativeFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// ReadFile reads the named file from the filesystem.
+func ReadFile(fs Filesystem, name string) ([]byte, error) {
+	fd, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ioutil.ReadAll(fd)
+}
+
+// Glob returns the names of the files matching the pattern, like
+// filepath.Glob. Only the last element of the pattern may contain
+// wildcards.
+func Glob(fs Filesystem, pattern string) ([]string, error) {
+	dir, pat := filepath.Split(pattern)
+	dir = filepath.Clean(dir)
+	if _, err := filepath.Match(pat, ""); err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	fs.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path == dir {
+			return nil
+		}
+		if ok, _ := filepath.Match(pat, info.Name()); ok {
+			matches = append(matches, path)
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return matches, nil
+}
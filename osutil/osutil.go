@@ -9,14 +9,14 @@ import (
 	"runtime"
 )
 
-func Rename(from, to string) error {
+func Rename(fs Filesystem, from, to string) error {
 	if runtime.GOOS == "windows" {
-		os.Chmod(to, 0666) // Make sure the file is user writeable
-		err := os.Remove(to)
+		fs.Chmod(to, 0666) // Make sure the file is user writeable
+		err := fs.Remove(to)
 		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
-	defer os.Remove(from) // Don't leave a dangling temp file in case of rename error
-	return os.Rename(from, to)
+	defer fs.Remove(from) // Don't leave a dangling temp file in case of rename error
+	return fs.Rename(from, to)
 }
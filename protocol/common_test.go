@@ -6,16 +6,32 @@ package protocol
 
 import (
 	"io"
+	"sync"
 	"time"
 )
 
 type TestModel struct {
 	data     []byte
+	err      error
 	repo     string
 	name     string
 	offset   int64
 	size     int
+	reqMut   sync.Mutex // protects repo, name, offset and size
+	block    chan struct{}
 	closedCh chan bool
+	closeErr error
+
+	idxMut     sync.Mutex
+	indexes    []indexCall
+	indexBlock chan struct{} // Index and IndexUpdate wait for this to close after recording the call, if set
+}
+
+type indexCall struct {
+	nodeID NodeID
+	repo   string
+	update bool
+	files  []FileInfo
 }
 
 func newTestModel() *TestModel {
@@ -25,20 +41,44 @@ func newTestModel() *TestModel {
 }
 
 func (t *TestModel) Index(nodeID NodeID, repo string, files []FileInfo) {
+	t.idxMut.Lock()
+	t.indexes = append(t.indexes, indexCall{nodeID, repo, false, files})
+	t.idxMut.Unlock()
+	if t.indexBlock != nil {
+		<-t.indexBlock
+	}
 }
 
 func (t *TestModel) IndexUpdate(nodeID NodeID, repo string, files []FileInfo) {
+	t.idxMut.Lock()
+	t.indexes = append(t.indexes, indexCall{nodeID, repo, true, files})
+	t.idxMut.Unlock()
+	if t.indexBlock != nil {
+		<-t.indexBlock
+	}
+}
+
+func (t *TestModel) indexCalls() []indexCall {
+	t.idxMut.Lock()
+	defer t.idxMut.Unlock()
+	return append([]indexCall(nil), t.indexes...)
 }
 
-func (t *TestModel) Request(nodeID NodeID, repo, name string, offset int64, size int) ([]byte, error) {
+func (t *TestModel) Request(nodeID NodeID, repo, name string, offset int64, size int, hash []byte) ([]byte, error) {
+	t.reqMut.Lock()
 	t.repo = repo
 	t.name = name
 	t.offset = offset
 	t.size = size
-	return t.data, nil
+	t.reqMut.Unlock()
+	if t.block != nil {
+		<-t.block
+	}
+	return t.data, t.err
 }
 
 func (t *TestModel) Close(nodeID NodeID, err error) {
+	t.closeErr = err
 	close(t.closedCh)
 }
 
@@ -0,0 +1,205 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Compression modes, as set in the "compression" cluster config option.
+// The mode used on a connection is the least compressing one of the modes
+// requested by the two sides.
+const (
+	CompressNever    = "never"    // no messages are compressed
+	CompressMetadata = "metadata" // all messages except block data are compressed
+	CompressAlways   = "always"   // all messages are compressed
+)
+
+// The cluster config option holding the requested compression mode.
+const CompressionOption = "compression"
+
+// The header bit set for messages with a compressed body.
+const flagCompressed = 1 << 0
+
+const (
+	// Message bodies smaller than this are never compressed.
+	minCompressSize = 128
+
+	// Data that does not compress to less than this percentage of its
+	// original size is assumed to already be compressed and is sent as is.
+	maxCompressedPercent = 95
+
+	// The maximum size of a decompressed message body, which is that of a
+	// response with a block of the maximum size. Larger message bodies are
+	// sent uncompressed.
+	maxDecompressedSize = 4 + MaxBlockSize + 4
+)
+
+var (
+	errDecompressedSize = errors.New("decompressed message too large")
+	errStreamEnd        = errors.New("protocol error: unexpected end of compressed stream")
+)
+
+func compressionLevel(mode string) int {
+	switch mode {
+	case CompressNever:
+		return 0
+	case CompressAlways:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// clusterConfigCompression returns the compression mode requested in the
+// cluster config message.
+func clusterConfigCompression(cm ClusterConfigMessage) string {
+	for _, opt := range cm.Options {
+		if opt.Key == CompressionOption {
+			return opt.Value
+		}
+	}
+	return CompressMetadata
+}
+
+// shouldCompress returns true if messages of the given type should be
+// compressed under the compression mode level.
+func shouldCompress(level int, msgType int) bool {
+	switch level {
+	case 0:
+		return false
+	case 1:
+		return msgType != messageTypeResponse
+	default:
+		return true
+	}
+}
+
+// compress returns the deflated data, or nil if the data does not compress
+// well enough to be worth sending compressed.
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		panic(err)
+	}
+	fw.Write(data)
+	fw.Close()
+
+	if buf.Len()*100 >= len(data)*maxCompressedPercent {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func decompress(data []byte) ([]byte, error) {
+	fr := flate.NewReader(bytes.NewReader(data))
+	defer fr.Close()
+
+	bs, err := ioutil.ReadAll(io.LimitReader(fr, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) > maxDecompressedSize {
+		return nil, errDecompressedSize
+	}
+	return bs, nil
+}
+
+// A streamReader reads the compressed stream that a connection starts with,
+// and the uncompressed data following it once the peer has ended the
+// stream. The stream may only end after a protocol version using per
+// message compression has been negotiated.
+type streamReader struct {
+	br     *bufio.Reader // an io.ByteReader, so that the decompressor doesn't read past the end of the stream
+	fr     io.ReadCloser // nil once the stream has ended
+	mayEnd bool
+}
+
+func newStreamReader(r io.Reader) *streamReader {
+	br := bufio.NewReader(r)
+	return &streamReader{
+		br: br,
+		fr: flate.NewReader(br),
+	}
+}
+
+func (r *streamReader) Read(bs []byte) (int, error) {
+	if r.fr == nil {
+		return r.br.Read(bs)
+	}
+
+	n, err := r.fr.Read(bs)
+	if err != io.EOF {
+		return n, err
+	}
+	if !r.mayEnd {
+		return n, errStreamEnd
+	}
+
+	r.fr.Close()
+	r.fr = nil
+	if n == 0 {
+		return r.br.Read(bs)
+	}
+	return n, nil
+}
+
+// compressed returns true until the peer has ended the compressed stream.
+func (r *streamReader) compressed() bool {
+	return r.fr != nil
+}
+
+// A streamWriter writes the compressed stream that a connection starts
+// with, and writes uncompressed data once the stream has been ended.
+type streamWriter struct {
+	w  io.Writer
+	fw *flate.Writer // nil once the stream has ended
+}
+
+func newStreamWriter(w io.Writer) *streamWriter {
+	fw, err := flate.NewWriter(w, flate.BestSpeed)
+	if err != nil {
+		panic(err)
+	}
+	return &streamWriter{
+		w:  w,
+		fw: fw,
+	}
+}
+
+func (w *streamWriter) Write(bs []byte) (int, error) {
+	if w.fw == nil {
+		return w.w.Write(bs)
+	}
+	return w.fw.Write(bs)
+}
+
+// Flush writes any pending compressed data, ending at a byte boundary so
+// that the peer can decompress everything written so far.
+func (w *streamWriter) Flush() error {
+	if w.fw == nil {
+		return nil
+	}
+	return w.fw.Flush()
+}
+
+// end ends the compressed stream. Everything written after it is sent
+// uncompressed.
+func (w *streamWriter) end() error {
+	err := w.fw.Close()
+	w.fw = nil
+	return err
+}
+
+// compressed returns true until the stream has been ended.
+func (w *streamWriter) compressed() bool {
+	return w.fw != nil
+}
@@ -0,0 +1,389 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/xdr"
+)
+
+func TestCompressRoundtrip(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible data "), 100)
+	cd := compress(data)
+	if cd == nil {
+		t.Fatal("Compressible data not compressed")
+	}
+	if len(cd) >= len(data) {
+		t.Errorf("Compressed data not smaller, %d >= %d", len(cd), len(data))
+	}
+
+	dd, err := decompress(cd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dd, data) {
+		t.Error("Decompressed data differs")
+	}
+}
+
+func TestCompressIncompressible(t *testing.T) {
+	data := make([]byte, 128<<10)
+	rand.Reader.Read(data)
+	if cd := compress(data); cd != nil {
+		t.Errorf("Random data compressed to %d bytes", len(cd))
+	}
+}
+
+func TestDecompressSizeLimit(t *testing.T) {
+	// A response with a block of the maximum size is within the limit.
+	var buf bytes.Buffer
+	ResponseMessage{Data: make([]byte, MaxBlockSize)}.EncodeXDR(&buf)
+	if bs, err := decompress(compress(buf.Bytes())); err != nil || len(bs) != buf.Len() {
+		t.Errorf("Incorrect decompression of %d bytes, %d bytes, %v", buf.Len(), len(bs), err)
+	}
+
+	data := make([]byte, maxDecompressedSize+1)
+	if _, err := decompress(compress(data)); err != errDecompressedSize {
+		t.Errorf("Unexpected error %v != %v", err, errDecompressedSize)
+	}
+}
+
+func rawConn(c Connection) *rawConnection {
+	return c.(wireFormatConnection).next.(*rawConnection)
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	modes := []string{CompressNever, CompressMetadata, CompressAlways}
+	for _, local := range modes {
+		for _, remote := range modes {
+			ar, aw := io.Pipe()
+			br, bw := io.Pipe()
+
+			c0 := NewConnection(c0ID, ar, bw, newTestModel())
+			c1 := NewConnection(c1ID, br, aw, newTestModel())
+
+			if l := rawConn(c0).compressionLevel(); l != 0 {
+				t.Errorf("Compression level %d before cluster config", l)
+			}
+
+			c0.ClusterConfig(ClusterConfigMessage{Options: []Option{{CompressionOption, local}}})
+			c1.ClusterConfig(ClusterConfigMessage{Options: []Option{{CompressionOption, remote}}})
+
+			expected := compressionLevel(local)
+			if r := compressionLevel(remote); r < expected {
+				expected = r
+			}
+			for _, c := range []Connection{c0, c1} {
+				var l int
+				for t0 := time.Now(); time.Since(t0) < time.Second; time.Sleep(time.Millisecond) {
+					if l = rawConn(c).compressionLevel(); l == expected {
+						break
+					}
+				}
+				if l != expected {
+					t.Errorf("%s/%s: incorrect compression level %d != %d", local, remote, l, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestCompressedTransfer(t *testing.T) {
+	for _, mode := range []string{CompressNever, CompressMetadata, CompressAlways} {
+		m0 := newTestModel()
+		m0.data = bytes.Repeat([]byte("response data "), 1000)
+		m1 := newTestModel()
+
+		ar, aw := io.Pipe()
+		br, bw := io.Pipe()
+
+		c0 := NewConnection(c0ID, ar, bw, m0)
+		c1 := NewConnection(c1ID, br, aw, m1)
+
+		opts := []Option{{CompressionOption, mode}}
+		c0.ClusterConfig(ClusterConfigMessage{Options: opts})
+		c1.ClusterConfig(ClusterConfigMessage{Options: opts})
+
+		// Wait for the cluster configs to be processed so that the index
+		// and response can be compressed.
+		for t0 := time.Now(); time.Since(t0) < time.Second; time.Sleep(time.Millisecond) {
+			if rawConn(c0).compressionLevel() == compressionLevel(mode) && rawConn(c1).compressionLevel() == compressionLevel(mode) {
+				break
+			}
+		}
+
+		files := make([]FileInfo, 100)
+		for i := range files {
+			files[i].Name = "some/long/path/name/that/compresses/well"
+		}
+		c0.Index("default", files)
+		c1.Index("default", nil)
+
+		before := c0.Statistics().OutBytesTotal
+		d, err := c1.Request("default", "foo", 0, len(m0.data), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(d, m0.data) {
+			t.Errorf("%s: incorrect response data", mode)
+		}
+
+		sent := c0.Statistics().OutBytesTotal - before
+		if compressed := sent < uint64(len(m0.data)); compressed != (mode == CompressAlways) {
+			t.Errorf("%s: response sent in %d bytes", mode, sent)
+		}
+
+		var calls []indexCall
+		for t0 := time.Now(); time.Since(t0) < time.Second; time.Sleep(time.Millisecond) {
+			if calls = m1.indexCalls(); len(calls) > 0 {
+				break
+			}
+		}
+		if len(calls) != 1 || len(calls[0].files) != len(files) || calls[0].files[0].Name != files[0].Name {
+			t.Errorf("%s: incorrect index received", mode)
+		}
+	}
+}
+
+// A v0Peer speaks the protocol as implemented before version 1: the whole
+// stream is compressed in both directions and all messages are version 0.
+type v0Peer struct {
+	xr *xdr.Reader
+	fw *flate.Writer
+	xw *xdr.Writer
+}
+
+func newV0Peer(r io.Reader, w io.Writer) *v0Peer {
+	fw, err := flate.NewWriter(w, flate.BestSpeed)
+	if err != nil {
+		panic(err)
+	}
+	return &v0Peer{
+		xr: xdr.NewReader(flate.NewReader(r)),
+		fw: fw,
+		xw: xdr.NewWriter(fw),
+	}
+}
+
+func (p *v0Peer) send(hdr header, es ...encodable) error {
+	hdr.encodeXDR(p.xw)
+	for _, e := range es {
+		e.encodeXDR(p.xw)
+	}
+	if err := p.xw.Error(); err != nil {
+		return err
+	}
+	return p.fw.Flush()
+}
+
+// receive reads the next message header, which must be a version 0 header
+// of the given type.
+func (p *v0Peer) receive(t *testing.T, msgType int) header {
+	var hdr header
+	if err := hdr.decodeXDR(p.xr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.version != 0 || hdr.msgType != msgType {
+		t.Fatalf("Incorrect header %+v, expected version 0 type %d", hdr, msgType)
+	}
+	return hdr
+}
+
+func TestV0PeerFraming(t *testing.T) {
+	m := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c := NewConnection(c0ID, ar, bw, m)
+	p := newV0Peer(br, aw)
+
+	c.ClusterConfig(ClusterConfigMessage{ClientName: "new"})
+	p.receive(t, messageTypeClusterConfig)
+	var cm ClusterConfigMessage
+	if err := cm.decodeXDR(p.xr); err != nil {
+		t.Fatal(err)
+	}
+	if cm.ClientName != "new" {
+		t.Errorf("Incorrect cluster config %+v", cm)
+	}
+
+	if err := p.send(header{0, 0, messageTypeClusterConfig}, ClusterConfigMessage{ClientName: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	peerFiles := []fileInfoV0{{Name: "old/file", Version: 3}}
+	if err := p.send(header{0, 1, messageTypeIndex}, indexMessageV0{"default", peerFiles}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages sent after the old peer's cluster config stay in the
+	// compressed stream.
+
+	files := []FileInfo{{Name: "some/long/path/name/that/compresses/well", Version: 2, LocalVersion: 1}}
+	c.Index("default", files)
+	p.receive(t, messageTypeIndex)
+	var im indexMessageV0
+	if err := im.decodeXDR(p.xr); err != nil {
+		t.Fatal(err)
+	}
+	if im.Repository != "default" || len(im.Files) != 1 || im.Files[0].Name != files[0].Name || im.Files[0].Version != 2 {
+		t.Errorf("Incorrect index %+v", im)
+	}
+
+	if err := p.send(header{0, 2, messageTypePing}); err != nil {
+		t.Fatal(err)
+	}
+	if hdr := p.receive(t, messageTypePong); hdr.msgID != 2 {
+		t.Errorf("Incorrect pong message ID %d", hdr.msgID)
+	}
+
+	var calls []indexCall
+	for t0 := time.Now(); time.Since(t0) < time.Second; time.Sleep(time.Millisecond) {
+		if calls = m.indexCalls(); len(calls) > 0 {
+			break
+		}
+	}
+	if len(calls) != 1 || calls[0].repo != "default" || len(calls[0].files) != 1 || calls[0].files[0].Name != "old/file" || calls[0].files[0].Version != 3 {
+		t.Errorf("Incorrect index calls %+v", calls)
+	}
+}
+
+// connectV0Peer connects a new connection to a v0Peer and exchanges cluster
+// configs and indexes with it.
+func connectV0Peer(t *testing.T, m *TestModel) (Connection, *v0Peer) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c := NewConnection(c0ID, ar, bw, m)
+	p := newV0Peer(br, aw)
+
+	c.ClusterConfig(ClusterConfigMessage{ClientName: "new"})
+	p.receive(t, messageTypeClusterConfig)
+	var cm ClusterConfigMessage
+	if err := cm.decodeXDR(p.xr); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.send(header{0, 0, messageTypeClusterConfig}, ClusterConfigMessage{ClientName: "old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Index("default", nil)
+	p.receive(t, messageTypeIndex)
+	var im indexMessageV0
+	if err := im.decodeXDR(p.xr); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.send(header{0, 1, messageTypeIndex}, indexMessageV0{Repository: "default"}); err != nil {
+		t.Fatal(err)
+	}
+
+	return c, p
+}
+
+func TestV0PeerRequest(t *testing.T) {
+	m := newTestModel()
+	m.data = []byte("response data")
+	c, p := connectV0Peer(t, m)
+
+	// Our request is sent without the block hash, and the response is
+	// only the data.
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		d, err := c.Request("default", "foo", 131072, 1024, []byte("some hash"), nil)
+		resc <- result{d, err}
+	}()
+	hdr := p.receive(t, messageTypeRequest)
+	var req requestMessageV0
+	if err := req.decodeXDR(p.xr); err != nil {
+		t.Fatal(err)
+	}
+	if req != (requestMessageV0{"default", "foo", 131072, 1024}) {
+		t.Errorf("Incorrect request %+v", req)
+	}
+	if err := p.send(header{0, hdr.msgID, messageTypeResponse}, responseMessageV0{[]byte("old data")}); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-resc; res.err != nil || string(res.data) != "old data" {
+		t.Errorf("Incorrect response %q, %v", res.data, res.err)
+	}
+
+	// The old peer's request gets a response with only the data. Errors
+	// are sent as empty data.
+
+	for i, err := range []error{nil, ErrNoSuchFile} {
+		m.err = err
+		if err := p.send(header{0, i, messageTypeRequest}, requestMessageV0{"default", "bar", 0, 42}); err != nil {
+			t.Fatal(err)
+		}
+		p.receive(t, messageTypeResponse)
+		var resp responseMessageV0
+		if err := resp.decodeXDR(p.xr); err != nil {
+			t.Fatal(err)
+		}
+		expected := m.data
+		if err != nil {
+			expected = nil
+		}
+		if !bytes.Equal(resp.Data, expected) {
+			t.Errorf("Incorrect response data %q for error %v", resp.Data, err)
+		}
+	}
+
+	// The next message follows directly after the response.
+
+	if err := p.send(header{0, 2, messageTypePing}); err != nil {
+		t.Fatal(err)
+	}
+	p.receive(t, messageTypePong)
+
+	m.reqMut.Lock()
+	defer m.reqMut.Unlock()
+	if m.name != "bar" || m.size != 42 {
+		t.Errorf("Incorrect request to the model, %q size %d", m.name, m.size)
+	}
+}
+
+func TestV0PeerCancel(t *testing.T) {
+	m := newTestModel()
+	c, p := connectV0Peer(t, m)
+
+	// A canceled request isn't followed by a cancel message, since the
+	// feature isn't negotiated.
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, err := c.Request("default", "foo", 0, 1024, nil, cancel); err != ErrCanceled {
+		t.Errorf("Incorrect error %v", err)
+	}
+	p.receive(t, messageTypeRequest)
+	var req requestMessageV0
+	if err := req.decodeXDR(p.xr); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.send(header{0, 2, messageTypePing}); err != nil {
+		t.Fatal(err)
+	}
+	p.receive(t, messageTypePong)
+
+	// Receiving a cancel message is a protocol error.
+
+	if err := p.send(header{0, 3, messageTypeCancel}); err != nil {
+		t.Fatal(err)
+	}
+	if !m.isClosed() {
+		t.Fatal("Connection not closed")
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package protocol
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/xdr"
+)
+
+var errDisconnected = errors.New("disconnected")
+
+const (
+	faultCorrupt    = iota // flip all bits of the byte at the offset
+	faultTruncate          // fail the write at the offset, leaving the peer waiting for the rest
+	faultDisconnect        // break both directions of the transport at the offset
+)
+
+type fault struct {
+	at   int // offset in the written stream
+	kind int
+}
+
+// A faultConfig describes the faults injected in one direction of a
+// faulty transport.
+type faultConfig struct {
+	latency         time.Duration // delay before each write is delivered
+	bandwidth       int           // bytes per second, zero for unlimited
+	faults          []fault       // sorted by offset
+	dropRate        float64       // probability of a disconnect at each write
+	seed            int64         // seed for the random disconnects
+	disconnectAfter time.Duration // disconnect at this time after creation, if non zero
+}
+
+// A faultyWriter is one direction of a faulty transport.
+type faultyWriter struct {
+	cfg     faultConfig
+	rnd     *rand.Rand
+	pipe    *io.PipeWriter
+	reverse *io.PipeWriter // the other direction, broken by a disconnect
+
+	mut     sync.Mutex
+	written int
+	err     error // set by a fault, returned from all following writes
+}
+
+// faultyTransport returns the ends of an in-memory bidirectional transport
+// for NewConnection. What is written to w0 is read from r1 with the faults
+// in f0 injected, and vice versa.
+func faultyTransport(f0, f1 faultConfig) (r0 io.Reader, w0 *faultyWriter, r1 io.Reader, w1 *faultyWriter) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	w0 = newFaultyWriter(f0, aw, bw)
+	w1 = newFaultyWriter(f1, bw, aw)
+	return br, w0, ar, w1
+}
+
+func newFaultyWriter(cfg faultConfig, pipe, reverse *io.PipeWriter) *faultyWriter {
+	w := &faultyWriter{
+		cfg:     cfg,
+		rnd:     rand.New(rand.NewSource(cfg.seed)),
+		pipe:    pipe,
+		reverse: reverse,
+	}
+	if cfg.disconnectAfter > 0 {
+		time.AfterFunc(cfg.disconnectAfter, w.disconnect)
+	}
+	return w
+}
+
+func (w *faultyWriter) Write(data []byte) (int, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.cfg.latency > 0 {
+		time.Sleep(w.cfg.latency)
+	}
+	if w.cfg.bandwidth > 0 {
+		time.Sleep(time.Duration(len(data)) * time.Second / time.Duration(w.cfg.bandwidth))
+	}
+	if w.cfg.dropRate > 0 && w.rnd.Float64() < w.cfg.dropRate {
+		w.disconnect()
+		w.err = errDisconnected
+		return 0, w.err
+	}
+
+	var copied bool
+	end := w.written + len(data)
+	for len(w.cfg.faults) > 0 && w.cfg.faults[0].at < end {
+		f := w.cfg.faults[0]
+		w.cfg.faults = w.cfg.faults[1:]
+		off := f.at - w.written
+
+		switch f.kind {
+		case faultCorrupt:
+			// Don't modify the caller's buffer
+			if !copied {
+				data = append([]byte(nil), data...)
+				copied = true
+			}
+			data[off] ^= 0xff
+
+		case faultTruncate:
+			n := w.write(data[:off])
+			w.err = io.ErrShortWrite
+			return n, w.err
+
+		case faultDisconnect:
+			n := w.write(data[:off])
+			w.disconnect()
+			w.err = errDisconnected
+			return n, w.err
+		}
+	}
+
+	n := w.write(data)
+	if n < len(data) {
+		return n, io.ErrClosedPipe
+	}
+	return n, nil
+}
+
+// addFault adds a fault at the given offset after what has been written so
+// far.
+func (w *faultyWriter) addFault(f fault) {
+	w.mut.Lock()
+	f.at += w.written
+	w.cfg.faults = append(w.cfg.faults, f)
+	w.mut.Unlock()
+}
+
+// write passes data on to the pipe. Must be called with mut held.
+func (w *faultyWriter) write(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	n, _ := w.pipe.Write(data)
+	w.written += n
+	return n
+}
+
+// disconnect breaks both directions of the transport, as when the network
+// goes away. The readers at both ends get errDisconnected.
+func (w *faultyWriter) disconnect() {
+	w.pipe.CloseWithError(errDisconnected)
+	w.reverse.CloseWithError(errDisconnected)
+}
+
+// faultyConnections returns two connected connections over a faulty
+// transport, with the cluster config and an empty index sent in both
+// directions.
+func faultyConnections(f0, f1 faultConfig, m0, m1 *TestModel) (c0, c1 Connection, w0, w1 *faultyWriter) {
+	r0, w0, r1, w1 := faultyTransport(f0, f1)
+	c0 = NewConnection(c0ID, r0, w0, m0)
+	c1 = NewConnection(c1ID, r1, w1, m1)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+	return
+}
+
+func TestFaultyTransportLatency(t *testing.T) {
+	m0 := newTestModel()
+	m0.data = make([]byte, 1000)
+	m1 := newTestModel()
+
+	f := faultConfig{latency: 10 * time.Millisecond, bandwidth: 10000}
+	_, c1, _, _ := faultyConnections(f, f, m0, m1)
+
+	t0 := time.Now()
+	d, err := c1.Request("default", "foo", 0, 1000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 1000 {
+		t.Errorf("Incorrect response length %d", len(d))
+	}
+
+	// The response alone takes 100 ms at the given bandwidth
+	if d := time.Since(t0); d < 100*time.Millisecond {
+		t.Errorf("Request too fast for the bandwidth limit, %v", d)
+	}
+}
+
+func TestReaderLoopErrors(t *testing.T) {
+	// The faults are injected in an uncompressed index message for the
+	// repository "other", which has the header at offset 0, with the
+	// message type at offset 2, the repository length at 4 and the number
+	// of files at 16.
+	cases := []struct {
+		fault fault
+		err   string
+	}{
+		{fault{0, faultCorrupt}, "unknown message version"},
+		{fault{2, faultCorrupt}, "unknown message type"},
+		{fault{4, faultCorrupt}, xdr.ErrElementSizeExceeded.Error()},
+		{fault{16, faultCorrupt}, xdr.ErrElementSizeExceeded.Error()},
+		{fault{14, faultDisconnect}, errDisconnected.Error()},
+	}
+
+	for i, tc := range cases {
+		m0 := newTestModel()
+		m1 := newTestModel()
+
+		c0, _, w0, _ := faultyConnections(faultConfig{}, faultConfig{}, m0, m1)
+		for t0 := time.Now(); time.Since(t0) < time.Second; time.Sleep(time.Millisecond) {
+			if rawConn(c0).negotiatedVersion() > 0 {
+				break
+			}
+		}
+
+		// The compressed stream has ended once an index sent after the
+		// negotiation has been received.
+		c0.Index("sync", nil)
+		for t0 := time.Now(); time.Since(t0) < time.Second; time.Sleep(time.Millisecond) {
+			if len(m1.indexCalls()) == 2 {
+				break
+			}
+		}
+
+		w0.addFault(tc.fault)
+		c0.Index("other", nil)
+
+		if !m1.isClosed() {
+			t.Errorf("%d: connection not closed", i)
+			continue
+		}
+		if m1.closeErr == nil || !strings.Contains(m1.closeErr.Error(), tc.err) {
+			t.Errorf("%d: incorrect error %v, expected %q", i, m1.closeErr, tc.err)
+		}
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	// The pong is delayed beyond the ping timeout
+	r0, w0, r1, w1 := faultyTransport(faultConfig{}, faultConfig{latency: time.Second})
+	c0 := newRawConnection(c0ID, r0, w0, m0)
+	c0.pingIdle = 20 * time.Millisecond
+	c0.pingWait = 50 * time.Millisecond
+	c0.start()
+	NewConnection(c1ID, r1, w1, m1)
+
+	if !m0.isClosed() {
+		t.Fatal("Connection not closed")
+	}
+	if m0.closeErr == nil || m0.closeErr.Error() != "ping timeout" {
+		t.Errorf("Incorrect error %v", m0.closeErr)
+	}
+}
+
+func TestPingTruncatedWrite(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	// A write that fails half way leaves the peer waiting for the rest of
+	// the message. It must notice that the connection is gone by the
+	// missing pong.
+	r0, w0, r1, w1 := faultyTransport(faultConfig{faults: []fault{{6, faultTruncate}}}, faultConfig{})
+	c0 := NewConnection(c0ID, r0, w0, m0)
+	c1 := newRawConnection(c1ID, r1, w1, m1)
+	c1.pingIdle = 20 * time.Millisecond
+	c1.pingWait = 50 * time.Millisecond
+	c1.start()
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+
+	if !m0.isClosed() {
+		t.Fatal("Writing connection not closed")
+	}
+	if m0.closeErr != io.ErrShortWrite {
+		t.Errorf("Incorrect error %v", m0.closeErr)
+	}
+	if !m1.isClosed() {
+		t.Fatal("Waiting connection not closed")
+	}
+	if m1.closeErr == nil || m1.closeErr.Error() != "ping timeout" {
+		t.Errorf("Incorrect error %v", m1.closeErr)
+	}
+}
+
+func TestCloseAwaiting(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.block = make(chan struct{})
+	defer close(m1.block)
+
+	c0, _, w0, _ := faultyConnections(faultConfig{}, faultConfig{}, m0, m1)
+	rc0 := c0.(wireFormatConnection).next.(*rawConnection)
+
+	const requests = 5
+	errs := make(chan error)
+	for i := 0; i < requests; i++ {
+		go func() {
+			_, err := c0.Request("default", "foo", 0, 128, nil, nil)
+			errs <- err
+		}()
+	}
+
+	// Wait for the requests to be sent and left unanswered
+	for awaiting(rc0) < requests {
+		time.Sleep(time.Millisecond)
+	}
+
+	w0.disconnect()
+
+	for i := 0; i < requests; i++ {
+		select {
+		case err := <-errs:
+			if err != ErrClosed {
+				t.Errorf("Incorrect error %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Request not returned after close")
+		}
+	}
+
+	if !m0.isClosed() {
+		t.Fatal("Connection not closed")
+	}
+	if n := awaiting(rc0); n != 0 {
+		t.Errorf("%d awaiting channels left after close", n)
+	}
+}
+
+func TestRandomDisconnects(t *testing.T) {
+	m0 := newTestModel()
+	m0.data = []byte("response data")
+	m1 := newTestModel()
+
+	for seed := int64(0); seed < 10; seed++ {
+		m0.closedCh = make(chan bool)
+		m1.closedCh = make(chan bool)
+
+		f := faultConfig{dropRate: 0.05, seed: seed}
+		_, c1, _, _ := faultyConnections(f, f, m0, m1)
+
+		// Requests succeed until the disconnect, and then fail without
+		// hanging.
+		var err error
+		for i := 0; i < 1000 && err == nil; i++ {
+			var d []byte
+			d, err = c1.Request("default", "foo", 0, 128, nil, nil)
+			if err == nil && string(d) != "response data" {
+				t.Fatalf("%d: incorrect response data %q", seed, d)
+			}
+		}
+		if err != ErrClosed {
+			t.Errorf("%d: incorrect error %v", seed, err)
+		}
+		if !m0.isClosed() || !m1.isClosed() {
+			t.Fatalf("%d: connections not closed", seed)
+		}
+		if n := awaiting(c1.(wireFormatConnection).next.(*rawConnection)); n != 0 {
+			t.Errorf("%d: %d awaiting channels left after close", seed, n)
+		}
+	}
+}
+
+// awaiting returns the number of requests and pings waiting for a reply.
+func awaiting(c *rawConnection) int {
+	c.awaitingMut.Lock()
+	defer c.awaitingMut.Unlock()
+	var n int
+	for _, ch := range c.awaiting {
+		if ch != nil {
+			n++
+		}
+	}
+	return n
+}
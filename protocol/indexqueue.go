@@ -0,0 +1,135 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package protocol
+
+import "sync"
+
+// The maximum cost of the index messages waiting to be processed for a
+// single connection. The cost of a message is the number of files plus the
+// number of blocks it contains, which is roughly proportional to the memory
+// it uses.
+const maxQueuedIndexCost = 250000
+
+// The extra cost accepted while awaiting a response. It leaves room for the
+// index messages the peer has sent ahead of the response.
+const overflowIndexCost = 4 * indexChunkCost
+
+type incomingIndex struct {
+	update bool
+	id     NodeID
+	repo   string
+	files  []FileInfo
+}
+
+func (ii incomingIndex) cost() int {
+	cost := len(ii.files)
+	for _, f := range ii.files {
+		cost += len(f.Blocks)
+	}
+	return cost
+}
+
+// An indexQueue is a FIFO queue of received index messages for one
+// connection. Adding to a full queue blocks until there is room again, so
+// a slow receiver pushes back on the reader instead of buffering without
+// bound. A single message larger than the limit is accepted when the queue
+// is empty.
+//
+// The reader must not be blocked while the connection waits for a response
+// or pong from the peer, since those are read after the index messages
+// ahead of them. The queue accepts another overflowCost worth of messages
+// while there is an overflow allowance.
+type indexQueue struct {
+	maxCost      int
+	overflowCost int
+	queue        []incomingIndex
+	cost         int
+	overflow     int // number of outstanding allowances to exceed maxCost
+	closed       bool
+	mut          sync.Mutex
+	cond         *sync.Cond
+}
+
+func newIndexQueue(maxCost, overflowCost int) *indexQueue {
+	q := &indexQueue{maxCost: maxCost, overflowCost: overflowCost}
+	q.cond = sync.NewCond(&q.mut)
+	return q
+}
+
+// put adds ii to the queue, blocking while the queue is full. It returns
+// false if the queue was closed.
+func (q *indexQueue) put(ii incomingIndex) bool {
+	cost := ii.cost()
+
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	for !q.closed && len(q.queue) > 0 && q.cost+cost > q.limit() {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return false
+	}
+
+	q.queue = append(q.queue, ii)
+	q.cost += cost
+	q.cond.Broadcast()
+	return true
+}
+
+// limit returns the current maximum cost of the queue. Must be called with
+// mut held.
+func (q *indexQueue) limit() int {
+	if q.overflow > 0 {
+		return q.maxCost + q.overflowCost
+	}
+	return q.maxCost
+}
+
+// allowOverflow lets put add messages to a full queue, up to the overflow
+// cost, until the matching endOverflow call.
+func (q *indexQueue) allowOverflow() {
+	q.mut.Lock()
+	q.overflow++
+	q.cond.Broadcast()
+	q.mut.Unlock()
+}
+
+func (q *indexQueue) endOverflow() {
+	q.mut.Lock()
+	q.overflow--
+	q.mut.Unlock()
+}
+
+// get removes and returns the oldest message, blocking while the queue is
+// empty. It returns false if the queue was closed.
+func (q *indexQueue) get() (incomingIndex, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	for !q.closed && len(q.queue) == 0 {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return incomingIndex{}, false
+	}
+
+	ii := q.queue[0]
+	q.queue[0] = incomingIndex{}
+	q.queue = q.queue[1:]
+	q.cost -= ii.cost()
+	q.cond.Broadcast()
+	return ii, true
+}
+
+// close discards any queued messages and releases all waiting callers.
+func (q *indexQueue) close() {
+	q.mut.Lock()
+	q.closed = true
+	q.queue = nil
+	q.cost = 0
+	q.cond.Broadcast()
+	q.mut.Unlock()
+}
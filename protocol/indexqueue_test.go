@@ -0,0 +1,155 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package protocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func indexOfCost(name string, cost int) incomingIndex {
+	return incomingIndex{repo: name, files: make([]FileInfo, cost)}
+}
+
+func TestIndexQueueOrder(t *testing.T) {
+	q := newIndexQueue(100, 0)
+	for i := 0; i < 10; i++ {
+		q.put(indexOfCost(fmt.Sprint(i), 1))
+	}
+	for i := 0; i < 10; i++ {
+		ii, ok := q.get()
+		if !ok {
+			t.Fatal("Unexpected closed queue")
+		}
+		if ii.repo != fmt.Sprint(i) {
+			t.Errorf("Out of order message %q, expected %d", ii.repo, i)
+		}
+	}
+}
+
+func TestIndexQueueBackpressure(t *testing.T) {
+	q := newIndexQueue(10, 0)
+	q.put(indexOfCost("a", 8))
+
+	done := make(chan bool)
+	go func() {
+		done <- q.put(indexOfCost("b", 5))
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Put on a full queue should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if ii, _ := q.get(); ii.repo != "a" {
+		t.Errorf("Unexpected message %q", ii.repo)
+	}
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("Put failed after get")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Put still blocked after get")
+	}
+}
+
+func TestIndexQueueOverflow(t *testing.T) {
+	q := newIndexQueue(10, 5)
+	q.put(indexOfCost("a", 8))
+
+	done := make(chan bool)
+	go func() {
+		done <- q.put(indexOfCost("b", 5))
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Put on a full queue should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// An allowance releases the blocked put, up to the overflow cost.
+	q.allowOverflow()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Put still blocked with overflow allowed")
+	}
+	q.put(indexOfCost("c", 2))
+
+	go func() {
+		done <- q.put(indexOfCost("d", 1))
+	}()
+	select {
+	case <-done:
+		t.Fatal("Put above the overflow cost should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if ii, _ := q.get(); ii.repo != "a" {
+		t.Errorf("Unexpected message %q", ii.repo)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Put still blocked after get")
+	}
+	q.endOverflow()
+
+	go func() {
+		done <- q.put(indexOfCost("e", 5))
+	}()
+	select {
+	case <-done:
+		t.Fatal("Put on a full queue should block after the overflow ended")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.close()
+	<-done
+}
+
+func TestIndexQueueOversized(t *testing.T) {
+	q := newIndexQueue(10, 0)
+
+	// A message larger than the limit is let in on an empty queue.
+	done := make(chan bool)
+	go func() {
+		done <- q.put(indexOfCost("a", 50))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Oversized put blocked on empty queue")
+	}
+}
+
+func TestIndexQueueClose(t *testing.T) {
+	q := newIndexQueue(10, 0)
+	q.put(indexOfCost("a", 10))
+
+	putRes := make(chan bool)
+	go func() {
+		putRes <- q.put(indexOfCost("b", 1))
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	q.close()
+
+	select {
+	case ok := <-putRes:
+		if ok {
+			t.Error("Put on a closed queue should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Put still blocked after close")
+	}
+
+	if _, ok := q.get(); ok {
+		t.Error("Get on a closed queue should fail")
+	}
+}
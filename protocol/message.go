@@ -9,7 +9,23 @@ type IndexMessage struct {
 	Files      []FileInfo // max:10000000
 }
 
+// indexMessageV0 is the index message of protocol version 0, which has no
+// local versions in the file information.
+type indexMessageV0 struct {
+	Repository string       // max:64
+	Files      []fileInfoV0 // max:10000000
+}
+
 type FileInfo struct {
+	Name         string // max:1024
+	Flags        uint32
+	Modified     int64
+	Version      uint64
+	LocalVersion uint64
+	Blocks       []BlockInfo // max:1000000
+}
+
+type fileInfoV0 struct {
 	Name     string // max:1024
 	Flags    uint32
 	Modified int64
@@ -27,6 +43,27 @@ type RequestMessage struct {
 	Name       string // max:1024
 	Offset     uint64
 	Size       uint32
+	Hash       []byte // max:64
+}
+
+// requestMessageV0 is the request message of protocol version 0, which has
+// no block hash.
+type requestMessageV0 struct {
+	Repository string // max:64
+	Name       string // max:1024
+	Offset     uint64
+	Size       uint32
+}
+
+type ResponseMessage struct {
+	Data  []byte // max:16777216
+	Error uint32
+}
+
+// responseMessageV0 is the response message of protocol version 0, which
+// has no error code. Errors are sent as empty data.
+type responseMessageV0 struct {
+	Data []byte // max:16777216
 }
 
 type ClusterConfigMessage struct {
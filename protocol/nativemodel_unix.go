@@ -20,8 +20,8 @@ func (m nativeModel) IndexUpdate(nodeID NodeID, repo string, files []FileInfo) {
 	m.next.IndexUpdate(nodeID, repo, files)
 }
 
-func (m nativeModel) Request(nodeID NodeID, repo string, name string, offset int64, size int) ([]byte, error) {
-	return m.next.Request(nodeID, repo, name, offset, size)
+func (m nativeModel) Request(nodeID NodeID, repo string, name string, offset int64, size int, hash []byte) ([]byte, error) {
+	return m.next.Request(nodeID, repo, name, offset, size, hash)
 }
 
 func (m nativeModel) ClusterConfig(nodeID NodeID, config ClusterConfigMessage) {
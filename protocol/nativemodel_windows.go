@@ -48,9 +48,9 @@ func (m nativeModel) IndexUpdate(nodeID NodeID, repo string, files []FileInfo) {
 	m.next.IndexUpdate(nodeID, repo, files)
 }
 
-func (m nativeModel) Request(nodeID NodeID, repo string, name string, offset int64, size int) ([]byte, error) {
+func (m nativeModel) Request(nodeID NodeID, repo string, name string, offset int64, size int, hash []byte) ([]byte, error) {
 	name = filepath.FromSlash(name)
-	return m.next.Request(nodeID, repo, name, offset, size)
+	return m.next.Request(nodeID, repo, name, offset, size, hash)
 }
 
 func (m nativeModel) ClusterConfig(nodeID NodeID, config ClusterConfigMessage) {
@@ -0,0 +1,113 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package protocol
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The protocol versions we support, highest first. Version 0 must always be
+// supported since the cluster config message, and anything sent before the
+// peer's cluster config has been received, uses it. Version 1 ends the
+// compressed stream and compresses messages one by one instead.
+var supportedVersions = []int{1, 0}
+
+// Optional protocol features. A feature is only used on a connection when
+// both sides announce it in their cluster config, and version 1 or later is
+// used.
+const (
+	FeatureCompression      = "compression"      // per message compression
+	FeatureCancel           = "cancel"           // request cancellation
+	FeatureLargeBlocks      = "largeBlocks"      // blocks larger than BlockSize
+	FeatureIncrementalIndex = "incrementalIndex" // index updates in place of the initial index
+)
+
+var supportedFeatures = []string{
+	FeatureCompression,
+	FeatureCancel,
+	FeatureLargeBlocks,
+	FeatureIncrementalIndex,
+}
+
+const (
+	versionsOption = "versions"
+	featuresOption = "features"
+)
+
+var ErrNoCommonVersion = errors.New("protocol error: no common protocol version")
+
+// capabilityOptions returns the cluster config options announcing the
+// given supported versions and our features.
+func capabilityOptions(versions []int) []Option {
+	var vs []string
+	for _, v := range versions {
+		vs = append(vs, strconv.Itoa(v))
+	}
+	return []Option{
+		{versionsOption, strings.Join(vs, ",")},
+		{featuresOption, strings.Join(supportedFeatures, ",")},
+	}
+}
+
+// negotiate returns the highest protocol version among versions and the set
+// of features supported by both us and the peer that sent the cluster
+// config. A peer that doesn't announce any versions is assumed to support
+// only version 0 and no optional features. No features are used with
+// version 0.
+func negotiate(cm ClusterConfigMessage, versions []int) (int, map[string]bool, error) {
+	remoteVersions := []int{0}
+	remoteFeatures := make(map[string]bool)
+	for _, opt := range cm.Options {
+		switch opt.Key {
+		case versionsOption:
+			remoteVersions = nil
+			for _, s := range strings.Split(opt.Value, ",") {
+				if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+					remoteVersions = append(remoteVersions, v)
+				}
+			}
+		case featuresOption:
+			for _, s := range strings.Split(opt.Value, ",") {
+				remoteFeatures[strings.TrimSpace(s)] = true
+			}
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(remoteVersions)))
+	version := -1
+	for _, rv := range remoteVersions {
+		if containsVersion(versions, rv) {
+			version = rv
+			break
+		}
+	}
+	if version < 0 {
+		return 0, nil, ErrNoCommonVersion
+	}
+
+	features := make(map[string]bool)
+	if version == 0 {
+		return version, features, nil
+	}
+	for _, f := range supportedFeatures {
+		if remoteFeatures[f] {
+			features[f] = true
+		}
+	}
+
+	return version, features, nil
+}
+
+func containsVersion(versions []int, v int) bool {
+	for _, sv := range versions {
+		if sv == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNegotiateCommon(t *testing.T) {
+	cm := ClusterConfigMessage{
+		Options: []Option{
+			{versionsOption, "3, 1, 0"},
+			{featuresOption, "cancel,unknownFeature, compression"},
+		},
+	}
+
+	v, fs, err := negotiate(cm, supportedVersions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 {
+		t.Errorf("Incorrect version %d != 1", v)
+	}
+	if len(fs) != 2 || !fs[FeatureCancel] || !fs[FeatureCompression] {
+		t.Errorf("Incorrect features %v", fs)
+	}
+}
+
+func TestNegotiateVersion0(t *testing.T) {
+	cm := ClusterConfigMessage{
+		Options: []Option{
+			{versionsOption, "0"},
+			{featuresOption, "cancel,compression"},
+		},
+	}
+
+	// No features are used with version 0, whether it is the highest
+	// version of the peer or of us.
+	for _, versions := range [][]int{supportedVersions, {0}} {
+		v, fs, err := negotiate(cm, versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 0 {
+			t.Errorf("Incorrect version %d != 0", v)
+		}
+		if len(fs) != 0 {
+			t.Errorf("Unexpected features %v", fs)
+		}
+	}
+}
+
+func TestNegotiateNoOptions(t *testing.T) {
+	v, fs, err := negotiate(ClusterConfigMessage{}, supportedVersions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 0 {
+		t.Errorf("Incorrect version %d != 0", v)
+	}
+	if len(fs) != 0 {
+		t.Errorf("Unexpected features %v", fs)
+	}
+}
+
+func TestNegotiateNoCommonVersion(t *testing.T) {
+	cm := ClusterConfigMessage{
+		Options: []Option{{versionsOption, "2,3"}},
+	}
+	if _, _, err := negotiate(cm, supportedVersions); err != ErrNoCommonVersion {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoCommonVersion)
+	}
+}
+
+func TestConnectionFeatures(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, newTestModel())
+	c1 := NewConnection(c1ID, br, aw, newTestModel())
+
+	if c0.HasFeature(FeatureCancel) {
+		t.Error("Feature available before cluster config")
+	}
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+
+	for _, c := range []Connection{c0, c1} {
+		var ok bool
+		for t0 := time.Now(); time.Since(t0) < time.Second; time.Sleep(time.Millisecond) {
+			if ok = c.HasFeature(FeatureCancel); ok {
+				break
+			}
+		}
+		if !ok {
+			t.Error("Cancel feature not negotiated")
+		}
+		if c.HasFeature("unknownFeature") {
+			t.Error("Unknown feature reported as negotiated")
+		}
+	}
+}
+
+func TestConnectionNegotiateDown(t *testing.T) {
+	m0 := newTestModel()
+	m0.data = bytes.Repeat([]byte("response data "), 1000)
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	// A peer only supporting version 0
+	rc0 := newRawConnection(c0ID, ar, bw, m0)
+	rc0.versions = []int{0}
+	rc0.start()
+	c0 := wireFormatConnection{rc0}
+	c1 := NewConnection(c1ID, br, aw, m1)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	d, err := c1.Request("default", "foo", 0, len(m0.data), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, m0.data) {
+		t.Error("Incorrect response data")
+	}
+
+	for _, c := range []Connection{c0, c1} {
+		if v := rawConn(c).negotiatedVersion(); v != 0 {
+			t.Errorf("Incorrect version %d != 0", v)
+		}
+		for _, f := range supportedFeatures {
+			if c.HasFeature(f) {
+				t.Errorf("Feature %q negotiated with version 0", f)
+			}
+		}
+	}
+
+	// The response was sent in the compressed stream
+	if sent := c0.Statistics().OutBytesTotal; sent >= uint64(len(m0.data)) {
+		t.Errorf("Stream not compressed, %d bytes sent", sent)
+	}
+}
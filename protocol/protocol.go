@@ -6,7 +6,7 @@ package protocol
 
 import (
 	"bufio"
-	"compress/flate"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -16,7 +16,10 @@ import (
 	"github.com/calmh/syncthing/xdr"
 )
 
-const BlockSize = 128 * 1024
+const (
+	BlockSize    = 128 * 1024
+	MaxBlockSize = 16 * 1024 * 1024
+)
 
 const (
 	messageTypeClusterConfig = 0
@@ -26,8 +29,24 @@ const (
 	messageTypePing          = 4
 	messageTypePong          = 5
 	messageTypeIndexUpdate   = 6
+	messageTypeCancel        = 7
+)
+
+// Outgoing messages are queued in separate lanes so that small, latency
+// sensitive messages don't have to wait behind large index transfers. The
+// writer always prefers the lowest numbered lane with a waiting message.
+const (
+	laneControl = iota // ping, pong, cluster config
+	laneRequest        // requests, responses and cancellations
+	laneIndex          // index and index updates
+	numLanes
 )
 
+// Index messages are split into chunks of at most this cost (number of
+// files plus number of blocks), so that other traffic can be interleaved
+// with a large index.
+const indexChunkCost = 16384
+
 const (
 	stateInitial = iota
 	stateCCRcvd
@@ -39,12 +58,19 @@ const (
 	FlagInvalid           = 1 << 13
 	FlagDirectory         = 1 << 14
 	FlagNoPermBits        = 1 << 15
+
+	// The block size of a file is recorded in the flags as the base two
+	// logarithm of the block size in units of BlockSize.
+	FlagBlockSizeBits  = 0xf << flagBlockSizeShift
+	flagBlockSizeShift = 20
 )
 
 const (
-	FlagShareTrusted  uint32 = 1 << 0
-	FlagShareReadOnly        = 1 << 1
-	FlagShareBits            = 0x000000ff
+	FlagShareTrusted        uint32 = 1 << 0
+	FlagShareReadOnly              = 1 << 1
+	FlagShareReceiveOnly           = 1 << 2
+	FlagShareBits                  = 0x000000ff
+	FlagSharePermissionBits        = FlagShareTrusted | FlagShareReadOnly | FlagShareReceiveOnly
 )
 
 var (
@@ -52,13 +78,44 @@ var (
 	ErrClosed      = errors.New("connection closed")
 )
 
+// ErrorCode is the error code sent in a response message. Non zero error
+// codes are returned as errors from Connection.Request, and may be returned
+// by Model.Request to send a specific error code to the peer.
+type ErrorCode uint32
+
+const (
+	ErrGeneric ErrorCode = iota + 1
+	ErrNoSuchFile
+	ErrInvalid
+	ErrIO
+	ErrHashMismatch
+	ErrCanceled
+)
+
+var errorCodeStrings = map[ErrorCode]string{
+	ErrGeneric:      "generic error",
+	ErrNoSuchFile:   "no such file",
+	ErrInvalid:      "file is invalid",
+	ErrIO:           "I/O error",
+	ErrHashMismatch: "block data does not match hash",
+	ErrCanceled:     "request canceled",
+}
+
+func (e ErrorCode) Error() string {
+	if s, ok := errorCodeStrings[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown error code %d", uint32(e))
+}
+
 type Model interface {
 	// An index was received from the peer node
 	Index(nodeID NodeID, repo string, files []FileInfo)
 	// An index update was received from the peer node
 	IndexUpdate(nodeID NodeID, repo string, files []FileInfo)
-	// A request was made by the peer node
-	Request(nodeID NodeID, repo string, name string, offset int64, size int) ([]byte, error)
+	// A request was made by the peer node. An error of type ErrorCode is
+	// sent as is to the peer, any other error as ErrGeneric.
+	Request(nodeID NodeID, repo string, name string, offset int64, size int, hash []byte) ([]byte, error)
 	// A cluster configuration message was received
 	ClusterConfig(nodeID NodeID, config ClusterConfigMessage)
 	// The peer node closed the connection
@@ -68,8 +125,10 @@ type Model interface {
 type Connection interface {
 	ID() NodeID
 	Index(repo string, files []FileInfo)
-	Request(repo string, name string, offset int64, size int) ([]byte, error)
+	IndexUpdate(repo string, files []FileInfo, maxLocalVersion uint64)
+	Request(repo string, name string, offset int64, size int, hash []byte, cancel <-chan struct{}) ([]byte, error)
 	ClusterConfig(config ClusterConfigMessage)
+	HasFeature(feature string) bool
 	Statistics() Statistics
 }
 
@@ -78,23 +137,42 @@ type rawConnection struct {
 	receiver Model
 	state    int
 
-	reader io.ReadCloser
-	cr     *countingReader
-	xr     *xdr.Reader
+	cr *countingReader
+	sr *streamReader
+	xr *xdr.Reader
+
+	cw *countingWriter
+	sw *streamWriter
+	wb *bufio.Writer
+	xw *xdr.Writer
 
-	writer io.WriteCloser
-	cw     *countingWriter
-	wb     *bufio.Writer
-	xw     *xdr.Writer
+	versions []int // the protocol versions we support, highest first
+
+	localComp  int             // compression level requested by us
+	remoteComp int             // compression level requested by the peer
+	version    int             // negotiated protocol version
+	features   map[string]bool // negotiated features, nil until the peer's cluster config is received
+	negMut     sync.Mutex      // protects the above
 
 	awaiting    []chan asyncResult
 	awaitingMut sync.Mutex
 
+	incoming    map[int]chan struct{} // msgID -> cancel channel for requests being processed
+	incomingMut sync.Mutex
+
 	idxSent map[string]map[string]uint64
 	idxMut  sync.Mutex // ensures serialization of Index calls
 
+	indexes *indexQueue // received index messages, in order
+
+	stats *connStats
+
+	pingIdle   time.Duration // ping after this long without traffic
+	pingWait   time.Duration // close if the pong takes longer than this
+	cancelWait time.Duration // close if the response to a canceled request takes longer than this
+
 	nextID chan int
-	outbox chan []encodable
+	outbox [numLanes]chan []encodable
 	closed chan struct{}
 	once   sync.Once
 }
@@ -105,46 +183,68 @@ type asyncResult struct {
 }
 
 const (
-	pingTimeout  = 30 * time.Second
-	pingIdleTime = 60 * time.Second
+	pingTimeout   = 30 * time.Second
+	pingIdleTime  = 60 * time.Second
+	cancelTimeout = 5 * time.Minute
+)
+
+var (
+	errIDTaken            = errors.New("message ID in use")
+	errCanceledUnanswered = errors.New("no response to canceled request")
 )
 
 func NewConnection(nodeID NodeID, reader io.Reader, writer io.Writer, receiver Model) Connection {
+	c := newRawConnection(nodeID, reader, writer, receiver)
+	c.start()
+	return wireFormatConnection{c}
+}
+
+func newRawConnection(nodeID NodeID, reader io.Reader, writer io.Writer, receiver Model) *rawConnection {
 	cr := &countingReader{Reader: reader}
 	cw := &countingWriter{Writer: writer}
 
-	flrd := flate.NewReader(cr)
-	flwr, err := flate.NewWriter(cw, flate.BestSpeed)
-	if err != nil {
-		panic(err)
-	}
-	wb := bufio.NewWriter(flwr)
-
-	c := rawConnection{
-		id:       nodeID,
-		receiver: nativeModel{receiver},
-		state:    stateInitial,
-		reader:   flrd,
-		cr:       cr,
-		xr:       xdr.NewReader(flrd),
-		writer:   flwr,
-		cw:       cw,
-		wb:       wb,
-		xw:       xdr.NewWriter(wb),
-		awaiting: make([]chan asyncResult, 0x1000),
-		idxSent:  make(map[string]map[string]uint64),
-		outbox:   make(chan []encodable),
-		nextID:   make(chan int),
-		closed:   make(chan struct{}),
+	sr := newStreamReader(cr)
+	sw := newStreamWriter(cw)
+	wb := bufio.NewWriter(sw)
+
+	c := &rawConnection{
+		id:         nodeID,
+		receiver:   nativeModel{receiver},
+		state:      stateInitial,
+		cr:         cr,
+		sr:         sr,
+		xr:         xdr.NewReader(sr),
+		cw:         cw,
+		sw:         sw,
+		wb:         wb,
+		xw:         xdr.NewWriter(wb),
+		versions:   supportedVersions,
+		localComp:  compressionLevel(CompressMetadata),
+		awaiting:   make([]chan asyncResult, 0x1000),
+		incoming:   make(map[int]chan struct{}),
+		idxSent:    make(map[string]map[string]uint64),
+		indexes:    newIndexQueue(maxQueuedIndexCost, overflowIndexCost),
+		stats:      newConnStats(),
+		nextID:     make(chan int),
+		closed:     make(chan struct{}),
+		pingIdle:   pingIdleTime,
+		pingWait:   pingTimeout,
+		cancelWait: cancelTimeout,
+	}
+
+	for i := range c.outbox {
+		c.outbox[i] = make(chan []encodable)
 	}
 
+	return c
+}
+
+func (c *rawConnection) start() {
 	go c.indexSerializerLoop()
 	go c.readerLoop()
 	go c.writerLoop()
 	go c.pingerLoop()
 	go c.idGenerator()
-
-	return wireFormatConnection{&c}
 }
 
 func (c *rawConnection) ID() NodeID {
@@ -179,12 +279,74 @@ func (c *rawConnection) Index(repo string, idx []FileInfo) {
 	}
 
 	if msgType == messageTypeIndex || len(idx) > 0 {
-		c.send(header{0, -1, msgType}, IndexMessage{repo, idx})
+		c.sendIndex(repo, msgType, idx)
+	}
+}
+
+// IndexUpdate writes the list of file information to the connected peer
+// node as an index update, without first sending a full index. Files that
+// have not been sent before and have a local version not higher than
+// maxLocalVersion, the highest local version the peer has announced to
+// already know, are skipped.
+func (c *rawConnection) IndexUpdate(repo string, idx []FileInfo, maxLocalVersion uint64) {
+	c.idxMut.Lock()
+	defer c.idxMut.Unlock()
+
+	first := c.idxSent[repo] == nil
+	if first {
+		c.idxSent[repo] = make(map[string]uint64)
+	}
+
+	var diff []FileInfo
+	for _, f := range idx {
+		vs, ok := c.idxSent[repo][f.Name]
+		if ok && f.Version != vs || !ok && f.LocalVersion > maxLocalVersion {
+			diff = append(diff, f)
+		}
+		c.idxSent[repo][f.Name] = f.Version
+	}
+
+	// The first message for a repository is sent even if empty, since the
+	// peer won't accept requests until it has received one.
+	if first || len(diff) > 0 {
+		c.sendIndex(repo, messageTypeIndexUpdate, diff)
 	}
 }
 
-// Request returns the bytes for the specified block after fetching them from the connected peer.
-func (c *rawConnection) Request(repo string, name string, offset int64, size int) ([]byte, error) {
+// sendIndex sends idx in chunks. A large index is sent as an Index with the
+// first chunk of files followed by Index Updates with the rest.
+func (c *rawConnection) sendIndex(repo string, msgType int, idx []FileInfo) {
+	for _, chunk := range chunkIndex(idx, indexChunkCost) {
+		if !c.send(header{0, -1, msgType}, IndexMessage{repo, chunk}) {
+			return
+		}
+		msgType = messageTypeIndexUpdate
+	}
+}
+
+// chunkIndex splits files into chunks with a cost of at most maxCost each,
+// except that a single file above the limit gets a chunk of its own. At
+// least one (possibly empty) chunk is always returned.
+func chunkIndex(files []FileInfo, maxCost int) [][]FileInfo {
+	var chunks [][]FileInfo
+	start, cost := 0, 0
+	for i, f := range files {
+		fc := 1 + len(f.Blocks)
+		if i > start && cost+fc > maxCost {
+			chunks = append(chunks, files[start:i])
+			start, cost = i, 0
+		}
+		cost += fc
+	}
+	return append(chunks, files[start:])
+}
+
+// Request returns the bytes for the specified block after fetching them from
+// the connected peer. The hash is the expected hash of the block, which the
+// peer verifies before responding; it isn't sent to version 0 peers. If the
+// cancel channel is closed before the response has arrived, the peer is
+// asked to cancel the request and ErrCanceled is returned.
+func (c *rawConnection) Request(repo string, name string, offset int64, size int, hash []byte, cancel <-chan struct{}) ([]byte, error) {
 	var id int
 	select {
 	case id = <-c.nextID:
@@ -192,29 +354,74 @@ func (c *rawConnection) Request(repo string, name string, offset int64, size int
 		return nil, ErrClosed
 	}
 
-	c.awaitingMut.Lock()
-	if ch := c.awaiting[id]; ch != nil {
-		panic("id taken")
-	}
 	rc := make(chan asyncResult, 1)
-	c.awaiting[id] = rc
-	c.awaitingMut.Unlock()
+	if !c.reserveID(id, rc) {
+		return nil, errIDTaken
+	}
 
 	ok := c.send(header{0, id, messageTypeRequest},
-		RequestMessage{repo, name, uint64(offset), uint32(size)})
+		RequestMessage{repo, name, uint64(offset), uint32(size), hash})
 	if !ok {
 		return nil, ErrClosed
 	}
+	t0 := c.stats.requestStarted()
 
-	res, ok := <-rc
-	if !ok {
-		return nil, ErrClosed
+	select {
+	case res, ok := <-rc:
+		c.stats.requestDone(t0, ok)
+		if !ok {
+			return nil, ErrClosed
+		}
+		return res.val, res.err
+
+	case <-cancel:
+		c.stats.requestDone(t0, false)
+		// The message ID stays reserved until the (possibly empty)
+		// response arrives, since the peer may already have sent it.
+		if c.HasFeature(FeatureCancel) {
+			c.send(header{0, id, messageTypeCancel})
+		}
+		go c.awaitCanceled(rc)
+		return nil, ErrCanceled
 	}
-	return res.val, res.err
 }
 
-// ClusterConfig send the cluster configuration message to the peer and returns any error
+// reserveID registers rc to receive the response or pong for the message
+// with the given ID. It returns false if the ID is already reserved.
+func (c *rawConnection) reserveID(id int, rc chan asyncResult) bool {
+	c.awaitingMut.Lock()
+	defer c.awaitingMut.Unlock()
+	if c.awaiting[id] != nil {
+		return false
+	}
+	c.awaiting[id] = rc
+	c.indexes.allowOverflow()
+	return true
+}
+
+// awaitCanceled closes the connection unless the response to a canceled
+// request arrives within cancelWait. A peer that never responds would
+// otherwise keep the message ID reserved for good.
+func (c *rawConnection) awaitCanceled(rc chan asyncResult) {
+	t := time.NewTimer(c.cancelWait)
+	defer t.Stop()
+	select {
+	case <-rc:
+	case <-t.C:
+		c.close(errCanceledUnanswered)
+	case <-c.closed:
+	}
+}
+
+// ClusterConfig send the cluster configuration message to the peer and returns any error.
+// The supported protocol versions and features are added to the options.
 func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
+	c.negMut.Lock()
+	c.localComp = compressionLevel(clusterConfigCompression(config))
+	c.negMut.Unlock()
+
+	config.Options = append(append([]Option(nil), config.Options...), capabilityOptions(c.versions)...)
+
 	c.send(header{0, -1, messageTypeClusterConfig}, config)
 }
 
@@ -227,17 +434,22 @@ func (c *rawConnection) ping() bool {
 	}
 
 	rc := make(chan asyncResult, 1)
-	c.awaitingMut.Lock()
-	c.awaiting[id] = rc
-	c.awaitingMut.Unlock()
+	if !c.reserveID(id, rc) {
+		return false
+	}
 
+	t0 := time.Now()
 	ok := c.send(header{0, id, messageTypePing})
 	if !ok {
 		return false
 	}
 
 	res, ok := <-rc
-	return ok && res.err == nil
+	if ok && res.err == nil {
+		c.stats.ping(time.Since(t0))
+		return true
+	}
+	return false
 }
 
 func (c *rawConnection) readerLoop() (err error) {
@@ -252,46 +464,69 @@ func (c *rawConnection) readerLoop() (err error) {
 		default:
 		}
 
-		var hdr header
-		hdr.decodeXDR(c.xr)
+		t0 := c.xr.Tot()
+		u := c.xr.ReadUint32()
 		if err := c.xr.Error(); err != nil {
 			return err
 		}
-		if hdr.version != 0 {
+		hdr := decodeHeader(u)
+		if hdr.version != c.receiveVersion() {
 			return fmt.Errorf("protocol error: %s: unknown message version %#x", c.id, hdr.version)
 		}
 
+		// The message body is read from xr, which is a separate reader
+		// over the decompressed data for compressed messages.
+		xr := c.xr
+		if hdr.version > 0 && u&flagCompressed != 0 {
+			var err error
+			if xr, err = c.decompressedReader(); err != nil {
+				return err
+			}
+		}
+
 		switch hdr.msgType {
 		case messageTypeIndex:
 			if c.state < stateCCRcvd {
 				return fmt.Errorf("protocol error: index message in state %d", c.state)
 			}
-			if err := c.handleIndex(); err != nil {
+			if err := c.handleIndex(xr, hdr); err != nil {
 				return err
 			}
 			c.state = stateIdxRcvd
 
 		case messageTypeIndexUpdate:
-			if c.state < stateIdxRcvd {
+			// An index update may be sent in place of the initial index
+			// when we have announced a max version for the peer.
+			if c.state < stateCCRcvd {
 				return fmt.Errorf("protocol error: index update message in state %d", c.state)
 			}
-			if err := c.handleIndexUpdate(); err != nil {
+			if err := c.handleIndexUpdate(xr, hdr); err != nil {
 				return err
 			}
+			c.state = stateIdxRcvd
 
 		case messageTypeRequest:
 			if c.state < stateIdxRcvd {
 				return fmt.Errorf("protocol error: request message in state %d", c.state)
 			}
-			if err := c.handleRequest(hdr); err != nil {
+			if err := c.handleRequest(xr, hdr); err != nil {
 				return err
 			}
 
+		case messageTypeCancel:
+			if c.state < stateIdxRcvd {
+				return fmt.Errorf("protocol error: cancel message in state %d", c.state)
+			}
+			if !c.HasFeature(FeatureCancel) {
+				return fmt.Errorf("protocol error: %s: cancel message without the cancel feature", c.id)
+			}
+			c.handleCancel(hdr)
+
 		case messageTypeResponse:
 			if c.state < stateIdxRcvd {
 				return fmt.Errorf("protocol error: response message in state %d", c.state)
 			}
-			if err := c.handleResponse(hdr); err != nil {
+			if err := c.handleResponse(xr, hdr); err != nil {
 				return err
 			}
 
@@ -305,7 +540,7 @@ func (c *rawConnection) readerLoop() (err error) {
 			if c.state != stateInitial {
 				return fmt.Errorf("protocol error: cluster config message in state %d", c.state)
 			}
-			if err := c.handleClusterConfig(); err != nil {
+			if err := c.handleClusterConfig(xr); err != nil {
 				return err
 			}
 			c.state = stateCCRcvd
@@ -313,91 +548,112 @@ func (c *rawConnection) readerLoop() (err error) {
 		default:
 			return fmt.Errorf("protocol error: %s: unknown message type %#x", c.id, hdr.msgType)
 		}
-	}
-}
 
-type incomingIndex struct {
-	update bool
-	id     NodeID
-	repo   string
-	files  []FileInfo
+		c.stats.received(hdr.msgType, c.xr.Tot()-t0)
+	}
 }
 
-var incomingIndexes = make(chan incomingIndex, 100) // should be enough for anyone, right?
-
 func (c *rawConnection) indexSerializerLoop() {
 	// We must avoid blocking the reader loop when processing large indexes.
 	// There is otherwise a potential deadlock where both sides has the model
 	// locked because it's sending a large index update and can't receive the
 	// large index update from the other side. But we must also ensure to
 	// process the indexes in the order they are received, hence the separate
-	// routine and buffered channel.
+	// routine and the per connection queue. The queue is bounded, so a
+	// receiver that falls far behind eventually stops the reader, except
+	// while we wait for responses that are behind the index messages.
 	for {
-		select {
-		case ii := <-incomingIndexes:
-			if ii.update {
-				c.receiver.IndexUpdate(ii.id, ii.repo, ii.files)
-			} else {
-				c.receiver.Index(ii.id, ii.repo, ii.files)
-			}
-		case <-c.closed:
+		ii, ok := c.indexes.get()
+		if !ok {
 			return
 		}
+		if ii.update {
+			c.receiver.IndexUpdate(ii.id, ii.repo, ii.files)
+		} else {
+			c.receiver.Index(ii.id, ii.repo, ii.files)
+		}
 	}
 }
 
-func (c *rawConnection) handleIndex() error {
-	var im IndexMessage
-	im.decodeXDR(c.xr)
-	if err := c.xr.Error(); err != nil {
-		return err
-	} else {
-
-		// We run this (and the corresponding one for update, below)
-		// in a separate goroutine to avoid blocking the read loop.
-		// There is otherwise a potential deadlock where both sides
-		// has the model locked because it's sending a large index
-		// update and can't receive the large index update from the
-		// other side.
+func (c *rawConnection) handleIndex(xr *xdr.Reader, hdr header) error {
+	return c.queueIndex(xr, hdr, false)
+}
 
-		incomingIndexes <- incomingIndex{false, c.id, im.Repository, im.Files}
-	}
-	return nil
+func (c *rawConnection) handleIndexUpdate(xr *xdr.Reader, hdr header) error {
+	return c.queueIndex(xr, hdr, true)
 }
 
-func (c *rawConnection) handleIndexUpdate() error {
+func (c *rawConnection) queueIndex(xr *xdr.Reader, hdr header, update bool) error {
 	var im IndexMessage
-	im.decodeXDR(c.xr)
-	if err := c.xr.Error(); err != nil {
+	if hdr.version == 0 {
+		var v0 indexMessageV0
+		if err := v0.decodeXDR(xr); err != nil {
+			return err
+		}
+		im = indexFromV0(v0)
+	} else if err := im.decodeXDR(xr); err != nil {
 		return err
-	} else {
-		incomingIndexes <- incomingIndex{true, c.id, im.Repository, im.Files}
+	}
+	if !c.indexes.put(incomingIndex{update, c.id, im.Repository, im.Files}) {
+		return ErrClosed
 	}
 	return nil
 }
 
-func (c *rawConnection) handleRequest(hdr header) error {
+func (c *rawConnection) handleRequest(xr *xdr.Reader, hdr header) error {
 	var req RequestMessage
-	req.decodeXDR(c.xr)
-	if err := c.xr.Error(); err != nil {
+	if hdr.version == 0 {
+		var v0 requestMessageV0
+		if err := v0.decodeXDR(xr); err != nil {
+			return err
+		}
+		req = RequestMessage{v0.Repository, v0.Name, v0.Offset, v0.Size, nil}
+	} else if err := req.decodeXDR(xr); err != nil {
 		return err
 	}
-	go c.processRequest(hdr.msgID, req)
+	cancel := make(chan struct{})
+	c.incomingMut.Lock()
+	c.incoming[hdr.msgID] = cancel
+	c.incomingMut.Unlock()
+
+	go c.processRequest(hdr.msgID, req, cancel)
 	return nil
 }
 
-func (c *rawConnection) handleResponse(hdr header) error {
-	data := c.xr.ReadBytesMax(256 * 1024) // Sufficiently larger than max expected block size
+func (c *rawConnection) handleCancel(hdr header) {
+	c.incomingMut.Lock()
+	if cancel, ok := c.incoming[hdr.msgID]; ok {
+		close(cancel)
+		delete(c.incoming, hdr.msgID)
+	}
+	c.incomingMut.Unlock()
+}
 
-	if err := c.xr.Error(); err != nil {
+func (c *rawConnection) handleResponse(xr *xdr.Reader, hdr header) error {
+	var resp ResponseMessage
+	if hdr.version == 0 {
+		var v0 responseMessageV0
+		if err := v0.decodeXDR(xr); err != nil {
+			return err
+		}
+		resp.Data = v0.Data
+	} else if err := resp.decodeXDR(xr); err != nil {
 		return err
 	}
 
+	var res asyncResult
+	if resp.Error != 0 {
+		res.err = ErrorCode(resp.Error)
+	} else {
+		res.val = resp.Data
+	}
+
 	c.awaitingMut.Lock()
 	if rc := c.awaiting[hdr.msgID]; rc != nil {
 		c.awaiting[hdr.msgID] = nil
-		rc <- asyncResult{data, nil}
+		rc <- res
 		close(rc)
+		c.indexes.endOverflow()
 	}
 	c.awaitingMut.Unlock()
 
@@ -410,28 +666,100 @@ func (c *rawConnection) handlePong(hdr header) {
 		c.awaiting[hdr.msgID] = nil
 		rc <- asyncResult{}
 		close(rc)
+		c.indexes.endOverflow()
 	}
 	c.awaitingMut.Unlock()
 }
 
-func (c *rawConnection) handleClusterConfig() error {
+func (c *rawConnection) handleClusterConfig(xr *xdr.Reader) error {
 	var cm ClusterConfigMessage
-	cm.decodeXDR(c.xr)
-	if err := c.xr.Error(); err != nil {
+	if err := cm.decodeXDR(xr); err != nil {
 		return err
 	} else {
+		version, features, err := negotiate(cm, c.versions)
+		if err != nil {
+			return err
+		}
+		if debug {
+			l.Debugf("%s: negotiated version %d, features %v", c.id, version, features)
+		}
+
+		c.negMut.Lock()
+		c.remoteComp = compressionLevel(clusterConfigCompression(cm))
+		c.version = version
+		c.features = features
+		c.negMut.Unlock()
+
+		// The peer ends the compressed stream after its cluster config
+		// when a later version than 0 is used.
+		c.sr.mayEnd = version > 0
+
 		go c.receiver.ClusterConfig(c.id, cm)
 	}
 	return nil
 }
 
-type encodable interface {
-	encodeXDR(*xdr.Writer) (int, error)
+// decompressedReader reads a compressed message body and returns a reader
+// for the decompressed data.
+func (c *rawConnection) decompressedReader() (*xdr.Reader, error) {
+	data := c.xr.ReadBytesMax(maxDecompressedSize)
+	if err := c.xr.Error(); err != nil {
+		return nil, err
+	}
+	bs, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	return xdr.NewReader(bytes.NewReader(bs)), nil
 }
-type encodableBytes []byte
 
-func (e encodableBytes) encodeXDR(xw *xdr.Writer) (int, error) {
-	return xw.WriteBytes(e)
+// HasFeature returns true if the feature has been negotiated with the peer.
+func (c *rawConnection) HasFeature(feature string) bool {
+	c.negMut.Lock()
+	defer c.negMut.Unlock()
+	return c.features[feature]
+}
+
+func (c *rawConnection) negotiatedVersion() int {
+	c.negMut.Lock()
+	defer c.negMut.Unlock()
+	return c.version
+}
+
+// receiveVersion returns the version of the messages received from the
+// peer: 0 in the compressed stream the connection starts with, and the
+// negotiated version after it.
+func (c *rawConnection) receiveVersion() int {
+	if c.sr.compressed() {
+		return 0
+	}
+	return c.negotiatedVersion()
+}
+
+// sendVersion is the counterpart of receiveVersion for sent messages.
+func (c *rawConnection) sendVersion() int {
+	if c.sw.compressed() {
+		return 0
+	}
+	return c.negotiatedVersion()
+}
+
+// compressionLevel returns the compression level to use for outgoing
+// messages. Nothing is compressed until we know what the peer wants.
+func (c *rawConnection) compressionLevel() int {
+	c.negMut.Lock()
+	defer c.negMut.Unlock()
+	if !c.features[FeatureCompression] {
+		return 0
+	}
+	if c.remoteComp < c.localComp {
+		return c.remoteComp
+	}
+	return c.localComp
+}
+
+type encodable interface {
+	encodeXDR(*xdr.Writer) (int, error)
 }
 
 func (c *rawConnection) send(h header, es ...encodable) bool {
@@ -446,34 +774,169 @@ func (c *rawConnection) send(h header, es ...encodable) bool {
 	msg := append([]encodable{h}, es...)
 
 	select {
-	case c.outbox <- msg:
+	case c.outbox[messageLane(h.msgType)] <- msg:
 		return true
 	case <-c.closed:
 		return false
 	}
 }
 
+func messageLane(msgType int) int {
+	switch msgType {
+	case messageTypeIndex, messageTypeIndexUpdate:
+		return laneIndex
+	case messageTypeRequest, messageTypeResponse, messageTypeCancel:
+		return laneRequest
+	default:
+		return laneControl
+	}
+}
+
+// nextMessage returns the next message to send, taken from the highest
+// priority lane that has one waiting. It returns nil when the connection
+// is closed.
+func (c *rawConnection) nextMessage() []encodable {
+	select {
+	case es := <-c.outbox[laneControl]:
+		return es
+	default:
+	}
+
+	select {
+	case es := <-c.outbox[laneControl]:
+		return es
+	case es := <-c.outbox[laneRequest]:
+		return es
+	default:
+	}
+
+	select {
+	case es := <-c.outbox[laneControl]:
+		return es
+	case es := <-c.outbox[laneRequest]:
+		return es
+	case es := <-c.outbox[laneIndex]:
+		return es
+	case <-c.closed:
+		return nil
+	}
+}
+
 func (c *rawConnection) writerLoop() {
 	var err error
+	var ccSent bool
 	for {
-		select {
-		case es := <-c.outbox:
-			for _, e := range es {
-				e.encodeXDR(c.xw)
-			}
+		es := c.nextMessage()
+		if es == nil {
+			return
+		}
 
-			if err = c.flush(); err != nil {
+		if ccSent && c.sw.compressed() && c.negotiatedVersion() > 0 {
+			// Both cluster configs have been sent, so both sides know
+			// the version to use after the compressed stream.
+			if err = c.sw.end(); err != nil {
 				c.close(err)
 				return
 			}
-		case <-c.closed:
+		}
+
+		msgType := es[0].(header).msgType
+		t0 := c.xw.Tot()
+		c.writeMessage(es)
+		c.stats.sent(msgType, c.xw.Tot()-t0)
+		if msgType == messageTypeClusterConfig {
+			ccSent = true
+		}
+
+		if err = c.flush(); err != nil {
+			c.close(err)
 			return
 		}
 	}
 }
 
-type flusher interface {
-	Flush() error
+// writeMessage writes the header and the message body, if any. After the
+// compressed stream, the body is compressed when the negotiated compression
+// level says so, unless it is small or doesn't compress well.
+func (c *rawConnection) writeMessage(es []encodable) {
+	hdr := es[0].(header)
+	hdr.version = c.sendVersion()
+	es[0] = hdr
+	if len(es) > 1 {
+		es[1] = messageForVersion(hdr.version, es[1])
+	}
+	if hdr.version > 0 && len(es) > 1 && shouldCompress(c.compressionLevel(), hdr.msgType) {
+		var buf bytes.Buffer
+		es[1].encodeXDR(xdr.NewWriter(&buf))
+		if buf.Len() >= minCompressSize && buf.Len() <= maxDecompressedSize {
+			if data := compress(buf.Bytes()); data != nil {
+				c.xw.WriteUint32(encodeHeader(hdr) | flagCompressed)
+				c.xw.WriteBytes(data)
+				return
+			}
+		}
+	}
+
+	for _, e := range es {
+		e.encodeXDR(c.xw)
+	}
+}
+
+// messageForVersion returns the message body to send in a message of the
+// given version, since version 0 uses the original message formats.
+func messageForVersion(version int, e encodable) encodable {
+	if version > 0 {
+		return e
+	}
+	switch m := e.(type) {
+	case IndexMessage:
+		return indexToV0(m)
+	case RequestMessage:
+		return requestMessageV0{m.Repository, m.Name, m.Offset, m.Size}
+	case ResponseMessage:
+		if m.Error != 0 {
+			return responseMessageV0{}
+		}
+		return responseMessageV0{m.Data}
+	}
+	return e
+}
+
+// indexToV0 returns the version 0 form of the index message, without the
+// local versions.
+func indexToV0(m IndexMessage) indexMessageV0 {
+	v0 := indexMessageV0{m.Repository, make([]fileInfoV0, len(m.Files))}
+	for i, f := range m.Files {
+		v0.Files[i] = fileInfoV0{f.Name, f.Flags, f.Modified, f.Version, f.Blocks}
+	}
+	return v0
+}
+
+// indexFromV0 returns the index message in a version 0 message, with zero
+// local versions.
+func indexFromV0(v0 indexMessageV0) IndexMessage {
+	m := IndexMessage{v0.Repository, make([]FileInfo, len(v0.Files))}
+	for i, f := range v0.Files {
+		m.Files[i] = FileInfo{Name: f.Name, Flags: f.Flags, Modified: f.Modified, Version: f.Version, Blocks: f.Blocks}
+	}
+	return m
+}
+
+// EncodeXDRV0 writes the index message in the version 0 format, which has
+// no local versions. It's the format of the legacy index files.
+func (m IndexMessage) EncodeXDRV0(w io.Writer) (int, error) {
+	return indexToV0(m).EncodeXDR(w)
+}
+
+// DecodeXDRV0 reads an index message in the version 0 format, which has no
+// local versions. It's the format of the legacy index files.
+func (m *IndexMessage) DecodeXDRV0(r io.Reader) error {
+	var v0 indexMessageV0
+	if err := v0.DecodeXDR(r); err != nil {
+		return err
+	}
+	*m = indexFromV0(v0)
+	return nil
 }
 
 func (c *rawConnection) flush() error {
@@ -485,16 +948,13 @@ func (c *rawConnection) flush() error {
 		return err
 	}
 
-	if f, ok := c.writer.(flusher); ok {
-		return f.Flush()
-	}
-
-	return nil
+	return c.sw.Flush()
 }
 
 func (c *rawConnection) close(err error) {
 	c.once.Do(func() {
 		close(c.closed)
+		c.indexes.close()
 
 		c.awaitingMut.Lock()
 		for i, ch := range c.awaiting {
@@ -509,10 +969,30 @@ func (c *rawConnection) close(err error) {
 	})
 }
 
+// idGenerator hands out message IDs in order, skipping those still reserved
+// for the response to an earlier request or ping. When all IDs are
+// reserved it waits a while before trying again.
 func (c *rawConnection) idGenerator() {
 	nextID := 0
+	skipped := 0
 	for {
 		nextID = (nextID + 1) & 0xfff
+		c.awaitingMut.Lock()
+		taken := c.awaiting[nextID] != nil
+		c.awaitingMut.Unlock()
+		if taken {
+			if skipped++; skipped == len(c.awaiting) {
+				skipped = 0
+				select {
+				case <-time.After(100 * time.Millisecond):
+				case <-c.closed:
+					return
+				}
+			}
+			continue
+		}
+		skipped = 0
+
 		select {
 		case c.nextID <- nextID:
 		case <-c.closed:
@@ -523,17 +1003,17 @@ func (c *rawConnection) idGenerator() {
 
 func (c *rawConnection) pingerLoop() {
 	var rc = make(chan bool, 1)
-	ticker := time.Tick(pingIdleTime / 2)
+	ticker := time.Tick(c.pingIdle / 2)
 	for {
 		select {
 		case <-ticker:
-			if d := time.Since(c.xr.LastRead()); d < pingIdleTime {
+			if d := time.Since(c.xr.LastRead()); d < c.pingIdle {
 				if debug {
 					l.Debugln(c.id, "ping skipped after rd", d)
 				}
 				continue
 			}
-			if d := time.Since(c.xw.LastWrite()); d < pingIdleTime {
+			if d := time.Since(c.xw.LastWrite()); d < c.pingIdle {
 				if debug {
 					l.Debugln(c.id, "ping skipped after wr", d)
 				}
@@ -553,7 +1033,7 @@ func (c *rawConnection) pingerLoop() {
 				if !ok {
 					c.close(fmt.Errorf("ping failure"))
 				}
-			case <-time.After(pingTimeout):
+			case <-time.After(c.pingWait):
 				c.close(fmt.Errorf("ping timeout"))
 			case <-c.closed:
 				return
@@ -565,24 +1045,65 @@ func (c *rawConnection) pingerLoop() {
 	}
 }
 
-func (c *rawConnection) processRequest(msgID int, req RequestMessage) {
-	data, _ := c.receiver.Request(c.id, req.Repository, req.Name, int64(req.Offset), int(req.Size))
+func (c *rawConnection) processRequest(msgID int, req RequestMessage, cancel chan struct{}) {
+	defer func() {
+		c.incomingMut.Lock()
+		if c.incoming[msgID] == cancel {
+			delete(c.incoming, msgID)
+		}
+		c.incomingMut.Unlock()
+	}()
 
-	c.send(header{0, msgID, messageTypeResponse}, encodableBytes(data))
+	var resp ResponseMessage
+	select {
+	case <-cancel:
+		// The request was canceled before we got around to it. We still
+		// send a response, so that the peer can reuse the message ID.
+		resp.Error = uint32(ErrCanceled)
+		c.send(header{0, msgID, messageTypeResponse}, resp)
+		return
+	default:
+	}
+
+	data, err := c.receiver.Request(c.id, req.Repository, req.Name, int64(req.Offset), int(req.Size), req.Hash)
+	if err == nil {
+		resp.Data = data
+	} else if code, ok := err.(ErrorCode); ok {
+		resp.Error = uint32(code)
+	} else {
+		resp.Error = uint32(ErrGeneric)
+	}
+
+	select {
+	case <-cancel:
+		resp.Data = nil
+		resp.Error = uint32(ErrCanceled)
+	default:
+	}
+
+	c.send(header{0, msgID, messageTypeResponse}, resp)
 }
 
 type Statistics struct {
 	At            time.Time
 	InBytesTotal  uint64
 	OutBytesTotal uint64
+
+	InMessages          map[string]MessageStatistics // message type -> statistics
+	OutMessages         map[string]MessageStatistics // message type -> statistics
+	PingRTT             time.Duration                // round trip time of the latest ping, zero if none yet
+	OutstandingRequests int                          // requests sent and not yet responded to
+	AvgResponseLatency  time.Duration                // average time from request to response
 }
 
 func (c *rawConnection) Statistics() Statistics {
-	return Statistics{
+	st := Statistics{
 		At:            time.Now(),
 		InBytesTotal:  c.cr.Tot(),
 		OutBytesTotal: c.cw.Tot(),
 	}
+	c.stats.fill(&st)
+	return st
 }
 
 func IsDeleted(bits uint32) bool {
@@ -600,3 +1121,18 @@ func IsDirectory(bits uint32) bool {
 func HasPermissionBits(bits uint32) bool {
 	return bits&FlagNoPermBits == 0
 }
+
+// BlockSizeBits returns the flag bits recording the given block size, which
+// should be BlockSize times a power of two. Other sizes are rounded up.
+func BlockSizeBits(size int) uint32 {
+	var exp uint32
+	for exp < FlagBlockSizeBits>>flagBlockSizeShift && BlockSize<<exp < size {
+		exp++
+	}
+	return exp << flagBlockSizeShift
+}
+
+// BlockSizeFromBits returns the block size recorded in the flag bits.
+func BlockSizeFromBits(bits uint32) int {
+	return BlockSize << ((bits & FlagBlockSizeBits) >> flagBlockSizeShift)
+}
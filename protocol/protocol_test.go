@@ -5,10 +5,15 @@
 package protocol
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
 	"testing"
 	"testing/quick"
+	"time"
 )
 
 var (
@@ -55,12 +60,32 @@ func TestHeaderLayout(t *testing.T) {
 	}
 }
 
+func TestBlockSizeBits(t *testing.T) {
+	var tests = []struct {
+		size int
+		bits uint32
+	}{
+		{BlockSize, 0},
+		{2 * BlockSize, 0x00100000},
+		{MaxBlockSize, 0x00700000},
+	}
+	for i, tc := range tests {
+		if bits := BlockSizeBits(tc.size); bits != tc.bits {
+			t.Errorf("Incorrect bits %08x != %08x for case #%d", bits, tc.bits, i)
+		}
+		flags := tc.bits | FlagDeleted | 0644
+		if size := BlockSizeFromBits(flags); size != tc.size {
+			t.Errorf("Incorrect block size %d != %d for case #%d", size, tc.size, i)
+		}
+	}
+}
+
 func TestPing(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, nil).(wireFormatConnection).next.(*rawConnection)
-	c1 := NewConnection(c1ID, br, aw, nil).(wireFormatConnection).next.(*rawConnection)
+	c0 := NewConnection(c0ID, ar, bw, newTestModel()).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection(c1ID, br, aw, newTestModel()).(wireFormatConnection).next.(*rawConnection)
 
 	if ok := c0.ping(); !ok {
 		t.Error("c0 ping failed")
@@ -114,7 +139,7 @@ func TestPingErr(t *testing.T) {
 // 			NewConnection(c0ID, ar, ebw, m0, nil)
 // 			c1 := NewConnection(c1ID, br, eaw, m1, nil).(wireFormatConnection).next.(*rawConnection)
 
-// 			d, err := c1.Request("default", "tn", 1234, 5678)
+// 			d, err := c1.Request("default", "tn", 1234, 5678, nil, nil)
 // 			if err == e || err == ErrClosed {
 // 				t.Logf("Error at %d+%d bytes", i, j)
 // 				if !m1.isClosed() {
@@ -222,7 +247,426 @@ func TestClose(t *testing.T) {
 	c0.Index("default", nil)
 	c0.Index("default", nil)
 
-	if _, err := c0.Request("default", "foo", 0, 0); err == nil {
+	if _, err := c0.Request("default", "foo", 0, 0, nil, nil); err == nil {
 		t.Error("Request should return an error")
 	}
 }
+
+func TestRequestErrorCode(t *testing.T) {
+	m0 := newTestModel()
+	m0.err = ErrNoSuchFile
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0)
+	c1 := NewConnection(c1ID, br, aw, m1)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	d, err := c1.Request("default", "foo", 0, 128, nil, nil)
+	if err != ErrNoSuchFile {
+		t.Errorf("Incorrect error %v", err)
+	}
+	if d != nil {
+		t.Errorf("Unexpected data %q", d)
+	}
+
+	m0.err = errors.New("some other error")
+	_, err = c1.Request("default", "foo", 0, 128, nil, nil)
+	if err != ErrGeneric {
+		t.Errorf("Incorrect error %v", err)
+	}
+
+	m0.err = nil
+	m0.data = []byte("response data")
+	d, err = c1.Request("default", "foo", 0, 128, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d) != "response data" {
+		t.Errorf("Incorrect response data %q", d)
+	}
+}
+
+func TestRequestCancel(t *testing.T) {
+	m0 := newTestModel()
+	m0.block = make(chan struct{})
+	m0.data = []byte("response data")
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0)
+	c1 := NewConnection(c1ID, br, aw, m1)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(cancel)
+	}()
+
+	d, err := c1.Request("default", "foo", 0, 128, nil, cancel)
+	if err != ErrCanceled {
+		t.Errorf("Incorrect error %v", err)
+	}
+	if d != nil {
+		t.Errorf("Unexpected data %q", d)
+	}
+
+	// The connection must still be usable after the cancelled request
+	// has been answered.
+	close(m0.block)
+	d, err = c1.Request("default", "foo", 0, 128, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d) != "response data" {
+		t.Errorf("Incorrect response data %q", d)
+	}
+}
+
+func TestIDGeneratorSkipsReserved(t *testing.T) {
+	c := newRawConnection(c0ID, &bytes.Buffer{}, &bytes.Buffer{}, newTestModel())
+	defer c.close(nil)
+	go c.idGenerator()
+
+	if !c.reserveID(5, make(chan asyncResult, 1)) {
+		t.Fatal("Unexpected taken ID")
+	}
+	if c.reserveID(5, make(chan asyncResult, 1)) {
+		t.Error("Reserved ID reserved again")
+	}
+
+	for i := 0; i < 2*len(c.awaiting); i++ {
+		if id := <-c.nextID; id == 5 {
+			t.Fatal("Reserved ID handed out")
+		}
+	}
+}
+
+func TestCanceledRequestUnanswered(t *testing.T) {
+	m1 := newTestModel()
+
+	// A peer that reads our messages but never responds.
+	ar, aw := io.Pipe()
+	br, _ := io.Pipe()
+	go io.Copy(ioutil.Discard, ar)
+
+	c1 := NewConnection(c1ID, br, aw, m1)
+	rawConn(c1).cancelWait = 100 * time.Millisecond
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, err := c1.Request("default", "foo", 0, 128, nil, cancel); err != ErrCanceled {
+		t.Errorf("Incorrect error %v", err)
+	}
+
+	// The connection is closed instead of keeping the message ID reserved.
+	if !m1.isClosed() {
+		t.Fatal("Connection not closed")
+	}
+	if m1.closeErr != errCanceledUnanswered {
+		t.Errorf("Incorrect close error %v", m1.closeErr)
+	}
+}
+
+func TestResponseBehindFullIndexQueue(t *testing.T) {
+	m0 := newTestModel()
+	m0.indexBlock = make(chan struct{})
+	defer close(m0.indexBlock)
+	m1 := newTestModel()
+	m1.data = []byte("response data")
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0)
+	c1 := NewConnection(c1ID, br, aw, m1)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+
+	// More index than fits in the queue, while the receiver is stuck on
+	// the first message.
+	go c1.Index("default", make([]FileInfo, maxQueuedIndexCost+2*indexChunkCost))
+	q := rawConn(c0).indexes
+	for t0 := time.Now(); ; time.Sleep(time.Millisecond) {
+		q.mut.Lock()
+		full := q.cost+indexChunkCost > q.maxCost
+		q.mut.Unlock()
+		if full {
+			break
+		}
+		if time.Since(t0) > 10*time.Second {
+			t.Fatal("Index queue not filled")
+		}
+	}
+
+	// Our request is answered anyway.
+	res := make(chan error)
+	go func() {
+		_, err := c0.Request("default", "foo", 0, 128, nil, nil)
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Response not received")
+	}
+}
+
+func TestIndexOrderMultipleConnections(t *testing.T) {
+	const (
+		conns   = 8
+		updates = 50
+	)
+
+	type pair struct {
+		id     NodeID
+		sender Connection
+		model  *TestModel
+	}
+
+	var pairs []pair
+	for i := 0; i < conns; i++ {
+		id := NewNodeID([]byte{byte(10 + i)})
+		m0 := newTestModel()
+		m1 := newTestModel()
+
+		ar, aw := io.Pipe()
+		br, bw := io.Pipe()
+
+		c0 := NewConnection(id, ar, bw, m0)
+		c1 := NewConnection(c1ID, br, aw, m1)
+
+		c0.ClusterConfig(ClusterConfigMessage{})
+		c1.ClusterConfig(ClusterConfigMessage{})
+
+		pairs = append(pairs, pair{id, c1, m0})
+	}
+
+	// All connections send their index and a series of updates at the
+	// same time; each model must see exactly its own peer's messages, in
+	// the order they were sent.
+	var wg sync.WaitGroup
+	for _, p := range pairs {
+		wg.Add(1)
+		go func(c Connection) {
+			defer wg.Done()
+			for v := 0; v <= updates; v++ {
+				c.Index("default", []FileInfo{{Name: "file", Version: uint64(v)}})
+			}
+		}(p.sender)
+	}
+	wg.Wait()
+
+	for _, p := range pairs {
+		var calls []indexCall
+		for t0 := time.Now(); time.Since(t0) < 5*time.Second; {
+			calls = p.model.indexCalls()
+			if len(calls) == updates+1 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(calls) != updates+1 {
+			t.Fatalf("Node %s: got %d index calls, expected %d", p.id, len(calls), updates+1)
+		}
+		for v, call := range calls {
+			if call.nodeID != p.id {
+				t.Errorf("Node %s received index from %s", p.id, call.nodeID)
+			}
+			if call.update != (v > 0) {
+				t.Errorf("Node %s call %d: incorrect update flag %v", p.id, v, call.update)
+			}
+			if len(call.files) != 1 || call.files[0].Version != uint64(v) {
+				t.Errorf("Node %s call %d: out of order index %v", p.id, v, call.files)
+			}
+		}
+	}
+}
+
+func TestChunkIndex(t *testing.T) {
+	files := []FileInfo{
+		{Name: "a", Blocks: make([]BlockInfo, 3)},
+		{Name: "b", Blocks: make([]BlockInfo, 3)},
+		{Name: "c", Blocks: make([]BlockInfo, 12)},
+		{Name: "d"},
+		{Name: "e"},
+	}
+
+	chunks := chunkIndex(files, 10)
+	var names []string
+	for _, chunk := range chunks {
+		var s string
+		for _, f := range chunk {
+			s += f.Name
+		}
+		names = append(names, s)
+	}
+	if fmt.Sprint(names) != "[ab c de]" {
+		t.Errorf("Incorrect chunks %v", names)
+	}
+
+	if chunks := chunkIndex(nil, 10); len(chunks) != 1 || len(chunks[0]) != 0 {
+		t.Errorf("Empty index should give one empty chunk, not %v", chunks)
+	}
+}
+
+func TestLargeIndexChunked(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0)
+	c1 := NewConnection(c1ID, br, aw, m1)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+
+	files := make([]FileInfo, 3*indexChunkCost)
+	for i := range files {
+		files[i].Name = fmt.Sprint(i)
+	}
+	c1.Index("default", files)
+
+	// Requests must be served while the index is being sent.
+	m1.data = []byte("response data")
+	if _, err := c0.Request("default", "foo", 0, 128, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []indexCall
+	var received int
+	for t0 := time.Now(); time.Since(t0) < 5*time.Second; {
+		calls = m0.indexCalls()
+		received = 0
+		for _, call := range calls {
+			received += len(call.files)
+		}
+		if received == len(files) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received != len(files) {
+		t.Fatalf("Received %d files, expected %d", received, len(files))
+	}
+	if len(calls) != 3 {
+		t.Errorf("Index sent in %d messages, expected 3", len(calls))
+	}
+	for i, call := range calls {
+		if call.update != (i > 0) {
+			t.Errorf("Message %d: incorrect update flag %v", i, call.update)
+		}
+	}
+}
+
+func TestIndexUpdateFirst(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.data = []byte("response data")
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0)
+	c1 := NewConnection(c1ID, br, aw, m1)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+
+	// An index update is accepted in place of the initial index, and only
+	// files with a local version above the announced one are sent, whatever
+	// their version.
+	c0.IndexUpdate("default", []FileInfo{{Name: "a", Version: 10, LocalVersion: 1}, {Name: "b", Version: 5, LocalVersion: 2}}, 1)
+	c1.Index("default", nil)
+
+	if _, err := c0.Request("default", "foo", 0, 128, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files seen in the first call are not sent again unless changed.
+	c0.Index("default", []FileInfo{{Name: "a", Version: 10, LocalVersion: 1}, {Name: "b", Version: 5, LocalVersion: 2}, {Name: "c", Version: 30, LocalVersion: 3}})
+
+	var calls []indexCall
+	for t0 := time.Now(); time.Since(t0) < 5*time.Second; {
+		if calls = m1.indexCalls(); len(calls) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("Got %d index calls, expected 2", len(calls))
+	}
+	for i, name := range []string{"b", "c"} {
+		call := calls[i]
+		if !call.update || len(call.files) != 1 || call.files[0].Name != name || call.files[0].LocalVersion != uint64(i+2) {
+			t.Errorf("Call %d: incorrect index update %+v", i, call)
+		}
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	m0 := newTestModel()
+	m0.data = []byte("response data")
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0)
+	c1 := NewConnection(c1ID, br, aw, m1)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	if !rawConn(c1).ping() {
+		t.Fatal("Ping failed")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c1.Request("default", "foo", 0, 128, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := c1.Statistics()
+	if st.PingRTT <= 0 {
+		t.Errorf("Incorrect ping RTT %v", st.PingRTT)
+	}
+	if st.AvgResponseLatency <= 0 {
+		t.Errorf("Incorrect average response latency %v", st.AvgResponseLatency)
+	}
+	if st.OutstandingRequests != 0 {
+		t.Errorf("Incorrect number of outstanding requests %d", st.OutstandingRequests)
+	}
+	if s := st.OutMessages["request"]; s.Count != 3 || s.Bytes == 0 {
+		t.Errorf("Incorrect request statistics %+v", s)
+	}
+	if s := st.InMessages["response"]; s.Count != 3 || s.Bytes == 0 {
+		t.Errorf("Incorrect response statistics %+v", s)
+	}
+	if s := st.InMessages["pong"]; s.Count != 1 || s.Bytes != 4 {
+		t.Errorf("Incorrect pong statistics %+v", s)
+	}
+}
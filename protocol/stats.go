@@ -0,0 +1,116 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+var messageTypeNames = map[int]string{
+	messageTypeClusterConfig: "clusterConfig",
+	messageTypeIndex:         "index",
+	messageTypeRequest:       "request",
+	messageTypeResponse:      "response",
+	messageTypePing:          "ping",
+	messageTypePong:          "pong",
+	messageTypeIndexUpdate:   "indexUpdate",
+	messageTypeCancel:        "cancel",
+}
+
+// MessageStatistics holds the number of messages of a given type and
+// the number of bytes they used on the wire, including headers.
+type MessageStatistics struct {
+	Count uint64
+	Bytes uint64
+}
+
+// connStats tracks the per connection statistics that are not simply
+// byte counters.
+type connStats struct {
+	in  map[string]MessageStatistics
+	out map[string]MessageStatistics
+
+	pingRTT time.Duration
+
+	outstanding  int
+	responses    uint64
+	totalLatency time.Duration
+
+	mut sync.Mutex
+}
+
+func newConnStats() *connStats {
+	return &connStats{
+		in:  make(map[string]MessageStatistics),
+		out: make(map[string]MessageStatistics),
+	}
+}
+
+func (s *connStats) received(msgType int, bytes int) {
+	s.mut.Lock()
+	s.in[messageTypeNames[msgType]] = s.in[messageTypeNames[msgType]].add(bytes)
+	s.mut.Unlock()
+}
+
+func (s *connStats) sent(msgType int, bytes int) {
+	s.mut.Lock()
+	s.out[messageTypeNames[msgType]] = s.out[messageTypeNames[msgType]].add(bytes)
+	s.mut.Unlock()
+}
+
+func (m MessageStatistics) add(bytes int) MessageStatistics {
+	m.Count++
+	m.Bytes += uint64(bytes)
+	return m
+}
+
+func (s *connStats) ping(rtt time.Duration) {
+	s.mut.Lock()
+	s.pingRTT = rtt
+	s.mut.Unlock()
+}
+
+// requestStarted records a newly sent request and returns the time it was
+// sent, to be passed to requestDone.
+func (s *connStats) requestStarted() time.Time {
+	s.mut.Lock()
+	s.outstanding++
+	s.mut.Unlock()
+	return time.Now()
+}
+
+// requestDone records the end of a request. The latency is only recorded
+// if a response was received.
+func (s *connStats) requestDone(t0 time.Time, responded bool) {
+	s.mut.Lock()
+	s.outstanding--
+	if responded {
+		s.responses++
+		s.totalLatency += time.Since(t0)
+	}
+	s.mut.Unlock()
+}
+
+// fill sets the tracked values in the statistics.
+func (s *connStats) fill(st *Statistics) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	st.PingRTT = s.pingRTT
+	st.OutstandingRequests = s.outstanding
+	if s.responses > 0 {
+		st.AvgResponseLatency = s.totalLatency / time.Duration(s.responses)
+	}
+
+	st.InMessages = make(map[string]MessageStatistics, len(s.in))
+	for k, v := range s.in {
+		st.InMessages[k] = v
+	}
+	st.OutMessages = make(map[string]MessageStatistics, len(s.out))
+	for k, v := range s.out {
+		st.OutMessages[k] = v
+	}
+}
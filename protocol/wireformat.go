@@ -29,15 +29,30 @@ func (c wireFormatConnection) Index(repo string, fs []FileInfo) {
 	c.next.Index(repo, myFs)
 }
 
-func (c wireFormatConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+func (c wireFormatConnection) IndexUpdate(repo string, fs []FileInfo, maxLocalVersion uint64) {
+	var myFs = make([]FileInfo, len(fs))
+	copy(myFs, fs)
+
+	for i := range fs {
+		myFs[i].Name = norm.NFC.String(filepath.ToSlash(myFs[i].Name))
+	}
+
+	c.next.IndexUpdate(repo, myFs, maxLocalVersion)
+}
+
+func (c wireFormatConnection) Request(repo, name string, offset int64, size int, hash []byte, cancel <-chan struct{}) ([]byte, error) {
 	name = norm.NFC.String(filepath.ToSlash(name))
-	return c.next.Request(repo, name, offset, size)
+	return c.next.Request(repo, name, offset, size, hash, cancel)
 }
 
 func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.next.ClusterConfig(config)
 }
 
+func (c wireFormatConnection) HasFeature(feature string) bool {
+	return c.next.HasFeature(feature)
+}
+
 func (c wireFormatConnection) Statistics() Statistics {
 	return c.next.Statistics()
 }
@@ -9,9 +9,30 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"sync"
+
+	"github.com/calmh/syncthing/protocol"
 )
 
-const StandardBlockSize = 128 * 1024
+const (
+	StandardBlockSize = protocol.BlockSize
+
+	// The number of blocks we aim to stay below when selecting a block
+	// size for a file.
+	desiredBlocksPerFile = 2000
+)
+
+// BlockSizeFor returns the block size to use when hashing a file of the
+// given size. This is the smallest power of two between StandardBlockSize and
+// protocol.MaxBlockSize that results in no more than desiredBlocksPerFile
+// blocks.
+func BlockSizeFor(size int64) int {
+	bs := StandardBlockSize
+	for bs < protocol.MaxBlockSize && size > int64(bs)*desiredBlocksPerFile {
+		bs *= 2
+	}
+	return bs
+}
 
 type Block struct {
 	Offset int64
@@ -23,6 +44,46 @@ func (b Block) String() string {
 	return fmt.Sprintf("%d/%d/%x", b.Offset, b.Size, b.Hash)
 }
 
+// The hashes of all-zero blocks of the possible block sizes, computed on
+// first use.
+var (
+	zeroHashes    = make(map[uint32][]byte)
+	zeroHashesMut sync.Mutex
+)
+
+// IsAllZeros returns true if the block is known to contain only zero bytes.
+// Only full size blocks, i.e. blocks of one of the block sizes returned by
+// BlockSizeFor, are recognized.
+func (b Block) IsAllZeros() bool {
+	if !validBlockSize(b.Size) {
+		return false
+	}
+	return bytes.Equal(b.Hash, zeroHash(b.Size))
+}
+
+func validBlockSize(size uint32) bool {
+	for bs := uint32(StandardBlockSize); bs <= protocol.MaxBlockSize; bs *= 2 {
+		if size == bs {
+			return true
+		}
+	}
+	return false
+}
+
+func zeroHash(size uint32) []byte {
+	zeroHashesMut.Lock()
+	defer zeroHashesMut.Unlock()
+
+	h, ok := zeroHashes[size]
+	if !ok {
+		hf := sha256.New()
+		hf.Write(make([]byte, size))
+		h = hf.Sum(nil)
+		zeroHashes[size] = h
+	}
+	return h
+}
+
 // Blocks returns the blockwise hash of the reader.
 func Blocks(r io.Reader, blocksize int) ([]Block, error) {
 	var blocks []Block
@@ -61,7 +122,8 @@ func Blocks(r io.Reader, blocksize int) ([]Block, error) {
 }
 
 // BlockDiff returns lists of common and missing (to transform src into tgt)
-// blocks. Both block lists must have been created with the same block size.
+// blocks. The block lists may have been created with different block sizes;
+// a block is only considered common when the offset, size and hash all match.
 func BlockDiff(src, tgt []Block) (have, need []Block) {
 	if len(tgt) == 0 && len(src) != 0 {
 		return nil, nil
@@ -73,7 +135,7 @@ func BlockDiff(src, tgt []Block) (have, need []Block) {
 	}
 
 	for i := range tgt {
-		if i >= len(src) || bytes.Compare(tgt[i].Hash, src[i].Hash) != 0 {
+		if i >= len(src) || tgt[i].Offset != src[i].Offset || tgt[i].Size != src[i].Size || bytes.Compare(tgt[i].Hash, src[i].Hash) != 0 {
 			// Copy differing block
 			need = append(need, tgt[i])
 		} else {
@@ -8,6 +8,8 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+
+	"github.com/calmh/syncthing/protocol"
 )
 
 var blocksTestData = []struct {
@@ -99,6 +101,36 @@ var diffTestData = []struct {
 	{"cont", "contents", 3, []Block{{3, 3, nil}, {6, 2, nil}}},
 }
 
+func TestDiffBlockSizes(t *testing.T) {
+	a, _ := Blocks(bytes.NewBufferString("contents"), 4)
+	b, _ := Blocks(bytes.NewBufferString("contents"), 2)
+	have, need := BlockDiff(a, b)
+	if len(have) != 0 {
+		t.Errorf("Unexpected common blocks %v", have)
+	}
+	if len(need) != 4 {
+		t.Errorf("Incorrect number of needed blocks %d != 4", len(need))
+	}
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	var tests = []struct {
+		size int64
+		bs   int
+	}{
+		{0, StandardBlockSize},
+		{StandardBlockSize, StandardBlockSize},
+		{StandardBlockSize * desiredBlocksPerFile, StandardBlockSize},
+		{StandardBlockSize*desiredBlocksPerFile + 1, 2 * StandardBlockSize},
+		{1 << 40, protocol.MaxBlockSize},
+	}
+	for i, tc := range tests {
+		if bs := BlockSizeFor(tc.size); bs != tc.bs {
+			t.Errorf("Incorrect block size for case #%d; %d != %d", i, bs, tc.bs)
+		}
+	}
+}
+
 func TestDiff(t *testing.T) {
 	for i, test := range diffTestData {
 		a, _ := Blocks(bytes.NewBufferString(test.a), test.s)
@@ -118,3 +150,30 @@ func TestDiff(t *testing.T) {
 		}
 	}
 }
+
+func TestAllZeroBlocks(t *testing.T) {
+	data := make([]byte, 2*StandardBlockSize+100)
+	data[len(data)-1] = 1
+	data = append(data, make([]byte, 2*StandardBlockSize)...)
+
+	blocks, err := Blocks(bytes.NewReader(data), 2*StandardBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []bool{true, false, false}
+	if len(blocks) != len(expected) {
+		t.Fatalf("Incorrect number of blocks %d != %d", len(blocks), len(expected))
+	}
+	for i := range blocks {
+		if z := blocks[i].IsAllZeros(); z != expected[i] {
+			t.Errorf("%d: IsAllZeros %v != %v", i, z, expected[i])
+		}
+	}
+
+	// Short blocks are not recognized
+	blocks, _ = Blocks(bytes.NewReader(make([]byte, 1000)), StandardBlockSize)
+	if blocks[0].IsAllZeros() {
+		t.Error("Short block recognized as all zeros")
+	}
+}
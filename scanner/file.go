@@ -4,21 +4,26 @@
 
 package scanner
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/calmh/syncthing/protocol"
+)
 
 type File struct {
-	Name       string
-	Flags      uint32
-	Modified   int64
-	Version    uint64
-	Size       int64
-	Blocks     []Block
-	Suppressed bool
+	Name         string
+	Flags        uint32
+	Modified     int64
+	Version      uint64
+	LocalVersion uint64
+	Size         int64
+	Blocks       []Block
+	Suppressed   bool
 }
 
 func (f File) String() string {
-	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%d, Size:%d, Blocks:%v, Sup:%v}",
-		f.Name, f.Flags, f.Modified, f.Version, f.Size, f.Blocks, f.Suppressed)
+	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%d, LocalVersion:%d, Size:%d, Blocks:%v, Sup:%v}",
+		f.Name, f.Flags, f.Modified, f.Version, f.LocalVersion, f.Size, f.Blocks, f.Suppressed)
 }
 
 func (f File) Equals(o File) bool {
@@ -28,3 +33,9 @@ func (f File) Equals(o File) bool {
 func (f File) NewerThan(o File) bool {
 	return f.Modified > o.Modified || (f.Modified == o.Modified && f.Version > o.Version)
 }
+
+// BlockSize returns the block size the file was hashed with, as recorded in
+// the flags.
+func (f File) BlockSize() int {
+	return protocol.BlockSizeFromBits(f.Flags)
+}
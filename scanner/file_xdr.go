@@ -28,6 +28,7 @@ func (o File) encodeXDR(xw *xdr.Writer) (int, error) {
 	xw.WriteUint32(o.Flags)
 	xw.WriteUint64(uint64(o.Modified))
 	xw.WriteUint64(o.Version)
+	xw.WriteUint64(o.LocalVersion)
 	xw.WriteUint64(uint64(o.Size))
 	xw.WriteUint32(uint32(len(o.Blocks)))
 	for i := range o.Blocks {
@@ -53,6 +54,7 @@ func (o *File) decodeXDR(xr *xdr.Reader) error {
 	o.Flags = xr.ReadUint32()
 	o.Modified = int64(xr.ReadUint64())
 	o.Version = xr.ReadUint64()
+	o.LocalVersion = xr.ReadUint64()
 	o.Size = int64(xr.ReadUint64())
 	_BlocksSize := int(xr.ReadUint32())
 	o.Blocks = make([]Block, _BlocksSize)
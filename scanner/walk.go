@@ -9,7 +9,6 @@ import (
 	"code.google.com/p/go.text/unicode/norm"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -17,13 +16,20 @@ import (
 	"time"
 
 	"github.com/calmh/syncthing/lamport"
+	"github.com/calmh/syncthing/osutil"
 	"github.com/calmh/syncthing/protocol"
 )
 
 type Walker struct {
 	// Dir is the base directory for the walk
 	Dir string
-	// BlockSize controls the size of the block used when hashing.
+	// If Sub is not empty, only the named file or directory below Dir is
+	// walked. File names are still relative to Dir.
+	Sub string
+	// BlockSize controls the size of the block used when hashing. If
+	// BlockSize is zero, the block size is chosen per file by BlockSizeFor.
+	// Otherwise it should be StandardBlockSize times a power of two, since
+	// the block size is recorded in the file flags.
 	BlockSize int
 	// If IgnoreFile is not empty, it is the name used for the file that holds ignore patterns.
 	IgnoreFile string
@@ -39,6 +45,23 @@ type Walker struct {
 	// detected. Scanned files will get zero permission bits and the
 	// NoPermissionBits flag set.
 	IgnorePerms bool
+	// Filesystem is the filesystem that Dir is on. If Filesystem is nil,
+	// the native filesystem is used.
+	Filesystem osutil.Filesystem
+}
+
+// ErrFileModified is the error recorded for files that changed while they
+// were being hashed. Such files are rescanned at the next walk.
+var ErrFileModified = errors.New("file modified during hashing")
+
+// A FileError describes a file or directory that could not be scanned.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
 }
 
 type TempNamer interface {
@@ -59,13 +82,16 @@ type CurrentFiler interface {
 }
 
 // Walk returns the list of files found in the local repository by scanning the
-// file system. Files are blockwise hashed.
-func (w *Walker) Walk() (files []File, ignore map[string][]string, err error) {
+// file system. Files are blockwise hashed. Files and directories that could
+// not be read are not returned in the list of files but in the list of
+// errors.
+func (w *Walker) Walk() (files []File, ignore map[string][]string, errs []FileError, err error) {
 	if debug {
 		l.Debugln("Walk", w.Dir, w.BlockSize, w.IgnoreFile)
 	}
 
-	err = checkDir(w.Dir)
+	fs := w.fs()
+	err = checkDir(fs, w.Dir)
 	if err != nil {
 		return
 	}
@@ -73,10 +99,10 @@ func (w *Walker) Walk() (files []File, ignore map[string][]string, err error) {
 	t0 := time.Now()
 
 	ignore = make(map[string][]string)
-	hashFiles := w.walkAndHashFiles(&files, ignore)
+	hashFiles := w.walkAndHashFiles(&files, &errs, ignore)
 
-	filepath.Walk(w.Dir, w.loadIgnoreFiles(w.Dir, ignore))
-	filepath.Walk(w.Dir, hashFiles)
+	fs.Walk(w.Dir, w.loadIgnoreFiles(w.Dir, ignore))
+	fs.Walk(filepath.Join(w.Dir, w.Sub), hashFiles)
 
 	if debug {
 		t1 := time.Now()
@@ -84,13 +110,20 @@ func (w *Walker) Walk() (files []File, ignore map[string][]string, err error) {
 		l.Debugf("Walk in %.02f ms, %.0f files/s", d*1000, float64(len(files))/d)
 	}
 
-	err = checkDir(w.Dir)
+	err = checkDir(fs, w.Dir)
 	return
 }
 
 // CleanTempFiles removes all files that match the temporary filename pattern.
 func (w *Walker) CleanTempFiles() {
-	filepath.Walk(w.Dir, w.cleanTempFile)
+	w.fs().Walk(w.Dir, w.cleanTempFile)
+}
+
+func (w *Walker) fs() osutil.Filesystem {
+	if w.Filesystem == nil {
+		return osutil.NativeFilesystem{}
+	}
+	return w.Filesystem
 }
 
 func (w *Walker) loadIgnoreFiles(dir string, ign map[string][]string) filepath.WalkFunc {
@@ -106,7 +139,7 @@ func (w *Walker) loadIgnoreFiles(dir string, ign map[string][]string) filepath.W
 
 		if pn, sn := filepath.Split(rn); sn == w.IgnoreFile {
 			pn := filepath.Clean(pn)
-			bs, _ := ioutil.ReadFile(p)
+			bs, _ := osutil.ReadFile(w.fs(), p)
 			lines := bytes.Split(bs, []byte("\n"))
 			var patterns []string
 			for _, line := range lines {
@@ -122,20 +155,25 @@ func (w *Walker) loadIgnoreFiles(dir string, ign map[string][]string) filepath.W
 	}
 }
 
-func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath.WalkFunc {
-	return func(p string, info os.FileInfo, err error) error {
+func (w *Walker) walkAndHashFiles(res *[]File, errs *[]FileError, ign map[string][]string) filepath.WalkFunc {
+	return func(p string, info os.FileInfo, walkErr error) error {
+		rn, err := filepath.Rel(w.Dir, p)
 		if err != nil {
 			if debug {
-				l.Debugln("error:", p, info, err)
+				l.Debugln("rel error:", p, err)
 			}
+			*errs = append(*errs, FileError{p, err})
 			return nil
 		}
 
-		rn, err := filepath.Rel(w.Dir, p)
-		if err != nil {
+		if walkErr != nil {
+			if sn := filepath.Base(rn); sn == w.IgnoreFile || sn == ".stversions" || w.ignoreFile(ign, rn) {
+				return nil
+			}
 			if debug {
-				l.Debugln("rel error:", p, err)
+				l.Debugln("error:", p, info, walkErr)
 			}
+			*errs = append(*errs, FileError{rn, walkErr})
 			return nil
 		}
 
@@ -230,21 +268,28 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 				}
 			}
 
-			fd, err := os.Open(p)
+			fd, err := w.fs().Open(p)
 			if err != nil {
 				if debug {
 					l.Debugln("open:", p, err)
 				}
+				*errs = append(*errs, FileError{rn, err})
 				return nil
 			}
 			defer fd.Close()
 
+			bs := w.BlockSize
+			if bs == 0 {
+				bs = BlockSizeFor(info.Size())
+			}
+
 			t0 := time.Now()
-			blocks, err := Blocks(fd, w.BlockSize)
+			blocks, err := Blocks(fd, bs)
 			if err != nil {
 				if debug {
 					l.Debugln("hash error:", rn, err)
 				}
+				*errs = append(*errs, FileError{rn, err})
 				return nil
 			}
 			if debug {
@@ -252,10 +297,25 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 				l.Debugln("hashed:", rn, ";", len(blocks), "blocks;", info.Size(), "bytes;", int(float64(info.Size())/1024/t1.Sub(t0).Seconds()), "KB/s")
 			}
 
+			// The block list is only useful if it describes the file as it
+			// was when we started hashing and still is now. Otherwise we
+			// leave the file for the next scan.
+			if after, err := fd.Stat(); err != nil {
+				*errs = append(*errs, FileError{rn, err})
+				return nil
+			} else if after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) || blocksSize(blocks) != info.Size() {
+				if debug {
+					l.Debugln("modified during hashing:", rn, info.Size(), info.ModTime(), after.Size(), after.ModTime())
+				}
+				*errs = append(*errs, FileError{rn, ErrFileModified})
+				return nil
+			}
+
 			var flags = uint32(info.Mode() & os.ModePerm)
 			if w.IgnorePerms {
 				flags = protocol.FlagNoPermBits | 0666
 			}
+			flags |= protocol.BlockSizeBits(bs)
 			f := File{
 				Name:     rn,
 				Version:  lamport.Default.Tick(0),
@@ -276,7 +336,7 @@ func (w *Walker) cleanTempFile(path string, info os.FileInfo, err error) error {
 		return err
 	}
 	if info.Mode()&os.ModeType == 0 && w.TempNamer.IsTemporary(path) {
-		os.Remove(path)
+		w.fs().Remove(path)
 	}
 	return nil
 }
@@ -295,8 +355,16 @@ func (w *Walker) ignoreFile(patterns map[string][]string, file string) bool {
 	return false
 }
 
-func checkDir(dir string) error {
-	if info, err := os.Lstat(dir); err != nil {
+func blocksSize(blocks []Block) int64 {
+	var size int64
+	for _, b := range blocks {
+		size += int64(b.Size)
+	}
+	return size
+}
+
+func checkDir(fs osutil.Filesystem, dir string) error {
+	if info, err := fs.Lstat(dir); err != nil {
 		return err
 	} else if !info.IsDir() {
 		return errors.New(dir + ": not a directory")
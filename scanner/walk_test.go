@@ -5,10 +5,16 @@
 package scanner
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/calmh/syncthing/osutil"
 )
 
 var testdata = []struct {
@@ -31,7 +37,7 @@ func TestWalk(t *testing.T) {
 		BlockSize:  128 * 1024,
 		IgnoreFile: ".stignore",
 	}
-	files, ignores, err := w.Walk()
+	files, ignores, _, err := w.Walk()
 
 	if err != nil {
 		t.Fatal(err)
@@ -68,7 +74,7 @@ func TestWalkError(t *testing.T) {
 		BlockSize:  128 * 1024,
 		IgnoreFile: ".stignore",
 	}
-	_, _, err := w.Walk()
+	_, _, _, err := w.Walk()
 
 	if err == nil {
 		t.Error("no error from missing directory")
@@ -79,13 +85,181 @@ func TestWalkError(t *testing.T) {
 		BlockSize:  128 * 1024,
 		IgnoreFile: ".stignore",
 	}
-	_, _, err = w.Walk()
+	_, _, _, err = w.Walk()
 
 	if err == nil {
 		t.Error("no error from non-directory")
 	}
 }
 
+// A faultyFilesystem fails to open the files in openErrs and calls the
+// function in atEOF when the named file has been read to the end.
+type faultyFilesystem struct {
+	*osutil.FakeFilesystem
+	openErrs map[string]error
+	atEOF    map[string]func()
+}
+
+func (fs faultyFilesystem) Open(name string) (osutil.File, error) {
+	if err, ok := fs.openErrs[name]; ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	fd, err := fs.FakeFilesystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if fn, ok := fs.atEOF[name]; ok {
+		return &eofHookFile{File: fd, fn: fn}, nil
+	}
+	return fd, nil
+}
+
+type eofHookFile struct {
+	osutil.File
+	fn func()
+}
+
+func (f *eofHookFile) Read(bs []byte) (int, error) {
+	n, err := f.File.Read(bs)
+	if err == io.EOF && f.fn != nil {
+		f.fn()
+		f.fn = nil
+	}
+	return n, err
+}
+
+func newFaultyFilesystem(t *testing.T, dir string, names ...string) faultyFilesystem {
+	fs := faultyFilesystem{
+		FakeFilesystem: osutil.NewFakeFilesystem(),
+		openErrs:       make(map[string]error),
+		atEOF:          make(map[string]func()),
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		fd, err := fs.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd.Write([]byte("contents of " + name))
+		fd.Close()
+	}
+	return fs
+}
+
+func walkedNames(files []File) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestWalkUnreadableFile(t *testing.T) {
+	fs := newFaultyFilesystem(t, "repo", "a", "b", "c")
+	fs.openErrs[filepath.Join("repo", "b")] = os.ErrPermission
+
+	w := Walker{
+		Dir:        "repo",
+		Filesystem: fs,
+	}
+	files, _, errs, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := walkedNames(files); !reflect.DeepEqual(names, []string{"a", "c"}) {
+		t.Errorf("Incorrect walked files %v", names)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Incorrect number of file errors %d != 1: %v", len(errs), errs)
+	}
+	if errs[0].Path != "b" {
+		t.Errorf("Incorrect file error path %q != %q", errs[0].Path, "b")
+	}
+	if perr, ok := errs[0].Err.(*os.PathError); !ok || perr.Err != os.ErrPermission {
+		t.Errorf("Incorrect file error %v", errs[0].Err)
+	}
+}
+
+func TestWalkModifiedDuringHashing(t *testing.T) {
+	name := filepath.Join("repo", "b")
+	var modifications = []func(fs faultyFilesystem){
+		func(fs faultyFilesystem) {
+			fd, _ := fs.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+			fd.Write([]byte("more"))
+			fd.Close()
+		},
+		func(fs faultyFilesystem) {
+			t0 := time.Now().Add(time.Hour)
+			fs.Chtimes(name, t0, t0)
+		},
+	}
+
+	for i, modify := range modifications {
+		fs := newFaultyFilesystem(t, "repo", "a", "b")
+		modify := modify
+		fs.atEOF[name] = func() { modify(fs) }
+
+		w := Walker{
+			Dir:        "repo",
+			Filesystem: fs,
+		}
+		files, _, errs, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if names := walkedNames(files); !reflect.DeepEqual(names, []string{"a"}) {
+			t.Errorf("Incorrect walked files %v for case #%d", names, i)
+		}
+		if !reflect.DeepEqual(errs, []FileError{{"b", ErrFileModified}}) {
+			t.Errorf("Incorrect file errors %v for case #%d", errs, i)
+		}
+	}
+}
+
+func TestWalkBlockSize(t *testing.T) {
+	var tests = []struct {
+		walkBlockSize int
+		size          int
+		blockSize     int
+	}{
+		{0, 1000, StandardBlockSize},
+		{StandardBlockSize, 1000, StandardBlockSize},
+		{StandardBlockSize, 3 * StandardBlockSize, StandardBlockSize},
+		{4 * StandardBlockSize, 1000, 4 * StandardBlockSize},
+		{4 * StandardBlockSize, 5 * StandardBlockSize, 4 * StandardBlockSize},
+	}
+
+	for i, tc := range tests {
+		fs := newFaultyFilesystem(t, "repo")
+		fd, _ := fs.Create(filepath.Join("repo", "file"))
+		fd.Write(bytes.Repeat([]byte{1}, tc.size))
+		fd.Close()
+
+		w := Walker{
+			Dir:        "repo",
+			BlockSize:  tc.walkBlockSize,
+			Filesystem: fs,
+		}
+		files, _, _, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("Incorrect number of walked files %d != 1 for case #%d", len(files), i)
+		}
+		if bs := files[0].BlockSize(); bs != tc.blockSize {
+			t.Errorf("Incorrect block size %d != %d for case #%d", bs, tc.blockSize, i)
+		}
+		if n := (tc.size + tc.blockSize - 1) / tc.blockSize; len(files[0].Blocks) != n {
+			t.Errorf("Incorrect number of blocks %d != %d for case #%d", len(files[0].Blocks), n, i)
+		}
+	}
+}
+
 func TestIgnore(t *testing.T) {
 	var patterns = map[string][]string{
 		".":       {"t2"},
@@ -22,10 +22,11 @@ func init() {
 // The type holds our configuration
 type Simple struct {
 	keep int
+	fs   osutil.Filesystem
 }
 
 // The constructor function takes a map of parameters and creates the type.
-func NewSimple(params map[string]string) Versioner {
+func NewSimple(fs osutil.Filesystem, repoDir string, params map[string]string) Versioner {
 	keep, err := strconv.Atoi(params["keep"])
 	if err != nil {
 		keep = 5 // A reasonable default
@@ -33,6 +34,7 @@ func NewSimple(params map[string]string) Versioner {
 
 	s := Simple{
 		keep: keep,
+		fs:   fs,
 	}
 
 	if debug {
@@ -41,10 +43,13 @@ func NewSimple(params map[string]string) Versioner {
 	return s
 }
 
+// Stop does nothing; old versions are only removed when archiving.
+func (v Simple) Stop() {}
+
 // Move away the named file to a version archive. If this function returns
 // nil, the named file does not exist any more (has been archived).
 func (v Simple) Archive(path string) error {
-	_, err := os.Stat(path)
+	_, err := v.fs.Stat(path)
 	if err != nil && os.IsNotExist(err) {
 		return nil
 	}
@@ -55,7 +60,7 @@ func (v Simple) Archive(path string) error {
 
 	file := filepath.Base(path)
 	dir := filepath.Join(filepath.Dir(path), ".stversions")
-	err = os.MkdirAll(dir, 0755)
+	err = v.fs.MkdirAll(dir, 0755)
 	if err != nil && !os.IsExist(err) {
 		return err
 	} else {
@@ -63,12 +68,12 @@ func (v Simple) Archive(path string) error {
 	}
 
 	ver := file + "~" + time.Now().Format("20060102-150405")
-	err = osutil.Rename(path, filepath.Join(dir, ver))
+	err = osutil.Rename(v.fs, path, filepath.Join(dir, ver))
 	if err != nil {
 		return err
 	}
 
-	versions, err := filepath.Glob(filepath.Join(dir, file+"~*"))
+	versions, err := osutil.Glob(v.fs, filepath.Join(dir, file+"~*"))
 	if err != nil {
 		l.Warnln(err)
 		return nil
@@ -77,7 +82,7 @@ func (v Simple) Archive(path string) error {
 	if len(versions) > v.keep {
 		sort.Strings(versions)
 		for _, toRemove := range versions[:len(versions)-v.keep] {
-			err = os.Remove(toRemove)
+			err = v.fs.Remove(toRemove)
 			if err != nil {
 				l.Warnln(err)
 			}
@@ -0,0 +1,247 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package versioner
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+func init() {
+	// Register the constructor for this type of versioner with the name "staggered"
+	Factories["staggered"] = NewStaggered
+}
+
+// The format of the time in the names of versions, which is always in UTC so
+// that the age of versions doesn't change with the time zone.
+const versionTimes = "20060102-150405"
+
+// An interval keeps at most one version per step for versions younger than
+// end, both in seconds.
+type interval struct {
+	step int64
+	end  int64
+}
+
+// The type holds our configuration
+type Staggered struct {
+	versionsPath  string
+	repoDir       string
+	cleanInterval int64
+	intervals     []interval
+	fs            osutil.Filesystem
+	now           func() time.Time
+	stop          chan struct{} // closed to stop the clean loop
+}
+
+// The constructor function takes a map of parameters and creates the type.
+// The parameters are maxAge, the age in seconds after which versions are
+// removed, and cleanInterval, the time in seconds between removals of
+// expired versions, or zero for none except when archiving.
+func NewStaggered(fs osutil.Filesystem, repoDir string, params map[string]string) Versioner {
+	maxAge, err := strconv.ParseInt(params["maxAge"], 10, 0)
+	if err != nil {
+		maxAge = 365 * 86400 // A reasonable default
+	}
+
+	cleanInterval, err := strconv.ParseInt(params["cleanInterval"], 10, 0)
+	if err != nil {
+		cleanInterval = 3600 // Once an hour
+	}
+
+	s := &Staggered{
+		versionsPath:  filepath.Join(repoDir, versionsDir),
+		repoDir:       repoDir,
+		cleanInterval: cleanInterval,
+		intervals: []interval{
+			{30, 3600},          // one per 30 seconds for the first hour
+			{3600, 86400},       // one per hour for the first day
+			{86400, 30 * 86400}, // one per day for the first month
+			{7 * 86400, maxAge}, // one per week until the max age
+		},
+		fs:   fs,
+		now:  time.Now,
+		stop: make(chan struct{}),
+	}
+
+	if debug {
+		l.Debugf("instantiated %#v", s)
+	}
+
+	if cleanInterval > 0 {
+		go s.cleanLoop()
+	}
+	return s
+}
+
+func (v *Staggered) cleanLoop() {
+	ticker := time.NewTicker(time.Duration(v.cleanInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+			v.clean()
+		}
+	}
+}
+
+// Stop stops the periodic cleaning.
+func (v *Staggered) Stop() {
+	close(v.stop)
+}
+
+// clean removes the expired versions of all files, and directories left
+// empty in the versions tree.
+func (v *Staggered) clean() {
+	if debug {
+		l.Debugln("cleaning", v.versionsPath)
+	}
+
+	versions := make(map[string][]string) // original path -> versions
+	var dirs []string
+
+	v.fs.Walk(v.versionsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != v.versionsPath {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if name, _, ok := versionTime(path); ok {
+			versions[name] = append(versions[name], path)
+		}
+		return nil
+	})
+
+	for _, vs := range versions {
+		v.expire(vs)
+	}
+
+	// Remove the deepest directories first; removing one that is not
+	// empty fails.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		v.fs.Remove(dirs[i])
+	}
+}
+
+// Move away the named file to a version archive. If this function returns
+// nil, the named file does not exist any more (has been archived).
+func (v *Staggered) Archive(path string) error {
+	_, err := v.fs.Stat(path)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+
+	if debug {
+		l.Debugln("archiving", path)
+	}
+
+	rel, err := filepath.Rel(v.repoDir, path)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(v.versionsPath, filepath.Dir(rel))
+	err = v.fs.MkdirAll(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	} else {
+		osutil.HideFile(v.versionsPath)
+	}
+
+	file := filepath.Base(path)
+	ver := file + "~" + v.now().UTC().Format(versionTimes)
+	err = osutil.Rename(v.fs, path, filepath.Join(dir, ver))
+	if err != nil {
+		return err
+	}
+
+	matches, err := osutil.Glob(v.fs, filepath.Join(dir, file+"~*"))
+	if err != nil {
+		l.Warnln(err)
+		return nil
+	}
+
+	// The pattern also matches the versions of other files whose names
+	// start with the same name and a tilde.
+	var versions []string
+	for _, match := range matches {
+		if name, _, ok := versionTime(match); ok && name == filepath.Join(dir, file) {
+			versions = append(versions, match)
+		}
+	}
+	v.expire(versions)
+
+	return nil
+}
+
+// expire removes the versions of a file that are older than the max age,
+// or closer in time to a newer kept version than the interval they are in
+// allows. The newest version is always kept.
+func (v *Staggered) expire(versions []string) {
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+
+	now := v.now()
+	maxAge := v.intervals[len(v.intervals)-1].end
+	var keptAge int64 = -1
+
+	for _, path := range versions {
+		_, t, ok := versionTime(path)
+		if !ok {
+			continue
+		}
+		age := int64(now.Sub(t).Seconds())
+
+		remove := age > maxAge
+		if !remove && keptAge >= 0 {
+			step := v.intervals[len(v.intervals)-1].step
+			for _, iv := range v.intervals {
+				if age < iv.end {
+					step = iv.step
+					break
+				}
+			}
+			remove = age-keptAge < step
+		}
+
+		if !remove {
+			keptAge = age
+			continue
+		}
+
+		if debug {
+			l.Debugln("expiring", path)
+		}
+		if err := v.fs.Remove(path); err != nil {
+			l.Warnln(err)
+		}
+	}
+}
+
+// versionTime splits the name of a version into the name of the file and
+// the time the version was archived.
+func versionTime(path string) (string, time.Time, bool) {
+	i := strings.LastIndex(path, "~")
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	t, err := time.Parse(versionTimes, path[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return path[:i], t, true
+}
@@ -0,0 +1,184 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package versioner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{time.Date(2014, 8, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func writeFile(t *testing.T, fs osutil.Filesystem, name, data string) {
+	if err := fs.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte(data))
+	fd.Close()
+}
+
+// files returns the names of the files below dir, relative to it.
+func files(fs osutil.Filesystem, dir string) []string {
+	var names []string
+	fs.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			names = append(names, rel)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+func TestStaggeredExpire(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	clock := newFakeClock()
+	v := NewStaggered(fs, "repo", map[string]string{"cleanInterval": "0"}).(*Staggered)
+	v.now = clock.now
+
+	const day = 86400
+	ages := []int64{0, 10, 40, 100, 3000, 3700, 5000, 7400, 90000, 100000, 200000, 40 * day, 400 * day}
+	kept := []int64{0, 40, 100, 3000, 7400, 100000, 200000, 40 * day}
+
+	name := func(age int64) string {
+		return "file~" + clock.now().Add(-time.Duration(age)*time.Second).Format(versionTimes)
+	}
+
+	var versions []string
+	for _, age := range ages {
+		path := filepath.Join("versions", name(age))
+		writeFile(t, fs, path, "")
+		versions = append(versions, path)
+	}
+
+	v.expire(versions)
+
+	var expected []string
+	for _, age := range kept {
+		expected = append(expected, name(age))
+	}
+	sort.Strings(expected)
+	if left := files(fs, "versions"); !reflect.DeepEqual(left, expected) {
+		t.Errorf("Incorrect versions kept\n  %v\n!=%v", left, expected)
+	}
+}
+
+func TestStaggeredArchive(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	clock := newFakeClock()
+	v := NewStaggered(fs, "repo", map[string]string{"maxAge": "86400", "cleanInterval": "0"}).(*Staggered)
+	v.now = clock.now
+
+	path := filepath.Join("repo", "dir", "file")
+	versions := filepath.Join("repo", ".stversions")
+
+	// A version less than 30 seconds older than a newer one is expired.
+	for _, d := range []time.Duration{0, 10 * time.Second, 40 * time.Second} {
+		clock.advance(d)
+		writeFile(t, fs, path, "data")
+		if err := v.Archive(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := fs.Stat(path); !os.IsNotExist(err) {
+		t.Error("Archived file still exists")
+	}
+	expected := []string{
+		filepath.Join("dir", "file~20140801-120010"),
+		filepath.Join("dir", "file~20140801-120050"),
+	}
+	if left := files(fs, versions); !reflect.DeepEqual(left, expected) {
+		t.Errorf("Incorrect versions %v != %v", left, expected)
+	}
+
+	if err := v.Archive(filepath.Join("repo", "nonexistent")); err != nil {
+		t.Error(err)
+	}
+
+	// Past the max age, cleaning removes the versions and the directory
+	// they were in.
+	clock.advance(2 * 24 * time.Hour)
+	v.clean()
+
+	if left := files(fs, versions); len(left) != 0 {
+		t.Errorf("Unexpected versions left %v", left)
+	}
+	if _, err := fs.Stat(filepath.Join(versions, "dir")); !os.IsNotExist(err) {
+		t.Error("Empty directory not removed")
+	}
+	if _, err := fs.Stat(versions); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStaggeredVersionTimeUTC(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	v := NewStaggered(fs, "repo", map[string]string{"cleanInterval": "0"}).(*Staggered)
+	now := time.Date(2014, 8, 1, 14, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	v.now = func() time.Time { return now }
+
+	path := filepath.Join("repo", "file")
+	writeFile(t, fs, path, "data")
+	if err := v.Archive(path); err != nil {
+		t.Fatal(err)
+	}
+
+	version := "file~20140801-120000"
+	if left := files(fs, filepath.Join("repo", ".stversions")); !reflect.DeepEqual(left, []string{version}) {
+		t.Errorf("Incorrect versions %v", left)
+	}
+	if _, vt, ok := versionTime(version); !ok || !vt.Equal(now) {
+		t.Errorf("Incorrect version time %v != %v", vt, now)
+	}
+}
+
+func TestStaggeredArchiveSimilarNames(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	clock := newFakeClock()
+	v := NewStaggered(fs, "repo", map[string]string{"cleanInterval": "0"}).(*Staggered)
+	v.now = clock.now
+
+	// The versions of "file~x" are not versions of "file", so none of them
+	// is expired for being too close to the other.
+	for _, name := range []string{"file~x", "file"} {
+		path := filepath.Join("repo", name)
+		writeFile(t, fs, path, "data")
+		if err := v.Archive(path); err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(10 * time.Second)
+	}
+
+	expected := []string{"file~20140801-120010", "file~x~20140801-120000"}
+	if left := files(fs, filepath.Join("repo", ".stversions")); !reflect.DeepEqual(left, expected) {
+		t.Errorf("Incorrect versions %v != %v", left, expected)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package versioner
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+func init() {
+	// Register the constructor for this type of versioner with the name "trashcan"
+	Factories["trashcan"] = NewTrashcan
+}
+
+// The type holds our configuration
+type Trashcan struct {
+	versionsPath  string
+	repoDir       string
+	cleanoutDays  int
+	cleanInterval int64
+	fs            osutil.Filesystem
+	now           func() time.Time
+	stop          chan struct{} // closed to stop the clean loop
+}
+
+// The constructor function takes a map of parameters and creates the type.
+// The parameters are cleanoutDays, the number of days after which a copy is
+// removed, or zero to keep copies forever, and cleanInterval, the time in
+// seconds between removals of old copies.
+func NewTrashcan(fs osutil.Filesystem, repoDir string, params map[string]string) Versioner {
+	cleanoutDays, _ := strconv.Atoi(params["cleanoutDays"]) // Zero, keep forever, by default
+
+	cleanInterval, err := strconv.ParseInt(params["cleanInterval"], 10, 0)
+	if err != nil {
+		cleanInterval = 3600 // Once an hour
+	}
+
+	t := &Trashcan{
+		versionsPath:  filepath.Join(repoDir, versionsDir),
+		repoDir:       repoDir,
+		cleanoutDays:  cleanoutDays,
+		cleanInterval: cleanInterval,
+		fs:            fs,
+		now:           time.Now,
+		stop:          make(chan struct{}),
+	}
+
+	if debug {
+		l.Debugf("instantiated %#v", t)
+	}
+
+	if cleanoutDays > 0 && cleanInterval > 0 {
+		go t.cleanLoop()
+	}
+	return t
+}
+
+func (v *Trashcan) cleanLoop() {
+	ticker := time.NewTicker(time.Duration(v.cleanInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+			v.cleanout()
+		}
+	}
+}
+
+// Stop stops the periodic cleaning.
+func (v *Trashcan) Stop() {
+	close(v.stop)
+}
+
+// Move away the named file to the trash can, replacing any earlier copy of
+// it. If this function returns nil, the named file does not exist any more
+// (has been archived).
+func (v *Trashcan) Archive(path string) error {
+	_, err := v.fs.Stat(path)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+
+	if debug {
+		l.Debugln("archiving", path)
+	}
+
+	rel, err := filepath.Rel(v.repoDir, path)
+	if err != nil {
+		return err
+	}
+
+	trashed := filepath.Join(v.versionsPath, rel)
+	if err := v.removeParentFiles(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	if info, err := v.fs.Lstat(trashed); err == nil && info.IsDir() {
+		// The trashed copies of the files in a directory that this file
+		// replaced are in the way
+		if err := v.removeTree(trashed); err != nil {
+			return err
+		}
+	}
+	err = v.fs.MkdirAll(filepath.Dir(trashed), 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	} else {
+		osutil.HideFile(v.versionsPath)
+	}
+
+	err = osutil.Rename(v.fs, path, trashed)
+	if err != nil {
+		return err
+	}
+
+	// The cleanout goes by the time the file was put in the trash can
+	t := v.now()
+	if err := v.fs.Chtimes(trashed, t, t); err != nil {
+		l.Warnln(err)
+	}
+
+	return nil
+}
+
+// removeParentFiles removes the trashed copies of files that are in the way
+// of the directory dir, relative to the repository, in the trash can. They
+// were trashed before a directory took their place.
+func (v *Trashcan) removeParentFiles(dir string) error {
+	if dir == "." {
+		return nil
+	}
+
+	path := v.versionsPath
+	for _, part := range strings.Split(dir, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		info, err := v.fs.Stat(path)
+		if err != nil {
+			// Nothing exists further down either
+			return nil
+		}
+		if !info.IsDir() {
+			if debug {
+				l.Debugln("removing", path, "in the way of a directory")
+			}
+			return v.fs.Remove(path)
+		}
+	}
+	return nil
+}
+
+// removeTree removes the directory path in the trash can and everything in
+// it.
+func (v *Trashcan) removeTree(path string) error {
+	if debug {
+		l.Debugln("removing", path, "in the way of a file")
+	}
+
+	var paths []string
+	v.fs.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+
+	// A directory is walked before its contents and must be removed after
+	// them.
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := v.fs.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanout removes the copies older than the cleanout days, and
+// directories left empty in the trash can.
+func (v *Trashcan) cleanout() {
+	if debug {
+		l.Debugln("cleaning out", v.versionsPath)
+	}
+
+	limit := v.now().Add(-time.Duration(v.cleanoutDays) * 24 * time.Hour)
+	var dirs []string
+
+	v.fs.Walk(v.versionsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != v.versionsPath {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if info.ModTime().Before(limit) {
+			if debug {
+				l.Debugln("removing", path)
+			}
+			if err := v.fs.Remove(path); err != nil {
+				l.Warnln(err)
+			}
+		}
+		return nil
+	})
+
+	// Remove the deepest directories first; removing one that is not
+	// empty fails.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		v.fs.Remove(dirs[i])
+	}
+}
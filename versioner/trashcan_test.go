@@ -0,0 +1,148 @@
+// Copyright (C) 2014 Jakob Borg and other contributors. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package versioner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+func TestTrashcanFactory(t *testing.T) {
+	factory, ok := Factories["trashcan"]
+	if !ok {
+		t.Fatal("Trash can versioner not registered")
+	}
+	if _, ok := factory(osutil.NewFakeFilesystem(), "repo", nil).(*Trashcan); !ok {
+		t.Error("Factory does not create a trash can")
+	}
+}
+
+func TestTrashcanArchive(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	v := NewTrashcan(fs, "repo", nil).(*Trashcan)
+
+	path := filepath.Join("repo", "dir", "file")
+	trashed := filepath.Join("repo", ".stversions", "dir", "file")
+
+	// Only the latest copy is kept, at the same path in the trash can
+	for _, data := range []string{"first", "second"} {
+		writeFile(t, fs, path, data)
+		if err := v.Archive(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := fs.Stat(path); !os.IsNotExist(err) {
+		t.Error("Archived file still exists")
+	}
+	if bs, err := osutil.ReadFile(fs, trashed); err != nil || string(bs) != "second" {
+		t.Errorf("Incorrect trashed copy %q, %v", bs, err)
+	}
+	if left := files(fs, filepath.Join("repo", ".stversions")); !reflect.DeepEqual(left, []string{filepath.Join("dir", "file")}) {
+		t.Errorf("Unexpected files in trash can %v", left)
+	}
+
+	if err := v.Archive(filepath.Join("repo", "nonexistent")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrashcanArchiveFileToDirectory(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	v := NewTrashcan(fs, "repo", nil).(*Trashcan)
+
+	// The file "a" is trashed, and then a file in the directory that
+	// replaced it. The trashed copy of "a" is in the way of the directory
+	// in the trash can.
+	for _, name := range []string{"a", filepath.Join("a", "b")} {
+		path := filepath.Join("repo", name)
+		writeFile(t, fs, path, "data")
+		if err := v.Archive(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if left := files(fs, filepath.Join("repo", ".stversions")); !reflect.DeepEqual(left, []string{filepath.Join("a", "b")}) {
+		t.Errorf("Incorrect files in trash can %v", left)
+	}
+}
+
+func TestTrashcanArchiveDirectoryToFile(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	v := NewTrashcan(fs, "repo", nil).(*Trashcan)
+
+	// A file in the directory "a" is trashed, and then the file that
+	// replaced the directory. The directory in the trash can is in the way
+	// of the trashed copy of "a".
+	dir := filepath.Join("repo", "a")
+	file := filepath.Join(dir, "b")
+	writeFile(t, fs, file, "data")
+	if err := v.Archive(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, dir, "data")
+	if err := v.Archive(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if left := files(fs, filepath.Join("repo", ".stversions")); !reflect.DeepEqual(left, []string{"a"}) {
+		t.Errorf("Incorrect files in trash can %v", left)
+	}
+}
+
+func TestTrashcanCleanout(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	clock := newFakeClock()
+	v := NewTrashcan(fs, "repo", map[string]string{"cleanoutDays": "2", "cleanInterval": "0"}).(*Trashcan)
+	v.now = clock.now
+
+	old := filepath.Join("repo", "old", "file")
+	recent := filepath.Join("repo", "recent")
+	versions := filepath.Join("repo", ".stversions")
+
+	writeFile(t, fs, old, "old")
+	v.Archive(old)
+	clock.advance(24 * time.Hour)
+	writeFile(t, fs, recent, "recent")
+	v.Archive(recent)
+
+	// The copies are now two and a half and one and a half days old
+	clock.advance(36 * time.Hour)
+	v.cleanout()
+
+	if left := files(fs, versions); !reflect.DeepEqual(left, []string{"recent"}) {
+		t.Errorf("Incorrect files left in trash can %v", left)
+	}
+	if _, err := fs.Stat(filepath.Join(versions, "old")); !os.IsNotExist(err) {
+		t.Error("Empty directory not removed")
+	}
+}
+
+func TestTrashcanStop(t *testing.T) {
+	fs := osutil.NewFakeFilesystem()
+	v := NewTrashcan(fs, "repo", map[string]string{"cleanoutDays": "1", "cleanInterval": "1"}).(*Trashcan)
+	v.Stop()
+
+	// A copy that would be cleaned out is left alone once stopped
+	old := filepath.Join("repo", ".stversions", "old")
+	writeFile(t, fs, old, "old")
+	then := time.Now().Add(-48 * time.Hour)
+	if err := fs.Chtimes(old, then, then); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := fs.Stat(old); err != nil {
+		t.Error("Copy removed after stop:", err)
+	}
+}
@@ -4,8 +4,19 @@
 
 package versioner
 
+import "github.com/calmh/syncthing/osutil"
+
+// The directory holding the versions of the files in a repository, for the
+// versioners that keep them in one place.
+const versionsDir = ".stversions"
+
 type Versioner interface {
 	Archive(path string) error
+	// Stop stops any background cleaning of old versions.
+	Stop()
 }
 
-var Factories = map[string]func(map[string]string) Versioner{}
+// Factories holds the constructors of the versioner types by name. A
+// versioner archives the files of the repository in repoDir, on the given
+// filesystem.
+var Factories = map[string]func(fs osutil.Filesystem, repoDir string, params map[string]string) Versioner{}
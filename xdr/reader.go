@@ -7,18 +7,19 @@ package xdr
 import (
 	"errors"
 	"io"
+	"sync/atomic"
 	"time"
 )
 
 var ErrElementSizeExceeded = errors.New("element size exceeded")
 
 type Reader struct {
+	last int64 // unix nanoseconds; first for alignment, accessed atomically
 	r    io.Reader
 	tot  int
 	err  error
 	b    [8]byte
 	sb   []byte
-	last time.Time
 }
 
 func NewReader(r io.Reader) *Reader {
@@ -63,7 +64,7 @@ func (r *Reader) ReadBytesMaxInto(max int, dst []byte) []byte {
 	if r.err != nil {
 		return nil
 	}
-	r.last = time.Now()
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
 	s := r.tot
 
 	l := int(r.ReadUint32())
@@ -105,7 +106,7 @@ func (r *Reader) ReadBool() bool {
 	if r.err != nil {
 		return false
 	}
-	r.last = time.Now()
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
 	s := r.tot
 
 	var n int
@@ -130,7 +131,7 @@ func (r *Reader) ReadUint16() uint16 {
 	if r.err != nil {
 		return 0
 	}
-	r.last = time.Now()
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
 	s := r.tot
 
 	var n int
@@ -155,7 +156,7 @@ func (r *Reader) ReadUint32() uint32 {
 	if r.err != nil {
 		return 0
 	}
-	r.last = time.Now()
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
 	s := r.tot
 
 	var n int
@@ -180,7 +181,7 @@ func (r *Reader) ReadUint64() uint64 {
 	if r.err != nil {
 		return 0
 	}
-	r.last = time.Now()
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
 	s := r.tot
 
 	var n int
@@ -211,5 +212,5 @@ func (r *Reader) Error() error {
 }
 
 func (r *Reader) LastRead() time.Time {
-	return r.last
+	return time.Unix(0, atomic.LoadInt64(&r.last))
 }
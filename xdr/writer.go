@@ -6,6 +6,7 @@ package xdr
 
 import (
 	"io"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,11 +21,11 @@ func pad(l int) int {
 var padBytes = []byte{0, 0, 0}
 
 type Writer struct {
+	last int64 // unix nanoseconds; first for alignment, accessed atomically
 	w    io.Writer
 	tot  int
 	err  error
 	b    [8]byte
-	last time.Time
 }
 
 type AppendWriter []byte
@@ -49,7 +50,7 @@ func (w *Writer) WriteBytes(bs []byte) (int, error) {
 		return 0, w.err
 	}
 
-	w.last = time.Now()
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
 	w.WriteUint32(uint32(len(bs)))
 	if w.err != nil {
 		return 0, w.err
@@ -81,7 +82,7 @@ func (w *Writer) WriteBool(v bool) (int, error) {
 		return 0, w.err
 	}
 
-	w.last = time.Now()
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
 	if debug {
 		dl.Debugf("wr uint16=%d", v)
 	}
@@ -106,7 +107,7 @@ func (w *Writer) WriteUint16(v uint16) (int, error) {
 		return 0, w.err
 	}
 
-	w.last = time.Now()
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
 	if debug {
 		dl.Debugf("wr uint16=%d", v)
 	}
@@ -127,7 +128,7 @@ func (w *Writer) WriteUint32(v uint32) (int, error) {
 		return 0, w.err
 	}
 
-	w.last = time.Now()
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
 	if debug {
 		dl.Debugf("wr uint32=%d", v)
 	}
@@ -148,7 +149,7 @@ func (w *Writer) WriteUint64(v uint64) (int, error) {
 		return 0, w.err
 	}
 
-	w.last = time.Now()
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
 	if debug {
 		dl.Debugf("wr uint64=%d", v)
 	}
@@ -177,5 +178,5 @@ func (w *Writer) Error() error {
 }
 
 func (w *Writer) LastWrite() time.Time {
-	return w.last
+	return time.Unix(0, atomic.LoadInt64(&w.last))
 }